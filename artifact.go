@@ -0,0 +1,293 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/static"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/nbctools/oci-store/pkg/ocistore"
+	"github.com/spf13/cobra"
+)
+
+const (
+	defaultArtifactType    = "application/vnd.unknown.artifact.v1"
+	defaultFileMediaType   = "application/vnd.oci.image.layer.v1.tar"
+	emptyConfigMediaType   = "application/vnd.oci.empty.v1+json"
+	titleAnnotation        = "org.opencontainers.image.title"
+	artifactManifestSchema = 2
+)
+
+// artifactManifest is an OCI 1.1 image manifest. v1.Manifest lacks the
+// artifactType field, so artifacts are marshalled with this type instead.
+type artifactManifest struct {
+	SchemaVersion int64             `json:"schemaVersion"`
+	MediaType     types.MediaType   `json:"mediaType"`
+	ArtifactType  string            `json:"artifactType,omitempty"`
+	Config        v1.Descriptor     `json:"config"`
+	Layers        []v1.Descriptor   `json:"layers"`
+	Subject       *v1.Descriptor    `json:"subject,omitempty"`
+	Annotations   map[string]string `json:"annotations,omitempty"`
+}
+
+// rawManifest is a remote.Taggable for an already serialised OCI manifest.
+type rawManifest []byte
+
+func (m rawManifest) RawManifest() ([]byte, error) {
+	return m, nil
+}
+
+func (m rawManifest) MediaType() (types.MediaType, error) {
+	return types.OCIManifestSchema1, nil
+}
+
+func newArtifactCmd(storageType string, validate func() error) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "artifact",
+		Short: "Push and pull arbitrary files as OCI artifacts",
+	}
+
+	pushCmd := &cobra.Command{
+		Use:   "push " + refUsage(storageType) + " <file>[:<media-type>]...",
+		Short: "Push files as an OCI artifact",
+		Args:  cobra.MinimumNArgs(2),
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			return validate()
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			artifactType, _ := cmd.Flags().GetString("artifact-type")
+			policyFile, _ := cmd.Flags().GetString("policy")
+			return pushArtifact(cmd.Context(), storageType, args[0], artifactType, args[1:], policyFile)
+		},
+	}
+	pushCmd.Flags().String("artifact-type", defaultArtifactType, "Artifact type recorded in the manifest")
+	pushCmd.Flags().String("policy", "", "Local policy file enforced in addition to the bucket policy")
+
+	pullCmd := &cobra.Command{
+		Use:   "pull " + refUsage(storageType),
+		Short: "Pull the files of an OCI artifact into a directory",
+		Args:  cobra.ExactArgs(1),
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			return validate()
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			dir, _ := cmd.Flags().GetString("dir")
+			return pullArtifact(cmd.Context(), storageType, args[0], dir)
+		},
+	}
+	pullCmd.Flags().StringP("dir", "o", ".", "Directory to write the artifact files to")
+
+	cmd.AddCommand(pushCmd, pullCmd)
+	return cmd
+}
+
+func pushArtifact(ctx context.Context, storageType string, storageRef string, artifactType string, files []string, policyFile string) error {
+	ref, target, err := openStorageRef(ctx, storageType, storageRef)
+	if err != nil {
+		return err
+	}
+	policies, err := loadPolicies(ctx, storageType, ref.Bucket, policyFile)
+	if err != nil {
+		return err
+	}
+	if err := policies.CheckRepository(target.RepositoryStr()); err != nil {
+		return err
+	}
+	slog.Info("Pushing artifact", "artifact_type", artifactType, "files", len(files), "dest", storageRef)
+
+	layers := make([]v1.Layer, 0, len(files))
+	for _, file := range files {
+		path, mediaType := parseFileArg(file)
+		layer, err := newFileLayer(path, types.MediaType(mediaType))
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", path, err)
+		}
+		layers = append(layers, layer)
+	}
+	if err := checkArtifactSize(policies, layers); err != nil {
+		return err
+	}
+
+	// Check the tag before uploading, so a refused push leaves no blobs.
+	raw, err := buildArtifact(&artifactManifest{ArtifactType: artifactType}, layers)
+	if err != nil {
+		return err
+	}
+	d, _, err := v1.SHA256(bytes.NewReader(raw))
+	if err != nil {
+		return err
+	}
+	if err := policies.CheckTag(target, d, remote.WithContext(ctx), withRegistryTransport()); err != nil {
+		return err
+	}
+	if err := uploadArtifactBlobs(ctx, target.Repository, layers); err != nil {
+		return err
+	}
+	if err := remote.Put(target, raw, remote.WithContext(ctx), withRegistryTransport()); err != nil {
+		return fmt.Errorf("failed to write artifact manifest: %w", err)
+	}
+	slog.Info("Artifact pushed", "dest", storageRef)
+	return nil
+}
+
+// checkArtifactSize fails when the files of an artifact exceed the size
+// limit of policies.
+func checkArtifactSize(policies ocistore.PolicySet, layers []v1.Layer) error {
+	var size int64
+	for _, layer := range layers {
+		n, err := layer.Size()
+		if err != nil {
+			return err
+		}
+		size += n
+	}
+	return policies.CheckSize(size)
+}
+
+// writeArtifact uploads the empty config and the given layers to repo and
+// fills in manifest to reference them.
+func writeArtifact(ctx context.Context, repo name.Repository, manifest *artifactManifest, layers []v1.Layer) (rawManifest, error) {
+	raw, err := buildArtifact(manifest, layers)
+	if err != nil {
+		return nil, err
+	}
+	if err := uploadArtifactBlobs(ctx, repo, layers); err != nil {
+		return nil, err
+	}
+	return raw, nil
+}
+
+// buildArtifact fills in manifest to reference the empty config and the
+// given layers, without uploading them. Layers backed by files are annotated
+// with the file name so they can be restored on pull.
+func buildArtifact(manifest *artifactManifest, layers []v1.Layer) (rawManifest, error) {
+	configDesc, err := layerDescriptor(artifactConfig())
+	if err != nil {
+		return nil, err
+	}
+
+	manifest.SchemaVersion = artifactManifestSchema
+	manifest.MediaType = types.OCIManifestSchema1
+	manifest.Config = configDesc
+	manifest.Layers = []v1.Descriptor{}
+	for _, layer := range layers {
+		desc, err := layerDescriptor(layer)
+		if err != nil {
+			return nil, err
+		}
+		if fl, ok := layer.(*fileLayer); ok {
+			desc.Annotations = map[string]string{titleAnnotation: filepath.Base(fl.path)}
+		}
+		manifest.Layers = append(manifest.Layers, desc)
+	}
+
+	raw, err := json.Marshal(manifest)
+	if err != nil {
+		return nil, err
+	}
+	return rawManifest(raw), nil
+}
+
+// uploadArtifactBlobs uploads the empty config and the given layers to repo.
+func uploadArtifactBlobs(ctx context.Context, repo name.Repository, layers []v1.Layer) error {
+	if err := remote.WriteLayer(repo, artifactConfig(), remote.WithContext(ctx), withRegistryTransport()); err != nil {
+		return fmt.Errorf("failed to upload config: %w", err)
+	}
+	for _, layer := range layers {
+		digest, err := layer.Digest()
+		if err != nil {
+			return err
+		}
+		slog.Debug("Uploading blob", "digest", digest.String())
+		if err := remote.WriteLayer(repo, layer, remote.WithContext(ctx), withRegistryTransport()); err != nil {
+			return fmt.Errorf("failed to upload %s: %w", digest, err)
+		}
+	}
+	return nil
+}
+
+// artifactConfig is the empty config of artifacts.
+func artifactConfig() v1.Layer {
+	return static.NewLayer([]byte("{}"), emptyConfigMediaType)
+}
+
+func pullArtifact(ctx context.Context, storageType string, storageRef string, outDir string) error {
+	_, target, err := openStorageRef(ctx, storageType, storageRef)
+	if err != nil {
+		return err
+	}
+
+	desc, err := remote.Get(target, remote.WithContext(ctx), withRegistryTransport())
+	if err != nil {
+		return err
+	}
+	var manifest artifactManifest
+	if err := json.Unmarshal(desc.Manifest, &manifest); err != nil {
+		return fmt.Errorf("failed to parse manifest: %w", err)
+	}
+	slog.Info("Pulling artifact", "artifact_type", manifest.ArtifactType, "files", len(manifest.Layers), "dest", outDir)
+
+	if err := os.MkdirAll(outDir, 0o750); err != nil {
+		return err
+	}
+	for _, layerDesc := range manifest.Layers {
+		title := layerDesc.Annotations[titleAnnotation]
+		if title == "" {
+			slog.Warn("Skipping blob without a file name", "digest", layerDesc.Digest.String())
+			continue
+		}
+		if err := pullArtifactFile(ctx, target.Repository, layerDesc, outDir, title); err != nil {
+			return err
+		}
+	}
+	slog.Info("Artifact pulled", "name", storageRef, "dest", outDir)
+	return nil
+}
+
+func pullArtifactFile(ctx context.Context, repo name.Repository, desc v1.Descriptor, outDir string, title string) error {
+	if title != filepath.Base(title) || title == ".." || title == "." {
+		return fmt.Errorf("refusing to write file with unsafe name %q", title)
+	}
+	layer, err := remote.Layer(repo.Digest(desc.Digest.String()), remote.WithContext(ctx), withRegistryTransport())
+	if err != nil {
+		return err
+	}
+	rc, err := layer.Compressed()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = rc.Close() }()
+
+	path := filepath.Join(outDir, title)
+	f, err := os.Create(filepath.Clean(path))
+	if err != nil {
+		return err
+	}
+	defer func() { _ = f.Close() }()
+	if _, err := io.Copy(f, rc); err != nil {
+		return fmt.Errorf("failed to download %s: %w", title, err)
+	}
+	slog.Info("Wrote file", "path", path, "size", desc.Size)
+	return f.Close()
+}
+
+// parseFileArg splits a "path[:media-type]" argument.
+func parseFileArg(arg string) (string, string) {
+	if i := strings.LastIndex(arg, ":"); i > 0 {
+		if _, err := os.Stat(arg); errors.Is(err, os.ErrNotExist) {
+			return arg[:i], arg[i+1:]
+		}
+	}
+	return arg, defaultFileMediaType
+}
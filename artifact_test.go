@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+func TestParseFileArg(t *testing.T) {
+	dir := t.TempDir()
+	withColon := filepath.Join(dir, "a:b.txt")
+	if err := os.WriteFile(withColon, []byte("x"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name          string
+		arg           string
+		wantPath      string
+		wantMediaType string
+	}{
+		{
+			name:          "plain file",
+			arg:           "model.bin",
+			wantPath:      "model.bin",
+			wantMediaType: defaultFileMediaType,
+		},
+		{
+			name:          "file with media type",
+			arg:           "chart.tgz:application/vnd.cncf.helm.chart.content.v1.tar+gzip",
+			wantPath:      "chart.tgz",
+			wantMediaType: "application/vnd.cncf.helm.chart.content.v1.tar+gzip",
+		},
+		{
+			name:          "existing file with colon in name",
+			arg:           withColon,
+			wantPath:      withColon,
+			wantMediaType: defaultFileMediaType,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path, mediaType := parseFileArg(tt.arg)
+			if path != tt.wantPath || mediaType != tt.wantMediaType {
+				t.Errorf("parseFileArg() = %q, %q, want %q, %q", path, mediaType, tt.wantPath, tt.wantMediaType)
+			}
+		})
+	}
+}
+
+func TestArtifactRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	host := newTestRegistry(t)
+	target, _ := name.NewTag(host+"/models/classifier:v1", name.Insecure)
+
+	srcDir := t.TempDir()
+	files := map[string]string{
+		"weights.bin": "0123456789",
+		"config.yaml": "layers: 3\n",
+	}
+	var layers []v1.Layer
+	for fileName, content := range files {
+		path := filepath.Join(srcDir, fileName)
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		layer, err := newFileLayer(path, defaultFileMediaType)
+		if err != nil {
+			t.Fatalf("newFileLayer() error = %v", err)
+		}
+		layers = append(layers, layer)
+	}
+
+	raw, err := writeArtifact(ctx, target.Repository, &artifactManifest{ArtifactType: "application/vnd.acme.model"}, layers)
+	if err != nil {
+		t.Fatalf("writeArtifact() error = %v", err)
+	}
+	if err := remote.Put(target, raw); err != nil {
+		t.Fatalf("remote.Put() error = %v", err)
+	}
+
+	desc, err := remote.Get(target)
+	if err != nil {
+		t.Fatalf("remote.Get() error = %v", err)
+	}
+	var manifest artifactManifest
+	if err := json.Unmarshal(desc.Manifest, &manifest); err != nil {
+		t.Fatal(err)
+	}
+	if manifest.ArtifactType != "application/vnd.acme.model" {
+		t.Errorf("artifactType = %q, want application/vnd.acme.model", manifest.ArtifactType)
+	}
+	if manifest.Config.MediaType != emptyConfigMediaType {
+		t.Errorf("config media type = %q, want %q", manifest.Config.MediaType, emptyConfigMediaType)
+	}
+
+	outDir := t.TempDir()
+	for _, layerDesc := range manifest.Layers {
+		title := layerDesc.Annotations[titleAnnotation]
+		if err := pullArtifactFile(ctx, target.Repository, layerDesc, outDir, title); err != nil {
+			t.Fatalf("pullArtifactFile() error = %v", err)
+		}
+	}
+	for fileName, want := range files {
+		got, err := os.ReadFile(filepath.Join(outDir, fileName))
+		if err != nil {
+			t.Fatalf("missing pulled file %s: %v", fileName, err)
+		}
+		if string(got) != want {
+			t.Errorf("%s = %q, want %q", fileName, got, want)
+		}
+	}
+
+	if err := pullArtifactFile(ctx, target.Repository, manifest.Layers[0], outDir, "../escape"); err == nil {
+		t.Error("pullArtifactFile() should refuse path traversal in titles")
+	}
+}
@@ -3,7 +3,6 @@ package main
 import (
 	"errors"
 
-	_ "github.com/distribution/distribution/v3/registry/storage/driver/azure"
 	"github.com/spf13/cobra"
 )
 
@@ -18,15 +17,15 @@ var (
 )
 
 var azurePushCmd = &cobra.Command{
-	Use:   "push <container>/<image-path>:<tag>",
+	Use:   "push <container>/<image-path>:<tag> [<container>/<image-path>:<tag>...]",
+	Long:  "Push a Docker image to Azure Blob Storage. Further references in the same container are tagged after the upload.",
 	Short: "Push a Docker image to Azure Blob Storage",
-	Args:  cobra.ExactArgs(1),
+	Args:  cobra.MinimumNArgs(1),
 	PreRunE: func(cmd *cobra.Command, args []string) error {
 		return validateAzureConfig()
 	},
 	RunE: func(cmd *cobra.Command, args []string) error {
-		localImage, _ := cmd.Flags().GetString("image")
-		return pushImage(cmd.Context(), "azure", args[0], localImage)
+		return pushImage(cmd.Context(), "azure", args, pushOptionsFromFlags(cmd))
 	},
 }
 
@@ -38,7 +37,7 @@ var azurePullCmd = &cobra.Command{
 		return validateAzureConfig()
 	},
 	RunE: func(cmd *cobra.Command, args []string) error {
-		return pullImage(cmd.Context(), "azure", args[0])
+		return pullImage(cmd.Context(), "azure", args[0], pullOptionsFromFlags(cmd))
 	},
 }
 
@@ -67,6 +66,7 @@ func validateAzureConfig() error {
 
 func init() {
 	azureCmd.AddCommand(azurePushCmd, azurePullCmd)
+	azureCmd.AddCommand(newStorageCommands("azure", validateAzureConfig)...)
 
 	azureCmd.PersistentFlags().StringVarP(&azureAccountName, "account-name", "a", "", "Azure storage account name (defaults to AZURE_STORAGE_ACCOUNT env var)")
 	azureCmd.PersistentFlags().StringVarP(&azureAccountKey, "account-key", "k", "", "Azure storage account key (defaults to AZURE_STORAGE_KEY env var)")
@@ -76,5 +76,6 @@ func init() {
 	azureCmd.PersistentFlags().StringVar(&azureTenantId, "tenant-id", "", "The directory(tenant) ID (defaults to AZURE_TENANT_ID)")
 	azureCmd.PersistentFlags().StringVar(&azureSecret, "secret", "", "The client secret(defaults to AZURE_SECRET)")
 
-	azurePushCmd.Flags().StringP("image", "i", "", "Local Docker image to push (defaults to image-path:tag)")
+	addPushFlags(azurePushCmd)
+	addPullFlags(azurePullCmd)
 }
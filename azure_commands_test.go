@@ -136,8 +136,8 @@ func TestAzureCommandSetup(t *testing.T) {
 		t.Errorf("azureCmd.Short = %q, want %q", azureCmd.Short, "Azure Blob Storage operations")
 	}
 
-	if azurePushCmd.Use != "push <container>/<image-path>:<tag>" {
-		t.Errorf("azurePushCmd.Use = %q, want %q", azurePushCmd.Use, "push <container>/<image-path>:<tag>")
+	if azurePushCmd.Use != "push <container>/<image-path>:<tag> [<container>/<image-path>:<tag>...]" {
+		t.Errorf("azurePushCmd.Use = %q, want %q", azurePushCmd.Use, "push <container>/<image-path>:<tag> [<container>/<image-path>:<tag>...]")
 	}
 
 	if azurePullCmd.Use != "pull <container>/<image-path>:<tag>" {
@@ -2,8 +2,19 @@ package main
 
 import (
 	"fmt"
+
+	"github.com/nbctools/oci-store/pkg/ocistore"
+)
+
+type (
+	S3Backend         = ocistore.S3Backend
+	GCSBackend        = ocistore.GCSBackend
+	AzureBackend      = ocistore.AzureBackend
+	FilesystemBackend = ocistore.FilesystemBackend
 )
 
+// NewBackend returns the backend of storageType, configured by the flags of
+// its command.
 func NewBackend(storageType string) (StorageBackend, error) {
 	switch storageType {
 	case "s3":
@@ -12,19 +23,13 @@ func NewBackend(storageType string) (StorageBackend, error) {
 		return newGCSBackend(), nil
 	case "azure":
 		return newAzureBackend(), nil
+	case "filesystem":
+		return newFilesystemBackend(), nil
 	default:
 		return nil, fmt.Errorf("unsupported storage type: %s", storageType)
 	}
 }
 
-type S3Backend struct {
-	RootDir   string
-	Region    string
-	Endpoint  string
-	AccessKey string /* #nosec G117 */
-	SecretKey string
-}
-
 func newS3Backend() *S3Backend {
 	return &S3Backend{
 		RootDir:   s3RootDirectory,
@@ -35,56 +40,6 @@ func newS3Backend() *S3Backend {
 	}
 }
 
-func (s *S3Backend) Type() string {
-	return "s3"
-}
-
-func (s *S3Backend) ParseRef(ref string) (*StorageRef, error) {
-	return ParseStorageRef(ref, "s3")
-}
-
-func (s *S3Backend) GetStorageConfig(bucket string) map[string]interface{} {
-	config := map[string]interface{}{
-		"bucket": bucket,
-	}
-
-	if s.Region != "" {
-		config["region"] = s.Region
-	}
-	if s.Endpoint != "" {
-		config["regionendpoint"] = s.Endpoint
-	}
-	if s.AccessKey != "" {
-		config["accesskey"] = s.AccessKey
-	}
-	if s.SecretKey != "" {
-		config["secretkey"] = s.SecretKey
-	}
-	if s.RootDir != "" {
-		config["rootdirectory"] = s.RootDir
-	}
-
-	loglevel := "error"
-	if verbose {
-		loglevel = "info"
-	}
-	config["loglevel"] = loglevel
-
-	return config
-}
-
-func (s *S3Backend) ValidateConfig() error {
-	if s.Region == "" {
-		return fmt.Errorf("S3 requires region to be specified")
-	}
-	return nil
-}
-
-type GCSBackend struct {
-	RootDir string
-	Keyfile string // For GCS
-}
-
 func newGCSBackend() *GCSBackend {
 	return &GCSBackend{
 		RootDir: gcsRootDirectory,
@@ -92,50 +47,6 @@ func newGCSBackend() *GCSBackend {
 	}
 }
 
-func (g *GCSBackend) Type() string {
-	return "gcs"
-}
-
-func (g *GCSBackend) ParseRef(ref string) (*StorageRef, error) {
-	return ParseStorageRef(ref, "gcs")
-}
-
-func (g *GCSBackend) GetStorageConfig(bucket string) map[string]interface{} {
-	config := map[string]interface{}{
-		"bucket": bucket,
-	}
-
-	if g.Keyfile != "" {
-		config["keyfile"] = g.Keyfile
-	}
-	if g.RootDir != "" {
-		config["rootdirectory"] = g.RootDir
-	}
-
-	loglevel := "error"
-	if verbose {
-		loglevel = "info"
-	}
-	config["loglevel"] = loglevel
-
-	return config
-}
-
-func (g *GCSBackend) ValidateConfig() error {
-	return nil
-}
-
-type AzureBackend struct {
-	AccountName    string // For Azure
-	AccountKey     string // For Azure
-	Container      string // For Azure
-	CredentialType string //For Azure
-	RootDir        string
-	Secret         string /* #nosec G117 */
-	TenantID       string
-	ClientID       string
-}
-
 func newAzureBackend() *AzureBackend {
 	return &AzureBackend{
 		AccountName:    azureAccountName,
@@ -148,50 +59,8 @@ func newAzureBackend() *AzureBackend {
 	}
 }
 
-func (a *AzureBackend) Type() string {
-	return "azure"
-}
-
-func (a *AzureBackend) ParseRef(ref string) (*StorageRef, error) {
-	return ParseStorageRef(ref, "azure")
-}
-
-func (a *AzureBackend) GetStorageConfig(container string) map[string]interface{} {
-	config := map[string]interface{}{
-		"container": container,
-	}
-
-	if a.AccountName != "" {
-		config["accountname"] = a.AccountName
-	}
-	if a.AccountKey != "" {
-		config["accountkey"] = a.AccountKey
-	}
-	if a.RootDir != "" {
-		config["rootdirectory"] = a.RootDir
-	}
-	if a.CredentialType != "" {
-		config["credentials"] = map[string]string{"type": a.CredentialType,
-			"secret":   a.Secret,
-			"clientid": a.ClientID,
-			"tenantid": a.TenantID}
-	}
-
-	loglevel := "error"
-	if verbose {
-		loglevel = "info"
-	}
-	config["loglevel"] = loglevel
-
-	return config
-}
-
-func (a *AzureBackend) ValidateConfig() error {
-	if a.AccountName == "" {
-		return fmt.Errorf("missing required Azure account name")
-	}
-	if a.AccountKey == "" {
-		return fmt.Errorf("missing required account key")
+func newFilesystemBackend() *FilesystemBackend {
+	return &FilesystemBackend{
+		RootDir: fsRootDirectory,
 	}
-	return nil
 }
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/spf13/cobra"
+	"golang.org/x/sync/errgroup"
+	"gopkg.in/yaml.v3"
+)
+
+// BatchEntry maps a local image to a storage reference.
+type BatchEntry struct {
+	Image string `yaml:"image" json:"image"`
+	Ref   string `yaml:"ref" json:"ref"`
+}
+
+// BatchResult is the result of push-all and pull-all.
+type BatchResult struct {
+	Pushed []PushResult   `json:"pushed,omitempty"`
+	Pulled []PullResult   `json:"pulled,omitempty"`
+	Failed []BatchFailure `json:"failed"`
+}
+
+// BatchFailure is an image push-all or pull-all failed to transfer.
+type BatchFailure struct {
+	Image string `json:"image"`
+	Ref   string `json:"ref"`
+	Error string `json:"error"`
+}
+
+func addBatchFlags(cmd *cobra.Command) {
+	cmd.Flags().StringP("file", "f", "", "Image list or compose file, - for stdin")
+	cmd.Flags().String("bucket", "", "Bucket for images listed without a ref, e.g. the services of a compose file")
+	cmd.Flags().Int("jobs", 4, "Number of images transferred concurrently")
+	_ = cmd.MarkFlagRequired("file")
+}
+
+func newPushAllCmd(storageType string, validate func() error) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "push-all -f <file>",
+		Short: "Push the images listed in a file or compose file",
+		Long: `Push the images listed in a file or compose file concurrently, through one
+embedded registry per bucket.
+
+The file either lists the images to push:
+
+  images:
+    - image: myapp:1.0
+      ref: my-bucket/myapp:v1.0
+
+or is a compose file, whose services' images are pushed to --bucket under their
+repository name and tag.`,
+		Args: cobra.NoArgs,
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			return validate()
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			file, bucket, jobs := batchFlags(cmd)
+			return pushAll(cmd.Context(), storageType, file, bucket, jobs, pushOptionsFromFlags(cmd))
+		},
+	}
+	addBatchFlags(cmd)
+	addPushOptionFlags(cmd)
+	return cmd
+}
+
+func newPullAllCmd(storageType string, validate func() error) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "pull-all -f <file>",
+		Short: "Pull the images listed in a file or compose file",
+		Long: `Pull the images listed in a file or compose file concurrently, through one
+embedded registry per bucket. The file has the format push-all reads; each image
+is loaded into Docker under its local name, so a compose file pulled from a
+bucket runs as is.`,
+		Args: cobra.NoArgs,
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			return validate()
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			file, bucket, jobs := batchFlags(cmd)
+			return pullAll(cmd.Context(), storageType, file, bucket, jobs, pullOptionsFromFlags(cmd))
+		},
+	}
+	addBatchFlags(cmd)
+	addPullFlags(cmd)
+	return cmd
+}
+
+func batchFlags(cmd *cobra.Command) (file string, bucket string, jobs int) {
+	file, _ = cmd.Flags().GetString("file")
+	bucket, _ = cmd.Flags().GetString("bucket")
+	jobs, _ = cmd.Flags().GetInt("jobs")
+	return file, bucket, jobs
+}
+
+func pushAll(ctx context.Context, storageType string, file string, bucket string, jobs int, opts PushOptions) error {
+	if err := opts.Transfer.Validate(); err != nil {
+		return err
+	}
+	entries, err := loadBatchFile(file, bucket)
+	if err != nil {
+		return err
+	}
+	results := make([]PushResult, len(entries))
+	errs, err := runBatch(ctx, storageType, "push", entries, jobs, func(i int, regAddr string, ref *StorageRef) error {
+		entryOpts := opts
+		entryOpts.Image = entries[i].Image
+		var err error
+		results[i], err = pushToRegistry(ctx, storageType, regAddr, ref, []string{entries[i].Ref}, entryOpts)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	var result BatchResult
+	for i, r := range results {
+		if errs[i] == nil {
+			result.Pushed = append(result.Pushed, r)
+		}
+	}
+	return finishBatch(result, "push", entries, errs)
+}
+
+func pullAll(ctx context.Context, storageType string, file string, bucket string, jobs int, opts PullOptions) error {
+	if err := opts.validate(); err != nil {
+		return err
+	}
+	entries, err := loadBatchFile(file, bucket)
+	if err != nil {
+		return err
+	}
+	results := make([]PullResult, len(entries))
+	errs, err := runBatch(ctx, storageType, "pull", entries, jobs, func(i int, regAddr string, ref *StorageRef) error {
+		var err error
+		results[i], err = pullFromRegistry(ctx, regAddr, ref, entries[i].Ref, entries[i].Image, opts)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	var result BatchResult
+	for i, r := range results {
+		if errs[i] == nil {
+			result.Pulled = append(result.Pulled, r)
+		}
+	}
+	return finishBatch(result, "pull", entries, errs)
+}
+
+// runBatch starts one registry per bucket of entries, then calls transfer
+// for every entry, jobs at a time. A failed entry does not stop the others;
+// the returned errors are those of each entry.
+func runBatch(ctx context.Context, storageType string, operation string, entries []BatchEntry, jobs int, transfer func(i int, regAddr string, ref *StorageRef) error) ([]error, error) {
+	if jobs < 1 {
+		return nil, invalidf("--jobs must be at least 1")
+	}
+	backend, err := NewBackend(storageType)
+	if err != nil {
+		return nil, err
+	}
+	refs := make([]*StorageRef, len(entries))
+	for i, e := range entries {
+		if refs[i], err = backend.ParseRef(e.Ref); err != nil {
+			return nil, fmt.Errorf("%s: %w", e.Ref, err)
+		}
+	}
+	registries := map[string]string{}
+	for _, ref := range refs {
+		if _, ok := registries[ref.Bucket]; ok {
+			continue
+		}
+		if registries[ref.Bucket], err = startRegistry(ctx, backend, ref.Bucket); err != nil {
+			return nil, err
+		}
+	}
+
+	slog.Info("Transferring images", "operation", operation, "images", len(entries), "buckets", len(registries), "jobs", jobs)
+	errs := make([]error, len(entries))
+	var g errgroup.Group
+	g.SetLimit(jobs)
+	for i, ref := range refs {
+		g.Go(func() error {
+			if err := ctx.Err(); err != nil {
+				errs[i] = context.Cause(ctx)
+				return nil
+			}
+			start := time.Now()
+			errs[i] = transfer(i, registries[ref.Bucket], ref)
+			recordOperation(ctx, operation, storageType, start, errs[i])
+			if errs[i] != nil {
+				slog.Error("Image transfer failed", "operation", operation, "ref", entries[i].Ref, "error", errs[i])
+			}
+			return nil
+		})
+	}
+	_ = g.Wait()
+	return errs, nil
+}
+
+// finishBatch prints result with the failures of entries, and fails if any
+// entry did.
+func finishBatch(result BatchResult, operation string, entries []BatchEntry, errs []error) error {
+	var failed []error
+	result.Failed = []BatchFailure{}
+	for i, err := range errs {
+		if err != nil {
+			result.Failed = append(result.Failed, BatchFailure{Image: entries[i].Image, Ref: entries[i].Ref, Error: redactString(err.Error())})
+			failed = append(failed, err)
+		}
+	}
+	err := printResult(result, func(w io.Writer) error {
+		for _, r := range result.Pushed {
+			state := "pushed"
+			if r.Skipped {
+				state = "unchanged"
+			}
+			if _, err := fmt.Fprintf(w, "%-9s %s -> %s (%s)\n", state, r.Image, r.Ref, r.Digest); err != nil {
+				return err
+			}
+		}
+		for _, r := range result.Pulled {
+			if _, err := fmt.Fprintf(w, "%-9s %s -> %s (%s)\n", "pulled", r.Ref, r.Image, r.Digest); err != nil {
+				return err
+			}
+		}
+		for _, f := range result.Failed {
+			if _, err := fmt.Fprintf(w, "%-9s %s: %s\n", "failed", f.Ref, f.Error); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(failed) > 0 {
+		// The result lists the failures already.
+		return reportedError{err: fmt.Errorf("%d of %d images failed to %s: %w", len(failed), len(entries), operation, errors.Join(failed...))}
+	}
+	return nil
+}
+
+// loadBatchFile reads the entries of an image list or compose file. Entries
+// without a ref are stored in bucket under the repository and tag of their
+// image.
+func loadBatchFile(file string, bucket string) ([]BatchEntry, error) {
+	var data []byte
+	var err error
+	if file == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(file)
+	}
+	if err != nil {
+		return nil, invalid(err)
+	}
+	var doc struct {
+		Images   []BatchEntry `yaml:"images"`
+		Services map[string]struct {
+			Image string `yaml:"image"`
+		} `yaml:"services"`
+	}
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, invalidf("failed to parse %s: %v", file, err)
+	}
+
+	entries := doc.Images
+	if len(entries) == 0 {
+		services := make([]string, 0, len(doc.Services))
+		for s := range doc.Services {
+			services = append(services, s)
+		}
+		sort.Strings(services)
+		seen := map[string]bool{}
+		for _, s := range services {
+			image := doc.Services[s].Image
+			if image == "" {
+				slog.Warn("Service has no image, skipping it", "service", s)
+				continue
+			}
+			if !seen[image] {
+				seen[image] = true
+				entries = append(entries, BatchEntry{Image: image})
+			}
+		}
+	}
+	if len(entries) == 0 {
+		return nil, invalidf("%s lists no images, expected an images list or compose services with an image", file)
+	}
+
+	refs := map[string]bool{}
+	for i, e := range entries {
+		if strings.Contains(e.Image, "$") {
+			return nil, invalidf("image %q contains a variable, render the compose file with docker compose config first", e.Image)
+		}
+		if e.Ref == "" {
+			if entries[i].Ref, err = defaultBatchRef(e.Image, bucket); err != nil {
+				return nil, err
+			}
+		}
+		if refs[entries[i].Ref] {
+			return nil, invalidf("%s is listed more than once", entries[i].Ref)
+		}
+		refs[entries[i].Ref] = true
+	}
+	return entries, nil
+}
+
+// defaultBatchRef returns the reference image is stored at in bucket, its
+// repository and tag. Docker Hub's library/ prefix is dropped.
+func defaultBatchRef(image string, bucket string) (string, error) {
+	if image == "" {
+		return "", invalidf("an entry has neither an image nor a ref")
+	}
+	if bucket == "" {
+		return "", invalidf("%s has no ref, set the bucket to store it in with --bucket", image)
+	}
+	tag, err := name.NewTag(image)
+	if err != nil {
+		return "", invalidf("%s needs a ref: %v", image, err)
+	}
+	repo := tag.RepositoryStr()
+	if tag.RegistryStr() == name.DefaultRegistry {
+		repo = strings.TrimPrefix(repo, "library/")
+	}
+	return fmt.Sprintf("%s/%s:%s", bucket, repo, tag.TagStr()), nil
+}
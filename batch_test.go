@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func writeBatchFile(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "images.yaml")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadBatchFile(t *testing.T) {
+	list := writeBatchFile(t, `
+images:
+  - image: myapp:1.0
+    ref: releases/myapp:v1.0
+  - image: ghcr.io/acme/worker:2.1
+`)
+	entries, err := loadBatchFile(list, "staging")
+	want := []BatchEntry{
+		{Image: "myapp:1.0", Ref: "releases/myapp:v1.0"},
+		{Image: "ghcr.io/acme/worker:2.1", Ref: "staging/acme/worker:2.1"},
+	}
+	if err != nil || !reflect.DeepEqual(entries, want) {
+		t.Errorf("loadBatchFile(list) = %+v, %v, want %+v", entries, err, want)
+	}
+
+	compose := writeBatchFile(t, `
+services:
+  web:
+    image: nginx
+  db:
+    image: postgres:16
+  worker:
+    build: .
+  cron:
+    image: postgres:16
+`)
+	entries, err = loadBatchFile(compose, "mirror")
+	want = []BatchEntry{
+		{Image: "postgres:16", Ref: "mirror/postgres:16"},
+		{Image: "nginx", Ref: "mirror/nginx:latest"},
+	}
+	if err != nil || !reflect.DeepEqual(entries, want) {
+		t.Errorf("loadBatchFile(compose) = %+v, %v, want %+v", entries, err, want)
+	}
+
+	invalid := map[string]struct {
+		content, bucket string
+	}{
+		"no bucket":  {"services:\n  web:\n    image: nginx\n", ""},
+		"variable":   {"services:\n  web:\n    image: nginx:${TAG}\n", "mirror"},
+		"duplicate":  {"images:\n  - ref: b/app:v1\n  - ref: b/app:v1\n", ""},
+		"empty":      {"version: '3'\n", "mirror"},
+		"digest":     {"images:\n  - image: nginx@sha256:0000000000000000000000000000000000000000000000000000000000000000\n", "mirror"},
+		"not yaml":   {"images: [", "mirror"},
+		"no entries": {"images:\n  - {}\n", "mirror"},
+	}
+	for name, tt := range invalid {
+		if _, err := loadBatchFile(writeBatchFile(t, tt.content), tt.bucket); exitCode(err) != exitValidation {
+			t.Errorf("%s: loadBatchFile() = %v, want a validation error", name, err)
+		}
+	}
+}
+
+func TestRunBatch(t *testing.T) {
+	old := fsRootDirectory
+	fsRootDirectory = t.TempDir()
+	t.Cleanup(func() {
+		fsRootDirectory = old
+		stopRegistries(context.Background())
+	})
+
+	entries := []BatchEntry{
+		{Ref: "one/app:v1"}, {Ref: "one/worker:v1"}, {Ref: "two/app:v1"}, {Ref: "one/broken:v1"},
+	}
+	var mu sync.Mutex
+	registries := map[string]map[string]bool{}
+	errs, err := runBatch(context.Background(), "filesystem", "push", entries, 2, func(i int, regAddr string, ref *StorageRef) error {
+		mu.Lock()
+		defer mu.Unlock()
+		if registries[regAddr] == nil {
+			registries[regAddr] = map[string]bool{}
+		}
+		registries[regAddr][ref.Bucket] = true
+		if ref.Path == "broken" {
+			return errors.New("broken image")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(registries) != 2 {
+		t.Errorf("images were transferred through %d registries, want one per bucket", len(registries))
+	}
+	for addr, buckets := range registries {
+		if len(buckets) != 1 {
+			t.Errorf("registry %s served buckets %v", addr, buckets)
+		}
+	}
+	for i, err := range errs {
+		if (err != nil) != (i == 3) {
+			t.Errorf("entry %d error = %v", i, err)
+		}
+	}
+
+	var reported reportedError
+	if err := finishBatch(BatchResult{}, "push", entries, errs); !errors.As(err, &reported) {
+		t.Errorf("finishBatch() with a failed entry = %v, want a reported failure", err)
+	}
+	if _, err := runBatch(context.Background(), "filesystem", "push", entries, 0, nil); exitCode(err) != exitValidation {
+		t.Errorf("runBatch() with 0 jobs = %v", err)
+	}
+}
@@ -0,0 +1,478 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/nbctools/oci-store/pkg/ocistore"
+	"github.com/spf13/cobra"
+)
+
+const (
+	// bundleChecksumFile lists the SHA-256 of every other file in a bundle in
+	// sha256sum format, so bundles can also be checked with sha256sum -c.
+	bundleChecksumFile = "SHA256SUMS"
+	refNameAnnotation  = "org.opencontainers.image.ref.name"
+)
+
+func newExportCmd(storageType string, validate func() error) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "export <bucket> -o <bundle.tar>",
+		Short: "Export images from a bucket into an OCI layout archive",
+		Long: `Export tagged images and artifacts from a bucket into a self-contained OCI
+image layout archive with a SHA256SUMS checksum manifest. The archive can be
+loaded into another bucket with the import command.`,
+		Args: cobra.ExactArgs(1),
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			return validate()
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			repos, _ := cmd.Flags().GetStringSlice("repos")
+			tags, _ := cmd.Flags().GetString("tags")
+			file, _ := cmd.Flags().GetString("file")
+			return exportBundle(cmd.Context(), storageType, args[0], repos, tags, file)
+		},
+	}
+	cmd.Flags().StringSlice("repos", nil, "Repositories to export (default: all repositories in the bucket)")
+	cmd.Flags().String("tags", "*", "Only export tags matching this glob pattern")
+	cmd.Flags().StringP("file", "o", "", "Bundle file to write")
+	_ = cmd.MarkFlagRequired("file")
+	return cmd
+}
+
+func newImportCmd(storageType string, validate func() error) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "import <bundle.tar> <bucket>",
+		Short: "Import an exported bundle into a bucket",
+		Long: `Verify the checksums of a bundle written by export and push every image and
+artifact it contains into the bucket under its original repository and tag.
+Nothing is written unless every entry satisfies the bucket's write policy.`,
+		Args: cobra.ExactArgs(2),
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			return validate()
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			policyFile, _ := cmd.Flags().GetString("policy")
+			return importBundle(cmd.Context(), storageType, args[0], args[1], policyFile)
+		},
+	}
+	cmd.Flags().String("policy", "", "Local policy file enforced in addition to the bucket policy")
+	return cmd
+}
+
+func exportBundle(ctx context.Context, storageType string, bucket string, repos []string, tagPattern string, output string) error {
+	if _, err := path.Match(tagPattern, ""); err != nil {
+		return fmt.Errorf("invalid tag pattern %q: %w", tagPattern, err)
+	}
+	reg, err := openStorageRegistry(ctx, storageType, bucket)
+	if err != nil {
+		return err
+	}
+
+	tmpDir, err := os.MkdirTemp("", "oci-store-export-")
+	if err != nil {
+		return err
+	}
+	defer func() { _ = os.RemoveAll(tmpDir) }()
+
+	count, err := exportLayout(ctx, reg, repos, tagPattern, tmpDir)
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return fmt.Errorf("no tags in %s match %q", bucket, tagPattern)
+	}
+	if err := writeChecksums(tmpDir); err != nil {
+		return err
+	}
+	if err := writeBundle(tmpDir, output); err != nil {
+		return err
+	}
+	slog.Info("Bundle exported", "bucket", bucket, "images", count, "output", output)
+	return nil
+}
+
+func importBundle(ctx context.Context, storageType string, bundle string, bucket string, policyFile string) error {
+	tmpDir, err := os.MkdirTemp("", "oci-store-import-")
+	if err != nil {
+		return err
+	}
+	defer func() { _ = os.RemoveAll(tmpDir) }()
+
+	if err := extractBundle(bundle, tmpDir); err != nil {
+		return err
+	}
+	if err := verifyChecksums(tmpDir); err != nil {
+		return fmt.Errorf("bundle %s failed verification: %w", bundle, err)
+	}
+
+	reg, err := openStorageRegistry(ctx, storageType, bucket)
+	if err != nil {
+		return err
+	}
+	policies, err := loadPolicies(ctx, storageType, bucket, policyFile)
+	if err != nil {
+		return err
+	}
+	count, err := importLayout(ctx, reg, tmpDir, policies)
+	if err != nil {
+		return err
+	}
+	slog.Info("Bundle imported", "bucket", bucket, "images", count, "bundle", bundle)
+	return nil
+}
+
+// openStorageRegistry starts a registry on bucket for commands that work on
+// a whole bucket rather than a single reference.
+func openStorageRegistry(ctx context.Context, storageType string, bucket string) (name.Registry, error) {
+	backend, err := NewBackend(storageType)
+	if err != nil {
+		return name.Registry{}, err
+	}
+	regAddr, err := startRegistry(ctx, backend, bucket)
+	if err != nil {
+		return name.Registry{}, err
+	}
+	return name.NewRegistry(regAddr, name.Insecure)
+}
+
+// exportLayout writes every tag of repos matching tagPattern into an OCI
+// image layout at dir. Each entry is annotated with its repository and tag.
+func exportLayout(ctx context.Context, reg name.Registry, repos []string, tagPattern string, dir string) (int, error) {
+	if len(repos) == 0 {
+		var err error
+		if repos, err = remote.Catalog(ctx, reg, withRegistryTransport()); err != nil {
+			return 0, fmt.Errorf("failed to list repositories: %w", err)
+		}
+	}
+	lp, err := layout.Write(dir, empty.Index)
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, repoName := range repos {
+		repo := reg.Repo(repoName)
+		tags, err := remote.List(repo, remote.WithContext(ctx), withRegistryTransport())
+		if err != nil {
+			return 0, fmt.Errorf("failed to list tags of %s: %w", repoName, err)
+		}
+		for _, tag := range tags {
+			if ok, _ := path.Match(tagPattern, tag); !ok {
+				continue
+			}
+			desc, err := remote.Get(repo.Tag(tag), remote.WithContext(ctx), withRegistryTransport())
+			if err != nil {
+				return 0, fmt.Errorf("failed to fetch %s:%s: %w", repoName, tag, err)
+			}
+			opt := layout.WithAnnotations(map[string]string{refNameAnnotation: repoName + ":" + tag})
+			if desc.MediaType.IsIndex() {
+				idx, ierr := desc.ImageIndex()
+				if ierr != nil {
+					return 0, ierr
+				}
+				err = lp.AppendIndex(idx, opt)
+			} else {
+				img, ierr := desc.Image()
+				if ierr != nil {
+					return 0, ierr
+				}
+				err = lp.AppendImage(img, opt)
+			}
+			if err != nil {
+				return 0, fmt.Errorf("failed to export %s:%s: %w", repoName, tag, err)
+			}
+			slog.Debug("Exported", "repository", repoName, "tag", tag, "digest", desc.Digest.String())
+			count++
+		}
+	}
+	return count, nil
+}
+
+// importLayout pushes every annotated entry of the OCI image layout at dir
+// to reg. All entries are checked against policies before the first write.
+func importLayout(ctx context.Context, reg name.Registry, dir string, policies ocistore.PolicySet) (int, error) {
+	lp, err := layout.FromPath(dir)
+	if err != nil {
+		return 0, err
+	}
+	index, err := lp.ImageIndex()
+	if err != nil {
+		return 0, err
+	}
+	indexManifest, err := index.IndexManifest()
+	if err != nil {
+		return 0, err
+	}
+
+	tags := make([]name.Tag, len(indexManifest.Manifests))
+	for i, desc := range indexManifest.Manifests {
+		ref := desc.Annotations[refNameAnnotation]
+		repoName, tagName, ok := strings.Cut(ref, ":")
+		if !ok {
+			return 0, fmt.Errorf("bundle entry %s has no repository and tag", desc.Digest)
+		}
+		tags[i] = reg.Repo(repoName).Tag(tagName)
+		if err := policies.CheckTag(tags[i], desc.Digest, remote.WithContext(ctx), withRegistryTransport()); err != nil {
+			return 0, err
+		}
+		if err := checkLayoutSize(policies, index, desc); err != nil {
+			return 0, fmt.Errorf("cannot import %s: %w", ref, err)
+		}
+	}
+
+	count := 0
+	for i, desc := range indexManifest.Manifests {
+		ref := desc.Annotations[refNameAnnotation]
+		tag := tags[i]
+		if desc.MediaType.IsIndex() {
+			idx, ierr := index.ImageIndex(desc.Digest)
+			if ierr != nil {
+				return 0, ierr
+			}
+			err = remote.WriteIndex(tag, idx, remote.WithContext(ctx), withRegistryTransport())
+		} else {
+			img, ierr := index.Image(desc.Digest)
+			if ierr != nil {
+				return 0, ierr
+			}
+			err = remote.Write(tag, img, remote.WithContext(ctx), withRegistryTransport())
+		}
+		if err != nil {
+			return 0, fmt.Errorf("failed to import %s: %w", ref, err)
+		}
+		slog.Debug("Imported", "repository", tag.RepositoryStr(), "tag", tag.TagStr(), "digest", desc.Digest.String())
+		count++
+	}
+	return count, nil
+}
+
+// checkLayoutSize checks the size of the image, or of each image of the
+// index, that desc in index refers to against policies.
+func checkLayoutSize(policies ocistore.PolicySet, index v1.ImageIndex, desc v1.Descriptor) error {
+	switch {
+	case desc.MediaType.IsIndex():
+		child, err := index.ImageIndex(desc.Digest)
+		if err != nil {
+			return err
+		}
+		return policies.CheckIndexSize(child)
+	case desc.MediaType.IsImage():
+		img, err := index.Image(desc.Digest)
+		if err != nil {
+			return err
+		}
+		return policies.CheckImageSize(img)
+	}
+	return nil
+}
+
+// bundleFiles returns the slash-separated paths of all regular files in dir
+// except the checksum file, in lexical order.
+func bundleFiles(dir string) ([]string, error) {
+	var files []string
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		if rel = filepath.ToSlash(rel); rel != bundleChecksumFile {
+			files = append(files, rel)
+		}
+		return nil
+	})
+	return files, err
+}
+
+func fileChecksum(p string) (string, error) {
+	f, err := os.Open(filepath.Clean(p))
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = f.Close() }()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func writeChecksums(dir string) error {
+	files, err := bundleFiles(dir)
+	if err != nil {
+		return err
+	}
+	var b strings.Builder
+	for _, file := range files {
+		sum, err := fileChecksum(filepath.Join(dir, filepath.FromSlash(file)))
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(&b, "%s  %s\n", sum, file)
+	}
+	return os.WriteFile(filepath.Join(dir, bundleChecksumFile), []byte(b.String()), 0o600)
+}
+
+// verifyChecksums checks that the files in dir are exactly the ones listed in
+// the checksum file and that their contents match.
+func verifyChecksums(dir string) error {
+	f, err := os.Open(filepath.Join(dir, bundleChecksumFile))
+	if err != nil {
+		return fmt.Errorf("missing %s: %w", bundleChecksumFile, err)
+	}
+	defer func() { _ = f.Close() }()
+
+	want := map[string]string{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		sum, file, ok := strings.Cut(scanner.Text(), "  ")
+		if !ok {
+			return fmt.Errorf("malformed %s line: %q", bundleChecksumFile, scanner.Text())
+		}
+		want[file] = sum
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	files, err := bundleFiles(dir)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		sum, ok := want[file]
+		if !ok {
+			return fmt.Errorf("%s is not listed in %s", file, bundleChecksumFile)
+		}
+		got, err := fileChecksum(filepath.Join(dir, filepath.FromSlash(file)))
+		if err != nil {
+			return err
+		}
+		if got != sum {
+			return fmt.Errorf("checksum mismatch for %s", file)
+		}
+		delete(want, file)
+	}
+	if len(want) > 0 {
+		missing := make([]string, 0, len(want))
+		for file := range want {
+			missing = append(missing, file)
+		}
+		sort.Strings(missing)
+		return fmt.Errorf("files missing from bundle: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// writeBundle archives dir into a tar file, checksum file first.
+func writeBundle(dir string, output string) (err error) {
+	out, err := os.Create(filepath.Clean(output))
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := out.Close(); err == nil {
+			err = cerr
+		}
+	}()
+
+	files, err := bundleFiles(dir)
+	if err != nil {
+		return err
+	}
+	tw := tar.NewWriter(out)
+	for _, file := range append([]string{bundleChecksumFile}, files...) {
+		if err := addTarFile(tw, dir, file); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+func addTarFile(tw *tar.Writer, dir string, file string) error {
+	f, err := os.Open(filepath.Join(dir, filepath.FromSlash(file)))
+	if err != nil {
+		return err
+	}
+	defer func() { _ = f.Close() }()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if err := tw.WriteHeader(&tar.Header{Name: file, Mode: 0o644, Size: info.Size(), Typeflag: tar.TypeReg}); err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, f)
+	return err
+}
+
+// extractBundle unpacks the regular files of a bundle into dir, rejecting
+// entries that would escape it.
+func extractBundle(bundle string, dir string) error {
+	f, err := os.Open(filepath.Clean(bundle))
+	if err != nil {
+		return err
+	}
+	defer func() { _ = f.Close() }()
+
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read bundle %s: %w", bundle, err)
+		}
+		if hdr.Typeflag == tar.TypeDir {
+			continue
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			return fmt.Errorf("unexpected entry %s in bundle", hdr.Name)
+		}
+		clean := path.Clean(hdr.Name)
+		if !filepath.IsLocal(clean) {
+			return fmt.Errorf("refusing to extract unsafe path %s", hdr.Name)
+		}
+		target := filepath.Join(dir, filepath.FromSlash(clean))
+		if err := os.MkdirAll(filepath.Dir(target), 0o750); err != nil {
+			return err
+		}
+		if err := extractTarFile(tr, target); err != nil {
+			return err
+		}
+	}
+}
+
+func extractTarFile(r io.Reader, target string) error {
+	out, err := os.OpenFile(filepath.Clean(target), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, r); err != nil {
+		_ = out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"archive/tar"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/nbctools/oci-store/pkg/ocistore"
+)
+
+func TestBundleRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	src, _ := name.NewRegistry(newTestRegistry(t), name.Insecure)
+	img, _ := random.Image(512, 2)
+	idx, _ := random.Index(256, 1, 2)
+	for tag, write := range map[string]func(name.Tag) error{
+		"app:v1.0": func(tag name.Tag) error { return remote.Write(tag, img) },
+		"app:v1.1": func(tag name.Tag) error { return remote.WriteIndex(tag, idx) },
+		"app:v2.0": func(tag name.Tag) error { return remote.Write(tag, img) },
+		"db:v1.0":  func(tag name.Tag) error { return remote.Write(tag, img) },
+	} {
+		ref, _ := name.NewTag(src.RegistryStr()+"/"+tag, name.Insecure)
+		if err := write(ref); err != nil {
+			t.Fatalf("writing %s: %v", tag, err)
+		}
+	}
+
+	layoutDir := t.TempDir()
+	count, err := exportLayout(ctx, src, []string{"app"}, "v1.*", layoutDir)
+	if err != nil {
+		t.Fatalf("exportLayout() error = %v", err)
+	}
+	if count != 2 {
+		t.Fatalf("exportLayout() exported %d tags, want 2", count)
+	}
+	if err := writeChecksums(layoutDir); err != nil {
+		t.Fatal(err)
+	}
+	bundle := filepath.Join(t.TempDir(), "bundle.tar")
+	if err := writeBundle(layoutDir, bundle); err != nil {
+		t.Fatalf("writeBundle() error = %v", err)
+	}
+
+	extracted := t.TempDir()
+	if err := extractBundle(bundle, extracted); err != nil {
+		t.Fatalf("extractBundle() error = %v", err)
+	}
+	if err := verifyChecksums(extracted); err != nil {
+		t.Fatalf("verifyChecksums() error = %v", err)
+	}
+
+	dst, _ := name.NewRegistry(newTestRegistry(t), name.Insecure)
+	count, err = importLayout(ctx, dst, extracted, nil)
+	if err != nil {
+		t.Fatalf("importLayout() error = %v", err)
+	}
+	if count != 2 {
+		t.Errorf("importLayout() imported %d tags, want 2", count)
+	}
+	for tag, want := range map[string]func() (string, error){
+		"v1.0": func() (string, error) { d, err := img.Digest(); return d.String(), err },
+		"v1.1": func() (string, error) { d, err := idx.Digest(); return d.String(), err },
+	} {
+		desc, err := remote.Head(dst.Repo("app").Tag(tag))
+		if err != nil {
+			t.Fatalf("imported tag %s: %v", tag, err)
+		}
+		if d, _ := want(); desc.Digest.String() != d {
+			t.Errorf("imported %s digest = %s, want %s", tag, desc.Digest, d)
+		}
+	}
+	if _, err := remote.Head(dst.Repo("app").Tag("v2.0")); err == nil {
+		t.Error("tag v2.0 should not have been exported")
+	}
+}
+
+func TestImportLayoutPolicy(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	lp, err := layout.Write(dir, empty.Index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, _ := random.Image(512, 1)
+	other, _ := random.Image(512, 1)
+	for ref, img := range map[string]v1.Image{"app:latest": img, "app:v1": other} {
+		if err := lp.AppendImage(img, layout.WithAnnotations(map[string]string{refNameAnnotation: ref})); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dst, _ := name.NewRegistry(newTestRegistry(t), name.Insecure)
+	if err := remote.Write(dst.Repo("app").Tag("v1"), img); err != nil {
+		t.Fatal(err)
+	}
+	policies := ocistore.PolicySet{{ImmutableTags: []string{"v*"}}}
+	if _, err := importLayout(ctx, dst, dir, policies); err == nil {
+		t.Fatal("importLayout() over an immutable tag should fail")
+	}
+	// The check runs before anything is written.
+	if _, err := remote.Head(dst.Repo("app").Tag("latest")); err == nil {
+		t.Error("importLayout() wrote app:latest although the import was refused")
+	}
+
+	if _, err := importLayout(ctx, dst, dir, ocistore.PolicySet{{MaxImageBytes: 100}}); err == nil {
+		t.Error("importLayout() above maxImageBytes should fail")
+	}
+	if _, err := importLayout(ctx, dst, dir, ocistore.PolicySet{{AllowedRepositories: []string{"team-a/"}}}); err == nil {
+		t.Error("importLayout() outside the allowed repositories should fail")
+	}
+}
+
+func TestVerifyChecksums(t *testing.T) {
+	newDir := func(t *testing.T) string {
+		dir := t.TempDir()
+		if err := os.MkdirAll(filepath.Join(dir, "blobs", "sha256"), 0o750); err != nil {
+			t.Fatal(err)
+		}
+		for _, f := range []string{"index.json", "blobs/sha256/abc"} {
+			if err := os.WriteFile(filepath.Join(dir, f), []byte(f), 0o600); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := writeChecksums(dir); err != nil {
+			t.Fatal(err)
+		}
+		return dir
+	}
+
+	if err := verifyChecksums(newDir(t)); err != nil {
+		t.Errorf("verifyChecksums() on intact bundle error = %v", err)
+	}
+
+	tampered := newDir(t)
+	_ = os.WriteFile(filepath.Join(tampered, "blobs", "sha256", "abc"), []byte("changed"), 0o600)
+	if err := verifyChecksums(tampered); err == nil {
+		t.Error("verifyChecksums() should fail for a modified file")
+	}
+
+	extra := newDir(t)
+	_ = os.WriteFile(filepath.Join(extra, "blobs", "sha256", "def"), []byte("extra"), 0o600)
+	if err := verifyChecksums(extra); err == nil {
+		t.Error("verifyChecksums() should fail for an unlisted file")
+	}
+
+	missing := newDir(t)
+	_ = os.Remove(filepath.Join(missing, "index.json"))
+	if err := verifyChecksums(missing); err == nil {
+		t.Error("verifyChecksums() should fail for a missing file")
+	}
+}
+
+func TestExtractBundleRejectsUnsafePaths(t *testing.T) {
+	bundle := filepath.Join(t.TempDir(), "evil.tar")
+	f, err := os.Create(bundle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tw := tar.NewWriter(f)
+	_ = tw.WriteHeader(&tar.Header{Name: "../escape", Mode: 0o644, Size: 1, Typeflag: tar.TypeReg})
+	_, _ = tw.Write([]byte("x"))
+	_ = tw.Close()
+	_ = f.Close()
+
+	if err := extractBundle(bundle, t.TempDir()); err == nil {
+		t.Error("extractBundle() should reject paths outside the target directory")
+	}
+}
+
+func TestOpenStorageRegistryRejectsUnsafeBuckets(t *testing.T) {
+	old := fsRootDirectory
+	fsRootDirectory = t.TempDir()
+	t.Cleanup(func() { fsRootDirectory = old })
+
+	for _, bucket := range []string{"..", "../outside", "."} {
+		if _, err := openStorageRegistry(context.Background(), "filesystem", bucket); exitCode(err) != exitValidation {
+			t.Errorf("openStorageRegistry(%q) = %v, want a validation error", bucket, err)
+		}
+	}
+}
+
+func TestExportOutputShorthand(t *testing.T) {
+	cmd := newExportCmd("filesystem", func() error { return nil })
+	if err := cmd.ParseFlags([]string{"-o", "bundle.tar"}); err != nil {
+		t.Fatalf("ParseFlags() error = %v", err)
+	}
+	if file, _ := cmd.Flags().GetString("file"); file != "bundle.tar" {
+		t.Errorf("--file = %q, want bundle.tar", file)
+	}
+	if err := cmd.ValidateRequiredFlags(); err != nil {
+		t.Errorf("ValidateRequiredFlags() error = %v", err)
+	}
+}
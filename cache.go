@@ -0,0 +1,509 @@
+package main
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/cache"
+	"github.com/google/go-containerregistry/pkg/v1/partial"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/spf13/cobra"
+)
+
+// Blob cache settings, set by global flags.
+var (
+	cacheDir     = defaultCacheDir()
+	cacheMaxSize = byteSize(10 << 30)
+)
+
+// staleCacheTemp is the age after which cache prune removes the partial
+// downloads of pulls that never finished.
+const staleCacheTemp = time.Hour
+
+// defaultCacheDir returns the oci-store directory in the user's cache
+// directory, e.g. ~/.cache/oci-store, or "" when there is none.
+func defaultCacheDir() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "oci-store")
+}
+
+// byteSize is a size flag such as 10G. As for --limit-rate, K, M and G are
+// powers of 1024.
+type byteSize int64
+
+func (s *byteSize) Set(v string) error {
+	n, err := parseByteSize(v)
+	if err != nil {
+		return err
+	}
+	*s = byteSize(n)
+	return nil
+}
+
+func (s *byteSize) String() string {
+	n := int64(*s)
+	for _, unit := range []struct {
+		suffix string
+		size   int64
+	}{{"G", 1 << 30}, {"M", 1 << 20}, {"K", 1 << 10}} {
+		if n >= unit.size && n%unit.size == 0 {
+			return fmt.Sprintf("%d%s", n/unit.size, unit.suffix)
+		}
+	}
+	return fmt.Sprint(n)
+}
+
+func (s *byteSize) Type() string { return "size" }
+
+// CachedBlob is a layer in the local blob cache.
+type CachedBlob struct {
+	Digest   string    `json:"digest"`
+	Size     int64     `json:"size"`
+	LastUsed time.Time `json:"lastUsed"`
+	path     string
+}
+
+// CacheListing is the result of cache ls printed with --output json.
+type CacheListing struct {
+	Dir     string       `json:"dir"`
+	Size    int64        `json:"size"`
+	MaxSize int64        `json:"maxSize"`
+	Blobs   []CachedBlob `json:"blobs"`
+}
+
+// CachePruneResult is the result of cache prune printed with --output json.
+type CachePruneResult struct {
+	Dir            string       `json:"dir"`
+	Removed        []CachedBlob `json:"removed"`
+	ReclaimedBytes int64        `json:"reclaimedBytes"`
+}
+
+func newCacheCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "cache",
+		Short: "Manage the local blob cache used by pull",
+	}
+
+	lsCmd := &cobra.Command{
+		Use:   "ls",
+		Short: "List cached layers, most recently used first",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return listCache()
+		},
+	}
+
+	pruneCmd := &cobra.Command{
+		Use:   "prune",
+		Short: "Remove cached layers",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			all, _ := cmd.Flags().GetBool("all")
+			olderThan, _ := cmd.Flags().GetDuration("older-than")
+			maxSize := int64(cacheMaxSize)
+			if cmd.Flags().Changed("max-size") {
+				maxSize = int64(*cmd.Flags().Lookup("max-size").Value.(*byteSize))
+			}
+			return pruneCache(all, olderThan, maxSize)
+		},
+	}
+	pruneCmd.Flags().Bool("all", false, "Remove every cached layer")
+	pruneCmd.Flags().Duration("older-than", 0, "Remove layers not used for longer than this")
+	pruneCmd.Flags().Var(new(byteSize), "max-size", "Evict the least recently used layers down to this size (defaults to --cache-max-size)")
+
+	cmd.AddCommand(lsCmd, pruneCmd)
+	return cmd
+}
+
+func openCache() (*blobCache, error) {
+	if cacheDir == "" {
+		return nil, invalidf("no cache directory, set one with --cache-dir")
+	}
+	return newBlobCache(cacheDir, int64(cacheMaxSize)), nil
+}
+
+func listCache() error {
+	c, err := openCache()
+	if err != nil {
+		return err
+	}
+	blobs, err := c.list()
+	if err != nil {
+		return err
+	}
+	listing := CacheListing{Dir: c.dir, MaxSize: c.maxSize, Blobs: blobs}
+	for _, b := range blobs {
+		listing.Size += b.Size
+	}
+	return printResult(listing, func(out io.Writer) error {
+		w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+		_, _ = fmt.Fprintln(w, "DIGEST\tSIZE\tLAST USED")
+		for _, b := range blobs {
+			_, _ = fmt.Fprintf(w, "%s\t%s\t%s\n", b.Digest, humanSize(b.Size), b.LastUsed.UTC().Format(time.RFC3339))
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+		_, err := fmt.Fprintf(out, "\n%d layers, %s of %s in %s\n", len(blobs), humanSize(listing.Size), humanSize(c.maxSize), c.dir)
+		return err
+	})
+}
+
+func pruneCache(all bool, olderThan time.Duration, maxSize int64) error {
+	c, err := openCache()
+	if err != nil {
+		return err
+	}
+	cutoff := time.Now().Add(-olderThan)
+	removed, err := c.prune(func(b CachedBlob) bool {
+		return all || (olderThan > 0 && b.LastUsed.Before(cutoff))
+	}, maxSize)
+	if err != nil {
+		return err
+	}
+	c.removeStaleTemps()
+
+	result := CachePruneResult{Dir: c.dir, Removed: removed}
+	for _, b := range removed {
+		result.ReclaimedBytes += b.Size
+	}
+	if result.Removed == nil {
+		result.Removed = []CachedBlob{}
+	}
+	err = printResult(result, func(out io.Writer) error {
+		w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+		_, _ = fmt.Fprintln(w, "DIGEST\tSIZE\tLAST USED")
+		for _, b := range removed {
+			_, _ = fmt.Fprintf(w, "%s\t%s\t%s\n", b.Digest, humanSize(b.Size), b.LastUsed.UTC().Format(time.RFC3339))
+		}
+		return w.Flush()
+	})
+	if err != nil {
+		return err
+	}
+	slog.Info("Pruned blob cache", "layers", len(removed), "reclaimed", humanSize(result.ReclaimedBytes))
+	return nil
+}
+
+// blobCache is an on-disk cache of compressed layers, shared by all pulls of
+// the user. Layers are stored by digest under blobs/<algorithm>/<hex>, as in
+// an OCI layout. The modification time of a layer records its last use, and
+// the least recently used layers are evicted once the cache outgrows
+// maxSize. It implements cache.Cache.
+type blobCache struct {
+	dir     string
+	maxSize int64
+
+	mu sync.Mutex
+	// hits holds the layers served from the cache and hitBytes their size.
+	// A layer read again, e.g. by a retried daemon write, counts once.
+	hits     map[v1.Hash]bool
+	hitBytes int64
+}
+
+func newBlobCache(dir string, maxSize int64) *blobCache {
+	return &blobCache{dir: dir, maxSize: maxSize, hits: map[v1.Hash]bool{}}
+}
+
+// cachedBytes returns the size of the layers served from the cache.
+func (c *blobCache) cachedBytes() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.hitBytes
+}
+
+// cacheImage returns img with its layers read through c. cache.Image returns
+// the layers it finds by digest straight from the cache, which keeps no
+// media type, so they take it from img's own layer instead.
+func cacheImage(img v1.Image, c *blobCache) v1.Image {
+	return &cachedImage{Image: cache.Image(img, c), base: img}
+}
+
+type cachedImage struct {
+	v1.Image
+	base v1.Image
+}
+
+func (i *cachedImage) LayerByDigest(h v1.Hash) (v1.Layer, error) {
+	l, err := i.Image.LayerByDigest(h)
+	if err != nil {
+		return nil, err
+	}
+	return &typedLayer{Layer: l, base: func() (v1.Layer, error) { return i.base.LayerByDigest(h) }}, nil
+}
+
+func (i *cachedImage) LayerByDiffID(h v1.Hash) (v1.Layer, error) {
+	l, err := i.Image.LayerByDiffID(h)
+	if err != nil {
+		return nil, err
+	}
+	return &typedLayer{Layer: l, base: func() (v1.Layer, error) { return i.base.LayerByDiffID(h) }}, nil
+}
+
+// typedLayer is a layer whose media type is that of base.
+type typedLayer struct {
+	v1.Layer
+	base func() (v1.Layer, error)
+}
+
+func (l *typedLayer) MediaType() (types.MediaType, error) {
+	base, err := l.base()
+	if err != nil {
+		return "", err
+	}
+	return base.MediaType()
+}
+
+func (c *blobCache) path(h v1.Hash) string {
+	return filepath.Join(c.dir, "blobs", h.Algorithm, h.Hex)
+}
+
+// Get returns the cached layer with digest h and marks it as used.
+func (c *blobCache) Get(h v1.Hash) (v1.Layer, error) {
+	p := c.path(h)
+	info, err := os.Stat(p)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, cache.ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	_ = os.Chtimes(p, now, now)
+	slog.Debug("Layer found in cache", "digest", h)
+	c.mu.Lock()
+	if !c.hits[h] {
+		c.hits[h] = true
+		c.hitBytes += info.Size()
+	}
+	c.mu.Unlock()
+	return partial.CompressedToLayer(&cachedLayer{path: p, digest: h, size: info.Size()})
+}
+
+// Put returns l with its compressed stream copied into the cache as it is
+// read. The layer is only stored once it was read completely and its digest
+// matched.
+func (c *blobCache) Put(l v1.Layer) (v1.Layer, error) {
+	return &cachingLayer{Layer: l, c: c}, nil
+}
+
+// Delete removes the layer with digest h from the cache.
+func (c *blobCache) Delete(h v1.Hash) error {
+	if err := os.Remove(c.path(h)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// list returns the cached layers, most recently used first. Partial
+// downloads are left out.
+func (c *blobCache) list() ([]CachedBlob, error) {
+	algorithms, err := os.ReadDir(filepath.Join(c.dir, "blobs"))
+	if errors.Is(err, fs.ErrNotExist) {
+		return []CachedBlob{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	blobs := []CachedBlob{}
+	for _, alg := range algorithms {
+		if !alg.IsDir() {
+			continue
+		}
+		entries, err := os.ReadDir(filepath.Join(c.dir, "blobs", alg.Name()))
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range entries {
+			if strings.HasPrefix(e.Name(), ".") || e.IsDir() {
+				continue
+			}
+			info, err := e.Info()
+			if err != nil {
+				continue
+			}
+			blobs = append(blobs, CachedBlob{
+				Digest:   alg.Name() + ":" + e.Name(),
+				Size:     info.Size(),
+				LastUsed: info.ModTime(),
+				path:     filepath.Join(c.dir, "blobs", alg.Name(), e.Name()),
+			})
+		}
+	}
+	sort.SliceStable(blobs, func(i, j int) bool { return blobs[i].LastUsed.After(blobs[j].LastUsed) })
+	return blobs, nil
+}
+
+// prune removes the layers for which remove returns true, then the least
+// recently used ones until the rest fit in maxSize.
+func (c *blobCache) prune(remove func(CachedBlob) bool, maxSize int64) ([]CachedBlob, error) {
+	blobs, err := c.list()
+	if err != nil {
+		return nil, err
+	}
+	var total int64
+	for _, b := range blobs {
+		total += b.Size
+	}
+	removed := []CachedBlob{}
+	for i := len(blobs) - 1; i >= 0; i-- {
+		b := blobs[i]
+		if !remove(b) && total <= maxSize {
+			continue
+		}
+		if err := os.Remove(b.path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return removed, err
+		}
+		total -= b.Size
+		removed = append(removed, b)
+	}
+	return removed, nil
+}
+
+// removeStaleTemps removes the partial downloads of pulls that were killed.
+func (c *blobCache) removeStaleTemps() {
+	temps, _ := filepath.Glob(filepath.Join(c.dir, "blobs", "*", ".tmp-*"))
+	for _, t := range temps {
+		if info, err := os.Stat(t); err == nil && time.Since(info.ModTime()) > staleCacheTemp {
+			_ = os.Remove(t)
+		}
+	}
+}
+
+// cachedLayer is a layer read from the cache. The cache keeps no media
+// type; cacheImage takes it from the image's own layer.
+type cachedLayer struct {
+	path   string
+	digest v1.Hash
+	size   int64
+}
+
+func (l *cachedLayer) Digest() (v1.Hash, error)            { return l.digest, nil }
+func (l *cachedLayer) Size() (int64, error)                { return l.size, nil }
+func (l *cachedLayer) MediaType() (types.MediaType, error) { return types.DockerLayer, nil }
+
+func (l *cachedLayer) Compressed() (io.ReadCloser, error) {
+	f, err := os.Open(l.path)
+	if err != nil {
+		return nil, err
+	}
+	return &verifyingReader{ReadCloser: f, hasher: sha256.New(), digest: l.digest, path: l.path}, nil
+}
+
+// verifyingReader checks a cached layer against its digest and removes it
+// if it was corrupted.
+type verifyingReader struct {
+	io.ReadCloser
+	hasher hash.Hash
+	digest v1.Hash
+	path   string
+}
+
+func (r *verifyingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.hasher.Write(p[:n])
+	if errors.Is(err, io.EOF) && fmt.Sprintf("%x", r.hasher.Sum(nil)) != r.digest.Hex {
+		_ = os.Remove(r.path)
+		return n, fmt.Errorf("cached layer %s is corrupted and was removed, pull again", r.digest)
+	}
+	return n, err
+}
+
+type cachingLayer struct {
+	v1.Layer
+	c *blobCache
+}
+
+func (l *cachingLayer) Compressed() (io.ReadCloser, error) {
+	rc, err := l.Layer.Compressed()
+	if err != nil {
+		return nil, err
+	}
+	digest, err := l.Layer.Digest()
+	if err != nil || digest.Algorithm != "sha256" {
+		return rc, nil
+	}
+	dir := filepath.Dir(l.c.path(digest))
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		slog.Debug("Not caching layer", "digest", digest, "error", err)
+		return rc, nil
+	}
+	tmp, err := os.CreateTemp(dir, ".tmp-*")
+	if err != nil {
+		slog.Debug("Not caching layer", "digest", digest, "error", err)
+		return rc, nil
+	}
+	return &cachingReader{ReadCloser: rc, c: l.c, digest: digest, tmp: tmp, hasher: sha256.New()}, nil
+}
+
+// cachingReader copies a downloaded layer into a temporary file of the
+// cache, which becomes the cached layer when the download completes.
+type cachingReader struct {
+	io.ReadCloser
+	c        *blobCache
+	digest   v1.Hash
+	tmp      *os.File
+	hasher   hash.Hash
+	complete bool
+}
+
+func (r *cachingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if n > 0 && r.tmp != nil {
+		r.hasher.Write(p[:n])
+		if _, werr := r.tmp.Write(p[:n]); werr != nil {
+			slog.Debug("Not caching layer", "digest", r.digest, "error", werr)
+			r.discard()
+		}
+	}
+	if errors.Is(err, io.EOF) {
+		r.complete = true
+	}
+	return n, err
+}
+
+func (r *cachingReader) discard() {
+	_ = r.tmp.Close()
+	_ = os.Remove(r.tmp.Name())
+	r.tmp = nil
+}
+
+func (r *cachingReader) Close() error {
+	err := r.ReadCloser.Close()
+	if r.tmp == nil {
+		return err
+	}
+	if !r.complete || fmt.Sprintf("%x", r.hasher.Sum(nil)) != r.digest.Hex {
+		r.discard()
+		return err
+	}
+	if cerr := r.tmp.Close(); cerr != nil {
+		r.discard()
+		return err
+	}
+	if rerr := os.Rename(r.tmp.Name(), r.c.path(r.digest)); rerr != nil {
+		slog.Debug("Not caching layer", "digest", r.digest, "error", rerr)
+		_ = os.Remove(r.tmp.Name())
+		return err
+	}
+	if _, perr := r.c.prune(func(CachedBlob) bool { return false }, r.c.maxSize); perr != nil {
+		slog.Warn("Failed to evict layers from the blob cache", "error", perr)
+	}
+	return err
+}
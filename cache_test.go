@@ -0,0 +1,186 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+	"testing"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/cache"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+func readLayer(t *testing.T, l v1.Layer) {
+	t.Helper()
+	rc, err := l.Compressed()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.Copy(io.Discard, rc); err != nil {
+		t.Fatal(err)
+	}
+	if err := rc.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBlobCache(t *testing.T) {
+	c := newBlobCache(t.TempDir(), 1<<30)
+	img, _ := random.Image(1024, 3)
+	layers, _ := cache.Image(img, c).Layers()
+
+	// A layer read halfway is not cached.
+	rc, _ := layers[0].Compressed()
+	_, _ = rc.Read(make([]byte, 10))
+	_ = rc.Close()
+	if blobs, _ := c.list(); len(blobs) != 0 {
+		t.Fatalf("partially read layer was cached: %+v", blobs)
+	}
+
+	for _, l := range layers {
+		readLayer(t, l)
+	}
+	blobs, err := c.list()
+	if err != nil || len(blobs) != 3 {
+		t.Fatalf("list() = %+v, %v, want 3 layers", blobs, err)
+	}
+
+	// The second pull reads every layer from the cache. Reading them again,
+	// as a retried daemon write does, does not count them twice.
+	layers, _ = cacheImage(img, c).Layers()
+	var total int64
+	for _, l := range layers {
+		readLayer(t, l)
+		readLayer(t, l)
+		size, _ := l.Size()
+		total += size
+	}
+	if got := c.cachedBytes(); got != total {
+		t.Errorf("cachedBytes() = %d, want all %d bytes of the layers", got, total)
+	}
+
+	// A corrupted layer fails the read and is removed.
+	digest, _ := layers[1].Digest()
+	if err := os.WriteFile(c.path(digest), []byte("garbage"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cached, err := c.Get(digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc, _ = cached.Compressed()
+	if _, err := io.Copy(io.Discard, rc); err == nil {
+		t.Error("reading a corrupted layer succeeded")
+	}
+	if _, err := c.Get(digest); !errors.Is(err, cache.ErrNotFound) {
+		t.Errorf("Get() of a corrupted layer = %v, want ErrNotFound", err)
+	}
+}
+
+func TestCacheImageMediaType(t *testing.T) {
+	c := newBlobCache(t.TempDir(), 1<<30)
+	layer, _ := random.Layer(512, types.OCILayer)
+	img, err := mutate.AppendLayers(mutate.MediaType(empty.Image, types.OCIManifestSchema1), layer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest, _ := layer.Digest()
+	cl, _ := c.Put(layer)
+	readLayer(t, cl)
+
+	cached, err := cacheImage(img, c).LayerByDigest(digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mt, err := cached.MediaType(); err != nil || mt != types.OCILayer {
+		t.Errorf("MediaType() of a cached layer = %s, %v, want %s", mt, err, types.OCILayer)
+	}
+}
+
+func TestBlobCacheEviction(t *testing.T) {
+	img, _ := random.Image(1000, 3)
+	layers, _ := img.Layers()
+	// One byte short of holding all three layers.
+	var maxSize int64 = -1
+	for _, l := range layers {
+		size, _ := l.Size()
+		maxSize += size
+	}
+	c := newBlobCache(t.TempDir(), maxSize)
+
+	for i, l := range layers[:2] {
+		cl, _ := c.Put(l)
+		readLayer(t, cl)
+		digest, _ := l.Digest()
+		used := time.Now().Add(time.Duration(i-10) * time.Minute)
+		_ = os.Chtimes(c.path(digest), used, used)
+	}
+	// Using the first layer makes the second the least recently used.
+	first, _ := layers[0].Digest()
+	if _, err := c.Get(first); err != nil {
+		t.Fatal(err)
+	}
+	cl, _ := c.Put(layers[2])
+	readLayer(t, cl)
+
+	second, _ := layers[1].Digest()
+	if _, err := c.Get(second); !errors.Is(err, cache.ErrNotFound) {
+		t.Errorf("least recently used layer was kept: %v", err)
+	}
+	if blobs, _ := c.list(); len(blobs) != 2 {
+		t.Errorf("cache holds %d layers, want 2", len(blobs))
+	}
+}
+
+func TestPruneCache(t *testing.T) {
+	oldDir, oldMax, oldFormat := cacheDir, cacheMaxSize, outputFormat
+	t.Cleanup(func() { cacheDir, cacheMaxSize, outputFormat = oldDir, oldMax, oldFormat })
+	cacheDir, cacheMaxSize, outputFormat = t.TempDir(), 1<<30, outputJSON
+
+	c := newBlobCache(cacheDir, int64(cacheMaxSize))
+	img, _ := random.Image(1000, 3)
+	layers, _ := img.Layers()
+	for i, l := range layers {
+		cl, _ := c.Put(l)
+		readLayer(t, cl)
+		digest, _ := l.Digest()
+		used := time.Now().Add(-time.Duration(i) * 48 * time.Hour)
+		_ = os.Chtimes(c.path(digest), used, used)
+	}
+
+	if err := pruneCache(false, 24*time.Hour, int64(cacheMaxSize)); err != nil {
+		t.Fatalf("pruneCache() error = %v", err)
+	}
+	if blobs, _ := c.list(); len(blobs) != 1 {
+		t.Errorf("--older-than 24h left %d layers, want 1", len(blobs))
+	}
+	if err := pruneCache(true, 0, int64(cacheMaxSize)); err != nil {
+		t.Fatalf("pruneCache() error = %v", err)
+	}
+	if blobs, _ := c.list(); len(blobs) != 0 {
+		t.Errorf("--all left %d layers", len(blobs))
+	}
+
+	cacheDir = ""
+	if err := listCache(); exitCode(err) != exitValidation {
+		t.Errorf("listCache() without a directory = %v", err)
+	}
+}
+
+func TestByteSizeFlag(t *testing.T) {
+	var s byteSize
+	if err := s.Set("10G"); err != nil || s != 10<<30 || s.String() != "10G" {
+		t.Errorf("byteSize = %d (%s), %v", s, s.String(), err)
+	}
+	if err := s.Set("1500"); err != nil || s.String() != "1500" {
+		t.Errorf("byteSize = %s, %v", s.String(), err)
+	}
+	if err := s.Set("big"); err == nil {
+		t.Error("invalid size accepted")
+	}
+}
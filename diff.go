@@ -0,0 +1,453 @@
+package main
+
+import (
+	"archive/tar"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/spf13/cobra"
+)
+
+const (
+	changeAdded    = "added"
+	changeRemoved  = "removed"
+	changeModified = "modified"
+	changeShared   = "shared"
+
+	whiteoutPrefix = ".wh."
+	whiteoutOpaque = ".wh..wh..opq"
+)
+
+// ImageDiff is the difference between two stored images printed by diff.
+type ImageDiff struct {
+	From   string         `json:"from"`
+	To     string         `json:"to"`
+	Layers []LayerChange  `json:"layers"`
+	Config []ConfigChange `json:"config"`
+	Files  []FileChange   `json:"files,omitempty"`
+}
+
+// LayerChange tells whether a layer is only in one of the images or in both.
+type LayerChange struct {
+	Change string `json:"change"`
+	Digest string `json:"digest"`
+	Size   int64  `json:"size"`
+}
+
+// ConfigChange is a config field whose value differs. Old or New is empty
+// when the field is only set in one of the images.
+type ConfigChange struct {
+	Field string `json:"field"`
+	Old   string `json:"old,omitempty"`
+	New   string `json:"new,omitempty"`
+}
+
+// FileChange is a file whose content differs between the filesystems of the
+// two images.
+type FileChange struct {
+	Change  string `json:"change"`
+	Path    string `json:"path"`
+	OldSize int64  `json:"oldSize,omitempty"`
+	NewSize int64  `json:"newSize,omitempty"`
+}
+
+func newDiffCmd(storageType string, validate func() error) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "diff " + refUsage(storageType) + " " + refUsage(storageType),
+		Short: "Compare the layers and config of two stored images",
+		Long: `Show the layers added, removed and shared between two stored images and
+the config fields that changed. With --files the layers that are not shared
+are also compared file by file.`,
+		Args: cobra.ExactArgs(2),
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			return validate()
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			files, _ := cmd.Flags().GetBool("files")
+			return diffImages(cmd.Context(), storageType, args[0], args[1], files)
+		},
+	}
+	cmd.Flags().Bool("files", false, "Also compare the files of both images, reading every layer")
+	return cmd
+}
+
+func diffImages(ctx context.Context, storageType string, fromRef string, toRef string, files bool) error {
+	from, err := fetchStoredImage(ctx, storageType, fromRef)
+	if err != nil {
+		return err
+	}
+	to, err := fetchStoredImage(ctx, storageType, toRef)
+	if err != nil {
+		return err
+	}
+	diff, err := compareImages(from, to, files)
+	if err != nil {
+		return err
+	}
+	diff.From, diff.To = fromRef, toRef
+	return printResult(diff, func(w io.Writer) error { return writeImageDiff(w, diff) })
+}
+
+func fetchStoredImage(ctx context.Context, storageType string, storageRef string) (v1.Image, error) {
+	_, target, err := openStorageRef(ctx, storageType, storageRef)
+	if err != nil {
+		return nil, err
+	}
+	desc, err := remote.Get(target, remote.WithContext(ctx), withRegistryTransport())
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch %s: %w", storageRef, err)
+	}
+	if desc.MediaType.IsIndex() {
+		return nil, fmt.Errorf("%s is an image index, compare one of its platforms instead", storageRef)
+	}
+	return desc.Image()
+}
+
+func compareImages(from v1.Image, to v1.Image, files bool) (*ImageDiff, error) {
+	fromManifest, err := from.Manifest()
+	if err != nil {
+		return nil, err
+	}
+	toManifest, err := to.Manifest()
+	if err != nil {
+		return nil, err
+	}
+	fromConfig, err := from.ConfigFile()
+	if err != nil {
+		return nil, err
+	}
+	toConfig, err := to.ConfigFile()
+	if err != nil {
+		return nil, err
+	}
+
+	diff := &ImageDiff{
+		Layers: compareLayers(fromManifest.Layers, toManifest.Layers),
+		Config: compareConfigs(fromConfig, toConfig),
+	}
+	if !files {
+		return diff, nil
+	}
+
+	// A file of a dropped layer may still be provided by a shared one, so
+	// both filesystems are compared as a whole. Shared layers are read once.
+	layers := map[v1.Hash][]layerEntry{}
+	oldFiles, err := imageFiles(from, layers)
+	if err != nil {
+		return nil, err
+	}
+	newFiles, err := imageFiles(to, layers)
+	if err != nil {
+		return nil, err
+	}
+	diff.Files = compareFiles(oldFiles, newFiles)
+	return diff, nil
+}
+
+// compareLayers lists the layers of from as shared or removed, followed by
+// the layers only in to.
+func compareLayers(from []v1.Descriptor, to []v1.Descriptor) []LayerChange {
+	inFrom := map[v1.Hash]bool{}
+	for _, l := range from {
+		inFrom[l.Digest] = true
+	}
+	inTo := map[v1.Hash]bool{}
+	for _, l := range to {
+		inTo[l.Digest] = true
+	}
+
+	changes := make([]LayerChange, 0, len(from)+len(to))
+	for _, l := range from {
+		change := changeRemoved
+		if inTo[l.Digest] {
+			change = changeShared
+		}
+		changes = append(changes, LayerChange{Change: change, Digest: l.Digest.String(), Size: l.Size})
+	}
+	for _, l := range to {
+		if !inFrom[l.Digest] {
+			changes = append(changes, LayerChange{Change: changeAdded, Digest: l.Digest.String(), Size: l.Size})
+		}
+	}
+	return changes
+}
+
+func compareConfigs(from *v1.ConfigFile, to *v1.ConfigFile) []ConfigChange {
+	var changes []ConfigChange
+	field := func(name, before, after string) {
+		if before != after {
+			changes = append(changes, ConfigChange{Field: name, Old: before, New: after})
+		}
+	}
+	field("Platform", platformString(from), platformString(to))
+	field("User", from.Config.User, to.Config.User)
+	field("WorkingDir", from.Config.WorkingDir, to.Config.WorkingDir)
+	field("Entrypoint", joinArgs(from.Config.Entrypoint), joinArgs(to.Config.Entrypoint))
+	field("Cmd", joinArgs(from.Config.Cmd), joinArgs(to.Config.Cmd))
+	field("ExposedPorts", joinKeys(from.Config.ExposedPorts), joinKeys(to.Config.ExposedPorts))
+
+	changes = append(changes, compareMaps("Env", envMap(from.Config.Env), envMap(to.Config.Env))...)
+	changes = append(changes, compareMaps("Label", from.Config.Labels, to.Config.Labels)...)
+	return changes
+}
+
+func compareMaps(field string, from map[string]string, to map[string]string) []ConfigChange {
+	keys := map[string]bool{}
+	for k := range from {
+		keys[k] = true
+	}
+	for k := range to {
+		keys[k] = true
+	}
+	sorted := make([]string, 0, len(keys))
+	for k := range keys {
+		sorted = append(sorted, k)
+	}
+	sort.Strings(sorted)
+
+	var changes []ConfigChange
+	for _, k := range sorted {
+		if from[k] != to[k] {
+			changes = append(changes, ConfigChange{Field: field + " " + k, Old: from[k], New: to[k]})
+		}
+	}
+	return changes
+}
+
+func platformString(cfg *v1.ConfigFile) string {
+	if p := cfg.Platform(); p != nil {
+		return p.String()
+	}
+	return ""
+}
+
+func envMap(env []string) map[string]string {
+	m := make(map[string]string, len(env))
+	for _, e := range env {
+		k, v, _ := strings.Cut(e, "=")
+		m[k] = v
+	}
+	return m
+}
+
+func joinArgs(args []string) string {
+	if len(args) == 0 {
+		return ""
+	}
+	b, _ := json.Marshal(args)
+	return string(b)
+}
+
+func joinKeys[V any](m map[string]V) string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return strings.Join(keys, ", ")
+}
+
+// fileEntry is a file in a layer.
+type fileEntry struct {
+	size   int64
+	mode   int64
+	link   string
+	digest [sha256.Size]byte
+}
+
+// layerEntry is a file of a layer, or a whiteout hiding a path of the layers
+// below, or with opaque the contents of a directory.
+type layerEntry struct {
+	path     string
+	file     fileEntry
+	whiteout bool
+	opaque   bool
+}
+
+// imageFiles applies the layers of img in order and returns the files of the
+// resulting filesystem. layers caches the entries of the layers read so far.
+func imageFiles(img v1.Image, layers map[v1.Hash][]layerEntry) (map[string]fileEntry, error) {
+	imgLayers, err := img.Layers()
+	if err != nil {
+		return nil, err
+	}
+	files := map[string]fileEntry{}
+	for _, layer := range imgLayers {
+		h, err := layer.Digest()
+		if err != nil {
+			return nil, err
+		}
+		entries, ok := layers[h]
+		if !ok {
+			mt, err := layer.MediaType()
+			if err != nil {
+				return nil, err
+			}
+			if strings.HasSuffix(string(mt), encryptedSuffix) {
+				return nil, fmt.Errorf("layer %s is encrypted and cannot be compared file by file", h)
+			}
+			if entries, err = readLayerEntries(layer); err != nil {
+				return nil, fmt.Errorf("failed to read layer %s: %w", h, err)
+			}
+			layers[h] = entries
+		}
+		// Whiteouts only hide the layers below, not files of their own layer.
+		// Directories are not kept, so a whiteout also hides every file below
+		// its path.
+		for _, e := range entries {
+			if !e.opaque && !e.whiteout {
+				continue
+			}
+			if e.whiteout {
+				delete(files, e.path)
+			}
+			prefix := strings.TrimSuffix(e.path, "/") + "/"
+			for p := range files {
+				if strings.HasPrefix(p, prefix) {
+					delete(files, p)
+				}
+			}
+		}
+		for _, e := range entries {
+			if !e.whiteout && !e.opaque {
+				files[e.path] = e.file
+			}
+		}
+	}
+	return files, nil
+}
+
+func readLayerEntries(layer v1.Layer) ([]layerEntry, error) {
+	rc, err := layer.Uncompressed()
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = rc.Close() }()
+
+	var entries []layerEntry
+	tr := tar.NewReader(rc)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return entries, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		name := path.Clean("/" + hdr.Name)
+		dir, base := path.Split(name)
+		switch {
+		case base == whiteoutOpaque:
+			entries = append(entries, layerEntry{path: dir, opaque: true})
+			continue
+		case strings.HasPrefix(base, whiteoutPrefix):
+			entries = append(entries, layerEntry{path: path.Join(dir, strings.TrimPrefix(base, whiteoutPrefix)), whiteout: true})
+			continue
+		case hdr.Typeflag == tar.TypeDir:
+			continue
+		}
+
+		entry := fileEntry{size: hdr.Size, mode: hdr.Mode, link: hdr.Linkname}
+		h := sha256.New()
+		if _, err := io.Copy(h, tr); err != nil {
+			return nil, err
+		}
+		copy(entry.digest[:], h.Sum(nil))
+		entries = append(entries, layerEntry{path: name, file: entry})
+	}
+}
+
+func compareFiles(from map[string]fileEntry, to map[string]fileEntry) []FileChange {
+	paths := map[string]bool{}
+	for p := range from {
+		paths[p] = true
+	}
+	for p := range to {
+		paths[p] = true
+	}
+	sorted := make([]string, 0, len(paths))
+	for p := range paths {
+		sorted = append(sorted, p)
+	}
+	sort.Strings(sorted)
+
+	changes := []FileChange{}
+	for _, p := range sorted {
+		before, inFrom := from[p]
+		after, inTo := to[p]
+		switch {
+		case !inTo:
+			changes = append(changes, FileChange{Change: changeRemoved, Path: p, OldSize: before.size})
+		case !inFrom:
+			changes = append(changes, FileChange{Change: changeAdded, Path: p, NewSize: after.size})
+		case before != after:
+			changes = append(changes, FileChange{Change: changeModified, Path: p, OldSize: before.size, NewSize: after.size})
+		}
+	}
+	return changes
+}
+
+var changeSymbols = map[string]string{
+	changeAdded:    "+",
+	changeRemoved:  "-",
+	changeModified: "~",
+	changeShared:   "=",
+}
+
+func writeImageDiff(out io.Writer, d *ImageDiff) error {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintf(w, "--- %s\n+++ %s\n\n", d.From, d.To)
+
+	var added, removed int64
+	_, _ = fmt.Fprintln(w, "Layers:")
+	for _, l := range d.Layers {
+		_, _ = fmt.Fprintf(w, "  %s %s\t%s\n", changeSymbols[l.Change], l.Digest, humanSize(l.Size))
+		switch l.Change {
+		case changeAdded:
+			added += l.Size
+		case changeRemoved:
+			removed += l.Size
+		}
+	}
+	_, _ = fmt.Fprintf(w, "  %s added, %s removed\n", humanSize(added), humanSize(removed))
+
+	_, _ = fmt.Fprintln(w, "\nConfig:")
+	if len(d.Config) == 0 {
+		_, _ = fmt.Fprintln(w, "  no changes")
+	}
+	for _, c := range d.Config {
+		_, _ = fmt.Fprintf(w, "  %s:\t%s -> %s\n", c.Field, orNone(c.Old), orNone(c.New))
+	}
+
+	if d.Files != nil {
+		_, _ = fmt.Fprintln(w, "\nFiles:")
+		for _, f := range d.Files {
+			switch f.Change {
+			case changeModified:
+				_, _ = fmt.Fprintf(w, "  ~ %s\t%s -> %s\n", f.Path, humanSize(f.OldSize), humanSize(f.NewSize))
+			case changeAdded:
+				_, _ = fmt.Fprintf(w, "  + %s\t%s\n", f.Path, humanSize(f.NewSize))
+			default:
+				_, _ = fmt.Fprintf(w, "  - %s\n", f.Path)
+			}
+		}
+	}
+	return w.Flush()
+}
+
+func orNone(s string) string {
+	if s == "" {
+		return "(none)"
+	}
+	return s
+}
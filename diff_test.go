@@ -0,0 +1,149 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"sort"
+	"strings"
+	"testing"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+)
+
+// tarLayer builds a layer holding the given files, path to content.
+func tarLayer(t *testing.T, files map[string]string) v1.Layer {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, name := range sortedKeys(files) {
+		_ = tw.WriteHeader(&tar.Header{Name: name, Mode: 0o644, Size: int64(len(files[name])), Typeflag: tar.TypeReg})
+		_, _ = tw.Write([]byte(files[name]))
+	}
+	_ = tw.Close()
+	layer, err := tarball.LayerFromOpener(func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(buf.Bytes())), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return layer
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func testImage(t *testing.T, cfg v1.Config, layers ...v1.Layer) v1.Image {
+	t.Helper()
+	img, err := mutate.AppendLayers(empty.Image, layers...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img, err = mutate.Config(img, cfg); err != nil {
+		t.Fatal(err)
+	}
+	return img
+}
+
+func TestCompareImages(t *testing.T) {
+	base := tarLayer(t, map[string]string{"etc/os-release": "debian", "lib/libc.so": "libc"})
+	from := testImage(t, v1.Config{
+		Entrypoint: []string{"/app/server"},
+		Env:        []string{"PATH=/bin", "MODE=debug"},
+		Labels:     map[string]string{"version": "1"},
+	}, base, tarLayer(t, map[string]string{"app/server": "v1", "app/debug.conf": "x", "lib/libc.so": "libc"}))
+	to := testImage(t, v1.Config{
+		Entrypoint: []string{"/app/server", "--prod"},
+		Env:        []string{"PATH=/bin"},
+		Labels:     map[string]string{"version": "2"},
+	}, base, tarLayer(t, map[string]string{"app/server": "v2!", "app/health": "ok", "etc/.wh.os-release": ""}))
+
+	diff, err := compareImages(from, to, true)
+	if err != nil {
+		t.Fatalf("compareImages() error = %v", err)
+	}
+
+	var changes []string
+	for _, l := range diff.Layers {
+		changes = append(changes, l.Change)
+	}
+	if got := strings.Join(changes, ","); got != "shared,removed,added" {
+		t.Errorf("layer changes = %s, want shared,removed,added", got)
+	}
+
+	config := map[string]ConfigChange{}
+	for _, c := range diff.Config {
+		config[c.Field] = c
+	}
+	if c := config["Entrypoint"]; c.New != `["/app/server","--prod"]` {
+		t.Errorf("Entrypoint change = %+v", c)
+	}
+	if c := config["Env MODE"]; c.Old != "debug" || c.New != "" {
+		t.Errorf("Env MODE change = %+v", c)
+	}
+	if c := config["Label version"]; c.Old != "1" || c.New != "2" {
+		t.Errorf("Label version change = %+v", c)
+	}
+	if _, ok := config["Env PATH"]; ok {
+		t.Error("unchanged Env PATH reported as changed")
+	}
+
+	// lib/libc.so is only in a dropped layer, but the shared base still
+	// provides it unchanged.
+	files := map[string]string{}
+	for _, f := range diff.Files {
+		files[f.Path] = f.Change
+	}
+	want := map[string]string{
+		"/app/server":     changeModified,
+		"/app/health":     changeAdded,
+		"/app/debug.conf": changeRemoved,
+		"/etc/os-release": changeRemoved,
+	}
+	for p, change := range want {
+		if files[p] != change {
+			t.Errorf("file %s change = %q, want %q", p, files[p], change)
+		}
+	}
+	if len(files) != len(want) {
+		t.Errorf("file changes = %v, want %v", files, want)
+	}
+
+	// Whiting out a directory removes the files below it.
+	lower := tarLayer(t, map[string]string{"dir/a": "a", "dir/sub/b": "b", "other/c": "c"})
+	dirFrom := testImage(t, v1.Config{}, lower)
+	dirTo := testImage(t, v1.Config{}, lower, tarLayer(t, map[string]string{"dir/.wh.sub": "", ".wh.other": ""}))
+	dirDiff, err := compareImages(dirFrom, dirTo, true)
+	if err != nil {
+		t.Fatalf("compareImages() error = %v", err)
+	}
+	var removed []string
+	for _, f := range dirDiff.Files {
+		if f.Change == changeRemoved {
+			removed = append(removed, f.Path)
+		}
+	}
+	if got := strings.Join(removed, ","); got != "/dir/sub/b,/other/c" || len(dirDiff.Files) != 2 {
+		t.Errorf("file changes after directory whiteouts = %+v, want /dir/sub/b and /other/c removed", dirDiff.Files)
+	}
+
+	var out bytes.Buffer
+	diff.From, diff.To = "bucket/app:v1", "bucket/app:v2"
+	if err := writeImageDiff(&out, diff); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{"--- bucket/app:v1", "+ /app/health", "~ /app/server", "Label version:"} {
+		if !strings.Contains(out.String(), s) {
+			t.Errorf("diff output does not contain %q:\n%s", s, out.String())
+		}
+	}
+}
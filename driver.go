@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"path"
+	"strings"
+
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/distribution/distribution/v3/registry/storage/driver/factory"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/nbctools/oci-store/pkg/ocistore"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// Paths of the distribution registry layout, relative to the driver root.
+const (
+	repositoriesRoot = "/docker/registry/v2/repositories"
+	blobsRoot        = "/docker/registry/v2/blobs"
+)
+
+// openStorageDriver returns the storage driver of bucket, for commands that
+// need to look at the registry layout itself rather than go through the
+// registry API.
+func openStorageDriver(ctx context.Context, storageType string, bucket string) (_ storagedriver.StorageDriver, err error) {
+	ctx, span := startSpan(ctx, "backend setup", attribute.String("storage.type", storageType), attribute.String("storage.bucket", bucket))
+	defer func() { endSpan(span, err) }()
+
+	backend, err := NewBackend(storageType)
+	if err != nil {
+		return nil, err
+	}
+	return openBackendDriver(ctx, backend, bucket)
+}
+
+// openBackendDriver returns the storage driver of bucket on backend.
+func openBackendDriver(ctx context.Context, backend StorageBackend, bucket string) (storagedriver.StorageDriver, error) {
+	if err := ocistore.ValidateBucket(bucket); err != nil {
+		return nil, err
+	}
+	if err := backend.ValidateConfig(); err != nil {
+		return nil, err
+	}
+	return factory.Create(ctx, backend.Type(), backend.GetStorageConfig(bucket))
+}
+
+// listRepositories returns the names of all repositories below dir. A
+// directory is a repository when it holds any of the _manifests, _layers or
+// _uploads directories; repositories can be nested in each other.
+func listRepositories(ctx context.Context, d storagedriver.StorageDriver, dir string) ([]string, error) {
+	children, err := d.List(ctx, dir)
+	if isPathNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var repos []string
+	isRepo := false
+	for _, child := range children {
+		if strings.HasPrefix(path.Base(child), "_") {
+			isRepo = true
+			continue
+		}
+		nested, err := listRepositories(ctx, d, child)
+		if err != nil {
+			return nil, err
+		}
+		repos = append(repos, nested...)
+	}
+	if isRepo {
+		repos = append(repos, strings.TrimPrefix(dir, repositoriesRoot+"/"))
+	}
+	return repos, nil
+}
+
+// readLink reads a digest from one of the link files the registry uses for
+// tags, revisions and layers.
+func readLink(ctx context.Context, d storagedriver.StorageDriver, p string) (v1.Hash, error) {
+	content, err := d.GetContent(ctx, p)
+	if err != nil {
+		return v1.Hash{}, err
+	}
+	return v1.NewHash(strings.TrimSpace(string(content)))
+}
+
+// listLinkDigests returns the digests of the link directories below dir,
+// which are laid out as <dir>/<algorithm>/<hex>.
+func listLinkDigests(ctx context.Context, d storagedriver.StorageDriver, dir string) (map[v1.Hash]bool, error) {
+	digests := map[v1.Hash]bool{}
+	algorithms, err := d.List(ctx, dir)
+	if isPathNotFound(err) {
+		return digests, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, alg := range algorithms {
+		entries, err := d.List(ctx, alg)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			h, err := v1.NewHash(path.Base(alg) + ":" + path.Base(entry))
+			if err != nil {
+				continue
+			}
+			digests[h] = true
+		}
+	}
+	return digests, nil
+}
+
+func blobDataPath(h v1.Hash) string {
+	return path.Join(blobsRoot, h.Algorithm, h.Hex[:2], h.Hex, "data")
+}
+
+func isPathNotFound(err error) bool {
+	var notFound storagedriver.PathNotFoundError
+	return errors.As(err, &notFound)
+}
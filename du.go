@@ -0,0 +1,276 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"path"
+	"sort"
+	"text/tabwriter"
+
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/spf13/cobra"
+)
+
+// UsageReport is the storage usage of a bucket printed by du.
+type UsageReport struct {
+	Bucket       string            `json:"bucket"`
+	Repositories []RepositoryUsage `json:"repositories"`
+	// TotalBytes is the size of every blob in the bucket, ReferencedBytes of
+	// those linked into at least one repository. The difference can be
+	// reclaimed by garbage collection.
+	TotalBytes        int64 `json:"totalBytes"`
+	ReferencedBytes   int64 `json:"referencedBytes"`
+	UnreferencedBytes int64 `json:"unreferencedBytes"`
+}
+
+// RepositoryUsage describes the blobs held by one repository. StoredBytes is
+// the sum of UniqueBytes, only held by this repository, and SharedBytes, also
+// held by others. LogicalBytes adds up the size of every tag, as if nothing
+// was deduplicated.
+type RepositoryUsage struct {
+	Name         string     `json:"name"`
+	LogicalBytes int64      `json:"logicalBytes"`
+	StoredBytes  int64      `json:"storedBytes"`
+	UniqueBytes  int64      `json:"uniqueBytes"`
+	SharedBytes  int64      `json:"sharedBytes"`
+	Tags         []TagUsage `json:"tags"`
+}
+
+// TagUsage is the size of the content a tag refers to. Of its
+// LogicalBytes, UniqueBytes are referred to by no other tag in the bucket and
+// SharedBytes also by other tags, e.g. a common base image.
+type TagUsage struct {
+	Name         string `json:"name"`
+	Digest       string `json:"digest"`
+	LogicalBytes int64  `json:"logicalBytes"`
+	UniqueBytes  int64  `json:"uniqueBytes"`
+	SharedBytes  int64  `json:"sharedBytes"`
+	// blobs holds the size of every blob the tag refers to.
+	blobs map[v1.Hash]int64
+}
+
+func newDuCmd(storageType string, validate func() error) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "du <bucket>",
+		Short: "Report storage usage and deduplication per repository and tag",
+		Args:  cobra.ExactArgs(1),
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			return validate()
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return diskUsage(cmd.Context(), storageType, args[0])
+		},
+	}
+	return cmd
+}
+
+func diskUsage(ctx context.Context, storageType string, bucket string) error {
+	d, err := openStorageDriver(ctx, storageType, bucket)
+	if err != nil {
+		return err
+	}
+	report, err := newUsageScanner(d).scan(ctx)
+	if err != nil {
+		return err
+	}
+	report.Bucket = bucket
+	return printResult(report, func(w io.Writer) error { return writeUsageReport(w, report) })
+}
+
+type usageScanner struct {
+	driver storagedriver.StorageDriver
+	// sizes caches blob sizes, -1 for missing blobs.
+	sizes map[v1.Hash]int64
+}
+
+func newUsageScanner(d storagedriver.StorageDriver) *usageScanner {
+	return &usageScanner{driver: d, sizes: map[v1.Hash]int64{}}
+}
+
+func (s *usageScanner) scan(ctx context.Context) (*UsageReport, error) {
+	repos, err := listRepositories(ctx, s.driver, repositoriesRoot)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list repositories: %w", err)
+	}
+	sort.Strings(repos)
+
+	// The blobs a repository holds are its layer links and its manifest
+	// revisions, tagged or not.
+	held := make([]map[v1.Hash]bool, len(repos))
+	holders := map[v1.Hash]int{}
+	// Tags are charged for their blobs the same way, counting the tags
+	// rather than the repositories referring to each blob.
+	tags := make([][]TagUsage, len(repos))
+	tagHolders := map[v1.Hash]int{}
+	for i, repo := range repos {
+		base := path.Join(repositoriesRoot, repo)
+		blobs, err := listLinkDigests(ctx, s.driver, path.Join(base, "_layers"))
+		if err != nil {
+			return nil, err
+		}
+		revisions, err := listLinkDigests(ctx, s.driver, path.Join(base, "_manifests", "revisions"))
+		if err != nil {
+			return nil, err
+		}
+		for h := range revisions {
+			blobs[h] = true
+		}
+		for h := range blobs {
+			holders[h]++
+		}
+		held[i] = blobs
+
+		if tags[i], err = s.tagUsage(ctx, repo); err != nil {
+			return nil, err
+		}
+		for _, t := range tags[i] {
+			for h := range t.blobs {
+				tagHolders[h]++
+			}
+		}
+	}
+
+	report := &UsageReport{Repositories: make([]RepositoryUsage, 0, len(repos))}
+	for i, repo := range repos {
+		usage := RepositoryUsage{Name: repo}
+		for h := range held[i] {
+			size := s.blobSize(ctx, h)
+			if size < 0 {
+				continue
+			}
+			if holders[h] > 1 {
+				usage.SharedBytes += size
+			} else {
+				usage.UniqueBytes += size
+			}
+		}
+		usage.StoredBytes = usage.UniqueBytes + usage.SharedBytes
+		usage.Tags = tags[i]
+		for j := range usage.Tags {
+			t := &usage.Tags[j]
+			for h, size := range t.blobs {
+				if tagHolders[h] > 1 {
+					t.SharedBytes += size
+				} else {
+					t.UniqueBytes += size
+				}
+			}
+			usage.LogicalBytes += t.LogicalBytes
+		}
+		report.Repositories = append(report.Repositories, usage)
+	}
+
+	for h := range holders {
+		if size := s.blobSize(ctx, h); size > 0 {
+			report.ReferencedBytes += size
+		}
+	}
+	err = s.driver.Walk(ctx, blobsRoot, func(fi storagedriver.FileInfo) error {
+		if !fi.IsDir() && path.Base(fi.Path()) == "data" {
+			report.TotalBytes += fi.Size()
+		}
+		return nil
+	})
+	if err != nil && !isPathNotFound(err) {
+		return nil, fmt.Errorf("failed to walk blobs: %w", err)
+	}
+	report.UnreferencedBytes = max(report.TotalBytes-report.ReferencedBytes, 0)
+	return report, nil
+}
+
+func (s *usageScanner) tagUsage(ctx context.Context, repo string) ([]TagUsage, error) {
+	tagDirs, err := s.driver.List(ctx, path.Join(repositoriesRoot, repo, "_manifests", "tags"))
+	if isPathNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(tagDirs)
+
+	tags := make([]TagUsage, 0, len(tagDirs))
+	for _, tagDir := range tagDirs {
+		tag := path.Base(tagDir)
+		d, err := readLink(ctx, s.driver, path.Join(tagDir, "current", "link"))
+		if err != nil {
+			slog.Warn("Skipping tag with unreadable link", "repository", repo, "tag", tag, "error", err)
+			continue
+		}
+		blobs := map[v1.Hash]int64{}
+		s.manifestBlobs(ctx, d, blobs)
+		usage := TagUsage{Name: tag, Digest: d.String(), blobs: blobs}
+		for _, size := range blobs {
+			usage.LogicalBytes += size
+		}
+		tags = append(tags, usage)
+	}
+	return tags, nil
+}
+
+// manifestBlobs adds a manifest and everything it references to blobs,
+// with their sizes.
+func (s *usageScanner) manifestBlobs(ctx context.Context, d v1.Hash, blobs map[v1.Hash]int64) {
+	if _, ok := blobs[d]; ok {
+		return
+	}
+	blobs[d] = max(s.blobSize(ctx, d), 0)
+
+	content, err := s.driver.GetContent(ctx, blobDataPath(d))
+	if err != nil {
+		return
+	}
+	var m storedManifest
+	if err := json.Unmarshal(content, &m); err != nil {
+		return
+	}
+	for _, child := range m.Manifests {
+		s.manifestBlobs(ctx, child.Digest, blobs)
+	}
+	refs := m.Layers
+	if m.Config != nil {
+		refs = append([]v1.Descriptor{*m.Config}, refs...)
+	}
+	for _, desc := range refs {
+		if _, ok := blobs[desc.Digest]; !ok {
+			blobs[desc.Digest] = desc.Size
+		}
+	}
+}
+
+func (s *usageScanner) blobSize(ctx context.Context, h v1.Hash) int64 {
+	if size, ok := s.sizes[h]; ok {
+		return size
+	}
+	size := int64(-1)
+	if info, err := s.driver.Stat(ctx, blobDataPath(h)); err == nil {
+		size = info.Size()
+	}
+	s.sizes[h] = size
+	return size
+}
+
+func writeUsageReport(out io.Writer, r *UsageReport) error {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintln(w, "REPOSITORY\tTAGS\tLOGICAL\tSTORED\tUNIQUE\tSHARED")
+	for _, repo := range r.Repositories {
+		_, _ = fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%s\t%s\n", repo.Name, len(repo.Tags),
+			humanSize(repo.LogicalBytes), humanSize(repo.StoredBytes), humanSize(repo.UniqueBytes), humanSize(repo.SharedBytes))
+	}
+	_, _ = fmt.Fprintln(w)
+	_, _ = fmt.Fprintln(w, "REPOSITORY\tTAG\tDIGEST\tLOGICAL\tUNIQUE\tSHARED")
+	for _, repo := range r.Repositories {
+		for _, tag := range repo.Tags {
+			_, _ = fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", repo.Name, tag.Name, tag.Digest,
+				humanSize(tag.LogicalBytes), humanSize(tag.UniqueBytes), humanSize(tag.SharedBytes))
+		}
+	}
+	_, _ = fmt.Fprintln(w)
+	_, _ = fmt.Fprintf(w, "Total stored:\t%s (%d bytes)\n", humanSize(r.TotalBytes), r.TotalBytes)
+	_, _ = fmt.Fprintf(w, "Referenced:\t%s\n", humanSize(r.ReferencedBytes))
+	_, _ = fmt.Fprintf(w, "Unreferenced:\t%s\n", humanSize(r.UnreferencedBytes))
+	return w.Flush()
+}
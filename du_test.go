@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+func imageSize(t *testing.T, img v1.Image) int64 {
+	t.Helper()
+	size, _ := img.Size()
+	m, _ := img.Manifest()
+	size += m.Config.Size
+	for _, l := range m.Layers {
+		size += l.Size
+	}
+	return size
+}
+
+func TestUsageScanner(t *testing.T) {
+	reg, _ := startFSRegistry(t)
+	base, _ := random.Image(1024, 1)
+	extra := func() v1.Image {
+		layer, _ := random.Layer(512, "application/vnd.docker.image.rootfs.diff.tar.gzip")
+		img, err := mutate.AppendLayers(base, layer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return img
+	}
+	imgA, imgB := extra(), extra()
+	for ref, img := range map[string]v1.Image{"app:v1": imgA, "app:v2": imgB, "db:v1": imgA} {
+		tag, _ := name.NewTag(reg.RegistryStr()+"/"+ref, name.Insecure)
+		if err := remote.Write(tag, img); err != nil {
+			t.Fatalf("remote.Write(%s) error = %v", ref, err)
+		}
+	}
+
+	d, err := openStorageDriver(context.Background(), "filesystem", "bucket")
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, err := newUsageScanner(d).scan(context.Background())
+	if err != nil {
+		t.Fatalf("scan() error = %v", err)
+	}
+	if len(report.Repositories) != 2 {
+		t.Fatalf("scan() found %d repositories, want 2", len(report.Repositories))
+	}
+	app, db := report.Repositories[0], report.Repositories[1]
+
+	sizeA, sizeB := imageSize(t, imgA), imageSize(t, imgB)
+	if len(app.Tags) != 2 || app.Tags[0].LogicalBytes != sizeA || app.Tags[1].LogicalBytes != sizeB {
+		t.Errorf("app tags = %+v, want v1=%d v2=%d", app.Tags, sizeA, sizeB)
+	}
+	if len(app.Tags) != 2 || len(db.Tags) != 1 {
+		t.Fatalf("tags = %+v, %+v", app.Tags, db.Tags)
+	}
+	// app:v1 and db:v1 are the same image; app:v2 only shares the base layer.
+	baseLayers, _ := base.Layers()
+	baseSize, _ := baseLayers[0].Size()
+	for _, tag := range append(app.Tags[:1:1], db.Tags...) {
+		if tag.UniqueBytes != 0 || tag.SharedBytes != sizeA {
+			t.Errorf("tag %s unique/shared = %d/%d, want 0/%d", tag.Name, tag.UniqueBytes, tag.SharedBytes, sizeA)
+		}
+	}
+	if v2 := app.Tags[1]; v2.UniqueBytes != sizeB-baseSize || v2.SharedBytes != baseSize {
+		t.Errorf("tag v2 unique/shared = %d/%d, want %d/%d", v2.UniqueBytes, v2.SharedBytes, sizeB-baseSize, baseSize)
+	}
+	if app.LogicalBytes != sizeA+sizeB {
+		t.Errorf("app.LogicalBytes = %d, want %d", app.LogicalBytes, sizeA+sizeB)
+	}
+	if db.UniqueBytes != 0 || db.SharedBytes != sizeA {
+		t.Errorf("db unique/shared = %d/%d, want 0/%d", db.UniqueBytes, db.SharedBytes, sizeA)
+	}
+	if app.SharedBytes != sizeA || app.StoredBytes >= app.LogicalBytes {
+		t.Errorf("app shared = %d, stored = %d, logical = %d", app.SharedBytes, app.StoredBytes, app.LogicalBytes)
+	}
+	if report.TotalBytes != app.StoredBytes || report.ReferencedBytes != report.TotalBytes || report.UnreferencedBytes != 0 {
+		t.Errorf("totals = %+v, want total = referenced = %d", report, app.StoredBytes)
+	}
+
+	var out bytes.Buffer
+	if err := writeUsageReport(&out, report); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "REPOSITORY") || !strings.Contains(out.String(), "db") {
+		t.Errorf("unexpected report:\n%s", out.String())
+	}
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/containers/ocicrypt"
+	encconfig "github.com/containers/ocicrypt/config"
+	"github.com/containers/ocicrypt/helpers"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const encryptedSuffix = "+encrypted"
+
+// encryptImage returns a copy of img whose layers are encrypted for the given
+// recipients (e.g. jwe:pubkey.pem) following the OCI image encryption spec.
+// Encrypted blobs are staged in tmpDir, which must outlive the returned image.
+func encryptImage(img v1.Image, recipients []string, tmpDir string) (v1.Image, error) {
+	cc, err := helpers.CreateCryptoConfig(recipients, nil)
+	if err != nil {
+		return nil, fmt.Errorf("invalid encryption recipients: %w", err)
+	}
+
+	layers, err := img.Layers()
+	if err != nil {
+		return nil, err
+	}
+	addenda := make([]mutate.Addendum, 0, len(layers))
+	for i, layer := range layers {
+		add, err := encryptLayer(cc.EncryptConfig, layer, filepath.Join(tmpDir, fmt.Sprintf("layer-%d", i)))
+		if err != nil {
+			return nil, fmt.Errorf("failed to encrypt layer %d: %w", i, err)
+		}
+		addenda = append(addenda, add)
+	}
+
+	return rebuildImage(img, addenda)
+}
+
+func encryptLayer(ec *encconfig.EncryptConfig, layer v1.Layer, path string) (mutate.Addendum, error) {
+	desc, err := layerDescriptor(layer)
+	if err != nil {
+		return mutate.Addendum{}, err
+	}
+	if strings.HasSuffix(string(desc.MediaType), encryptedSuffix) {
+		return mutate.Addendum{}, errors.New("layer is already encrypted")
+	}
+
+	rc, err := layer.Compressed()
+	if err != nil {
+		return mutate.Addendum{}, err
+	}
+	defer func() { _ = rc.Close() }()
+
+	encReader, finalizer, err := ocicrypt.EncryptLayer(ec, rc, ocispecDescriptor(desc))
+	if err != nil {
+		return mutate.Addendum{}, err
+	}
+	encDigest, encSize, err := writeBlobFile(path, encReader)
+	if err != nil {
+		return mutate.Addendum{}, err
+	}
+	annotations, err := finalizer()
+	if err != nil {
+		return mutate.Addendum{}, err
+	}
+
+	diffID, err := layer.DiffID()
+	if err != nil {
+		return mutate.Addendum{}, err
+	}
+	mediaType := ociLayerMediaType(desc.MediaType) + encryptedSuffix
+	return mutate.Addendum{
+		Layer: &encryptedLayer{
+			fileLayer: fileLayer{path: path, digest: encDigest, size: encSize, mediaType: mediaType},
+			diffID:    diffID,
+		},
+		Annotations: annotations,
+		MediaType:   mediaType,
+	}, nil
+}
+
+// isEncrypted reports whether any layer of img uses an encrypted media type.
+func isEncrypted(img v1.Image) (bool, error) {
+	manifest, err := img.Manifest()
+	if err != nil {
+		return false, err
+	}
+	for _, desc := range manifest.Layers {
+		if strings.HasSuffix(string(desc.MediaType), encryptedSuffix) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// decryptImage returns a copy of img with every encrypted layer decrypted using
+// the given private keys (path[:password]). Plain layers are passed through.
+func decryptImage(img v1.Image, keys []string, tmpDir string) (v1.Image, error) {
+	cc, err := helpers.CreateDecryptCryptoConfig(keys, nil)
+	if err != nil {
+		return nil, fmt.Errorf("invalid decryption keys: %w", err)
+	}
+
+	manifest, err := img.Manifest()
+	if err != nil {
+		return nil, err
+	}
+	addenda := make([]mutate.Addendum, 0, len(manifest.Layers))
+	for i, desc := range manifest.Layers {
+		layer, err := img.LayerByDigest(desc.Digest)
+		if err != nil {
+			return nil, err
+		}
+		if !strings.HasSuffix(string(desc.MediaType), encryptedSuffix) {
+			addenda = append(addenda, mutate.Addendum{Layer: layer, Annotations: desc.Annotations, MediaType: desc.MediaType})
+			continue
+		}
+		add, err := decryptLayer(cc.DecryptConfig, layer, desc, filepath.Join(tmpDir, fmt.Sprintf("layer-%d", i)))
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt layer %s: %w", desc.Digest, err)
+		}
+		addenda = append(addenda, add)
+	}
+
+	return rebuildImage(img, addenda)
+}
+
+func decryptLayer(dc *encconfig.DecryptConfig, layer v1.Layer, desc v1.Descriptor, path string) (mutate.Addendum, error) {
+	rc, err := layer.Compressed()
+	if err != nil {
+		return mutate.Addendum{}, err
+	}
+	defer func() { _ = rc.Close() }()
+
+	// The decrypting reader verifies the layer HMAC once it reaches EOF.
+	plainReader, _, err := ocicrypt.DecryptLayer(dc, rc, ocispecDescriptor(desc), false)
+	if err != nil {
+		return mutate.Addendum{}, err
+	}
+	if _, _, err := writeBlobFile(path, plainReader); err != nil {
+		return mutate.Addendum{}, err
+	}
+
+	mediaType := types.MediaType(strings.TrimSuffix(string(desc.MediaType), encryptedSuffix))
+	plain, err := tarball.LayerFromFile(path, tarball.WithMediaType(mediaType))
+	if err != nil {
+		return mutate.Addendum{}, err
+	}
+	return mutate.Addendum{
+		Layer:       plain,
+		Annotations: ocicrypt.FilterOutAnnotations(desc.Annotations),
+		MediaType:   mediaType,
+	}, nil
+}
+
+// rebuildImage assembles an OCI image from img's config and the given layers.
+func rebuildImage(img v1.Image, addenda []mutate.Addendum) (v1.Image, error) {
+	cfg, err := img.ConfigFile()
+	if err != nil {
+		return nil, err
+	}
+	base := mutate.MediaType(empty.Image, types.OCIManifestSchema1)
+	base = mutate.ConfigMediaType(base, types.OCIConfigJSON)
+	out, err := mutate.Append(base, addenda...)
+	if err != nil {
+		return nil, err
+	}
+	// Restore the original config so diff_ids and history are unchanged.
+	return mutate.ConfigFile(out, cfg)
+}
+
+func layerDescriptor(layer v1.Layer) (v1.Descriptor, error) {
+	d, err := layer.Digest()
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+	size, err := layer.Size()
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+	mt, err := layer.MediaType()
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+	return v1.Descriptor{Digest: d, Size: size, MediaType: mt}, nil
+}
+
+func ocispecDescriptor(desc v1.Descriptor) ocispec.Descriptor {
+	return ocispec.Descriptor{
+		MediaType:   string(desc.MediaType),
+		Digest:      digest.Digest(desc.Digest.String()),
+		Size:        desc.Size,
+		Annotations: desc.Annotations,
+	}
+}
+
+// ociLayerMediaType maps Docker layer media types to their OCI equivalents,
+// since the encryption spec only defines "+encrypted" for OCI types.
+func ociLayerMediaType(mt types.MediaType) types.MediaType {
+	switch mt {
+	case types.DockerLayer:
+		return types.OCILayer
+	case types.DockerUncompressedLayer:
+		return types.OCIUncompressedLayer
+	default:
+		return mt
+	}
+}
+
+// writeBlobFile copies r into path and returns the sha256 digest and size of
+// the written content.
+func writeBlobFile(path string, r io.Reader) (v1.Hash, int64, error) {
+	f, err := os.Create(filepath.Clean(path))
+	if err != nil {
+		return v1.Hash{}, 0, err
+	}
+	defer func() { _ = f.Close() }()
+
+	h, size, err := v1.SHA256(io.TeeReader(r, f))
+	if err != nil {
+		return v1.Hash{}, 0, err
+	}
+	return h, size, f.Close()
+}
+
+// encryptedLayer is a v1.Layer whose blob is an encrypted file on disk. The
+// DiffID is that of the plaintext layer, as required by the image config.
+type encryptedLayer struct {
+	fileLayer
+	diffID v1.Hash
+}
+
+func (l *encryptedLayer) DiffID() (v1.Hash, error) {
+	return l.diffID, nil
+}
+
+func (l *encryptedLayer) Uncompressed() (io.ReadCloser, error) {
+	return nil, errors.New("encrypted layers cannot be uncompressed")
+}
+
+// fileLayer is a v1.Layer whose blob is stored verbatim in a local file.
+type fileLayer struct {
+	path      string
+	digest    v1.Hash
+	size      int64
+	mediaType types.MediaType
+}
+
+// newFileLayer hashes the file at path and returns it as a layer blob.
+func newFileLayer(path string, mediaType types.MediaType) (*fileLayer, error) {
+	f, err := os.Open(filepath.Clean(path))
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = f.Close() }()
+
+	h, size, err := v1.SHA256(f)
+	if err != nil {
+		return nil, err
+	}
+	return &fileLayer{path: path, digest: h, size: size, mediaType: mediaType}, nil
+}
+
+func (l *fileLayer) Digest() (v1.Hash, error) {
+	return l.digest, nil
+}
+
+func (l *fileLayer) DiffID() (v1.Hash, error) {
+	return l.digest, nil
+}
+
+func (l *fileLayer) Compressed() (io.ReadCloser, error) {
+	return os.Open(l.path)
+}
+
+func (l *fileLayer) Uncompressed() (io.ReadCloser, error) {
+	return os.Open(l.path)
+}
+
+func (l *fileLayer) Size() (int64, error) {
+	return l.size, nil
+}
+
+func (l *fileLayer) MediaType() (types.MediaType, error) {
+	return l.mediaType, nil
+}
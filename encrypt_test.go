@@ -0,0 +1,109 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/v1/random"
+)
+
+func writeTestKeyPair(t *testing.T, dir string) (string, string) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("rsa.GenerateKey() error = %v", err)
+	}
+	pubDER, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatalf("MarshalPKIXPublicKey() error = %v", err)
+	}
+
+	pubPath := filepath.Join(dir, "pub.pem")
+	privPath := filepath.Join(dir, "priv.pem")
+	if err := os.WriteFile(pubPath, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	privPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	if err := os.WriteFile(privPath, privPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return pubPath, privPath
+}
+
+func TestEncryptDecryptImage(t *testing.T) {
+	dir := t.TempDir()
+	pubPath, privPath := writeTestKeyPair(t, dir)
+
+	img, err := random.Image(1024, 2)
+	if err != nil {
+		t.Fatalf("random.Image() error = %v", err)
+	}
+	origConfig, _ := img.ConfigFile()
+
+	encDir := filepath.Join(dir, "enc")
+	if err := os.Mkdir(encDir, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	enc, err := encryptImage(img, []string{"jwe:" + pubPath}, encDir)
+	if err != nil {
+		t.Fatalf("encryptImage() error = %v", err)
+	}
+
+	encrypted, err := isEncrypted(enc)
+	if err != nil || !encrypted {
+		t.Fatalf("isEncrypted() = %v, %v, want true", encrypted, err)
+	}
+	manifest, err := enc.Manifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, desc := range manifest.Layers {
+		if !strings.HasSuffix(string(desc.MediaType), encryptedSuffix) {
+			t.Errorf("layer media type = %q, want %s suffix", desc.MediaType, encryptedSuffix)
+		}
+		if desc.Annotations["org.opencontainers.image.enc.keys.jwe"] == "" {
+			t.Errorf("layer %s is missing the wrapped JWE key annotation", desc.Digest)
+		}
+	}
+
+	// Decrypting without the matching private key must fail.
+	_, otherPriv := writeTestKeyPair(t, t.TempDir())
+	if _, err := decryptImage(enc, []string{otherPriv}, t.TempDir()); err == nil {
+		t.Error("decryptImage() with the wrong key should have failed")
+	}
+
+	dec, err := decryptImage(enc, []string{privPath}, t.TempDir())
+	if err != nil {
+		t.Fatalf("decryptImage() error = %v", err)
+	}
+	if encrypted, _ := isEncrypted(dec); encrypted {
+		t.Error("decrypted image still reports encrypted layers")
+	}
+
+	origLayers, _ := img.Layers()
+	decLayers, err := dec.Layers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(decLayers) != len(origLayers) {
+		t.Fatalf("decrypted image has %d layers, want %d", len(decLayers), len(origLayers))
+	}
+	for i := range origLayers {
+		want, _ := origLayers[i].Digest()
+		got, _ := decLayers[i].Digest()
+		if got != want {
+			t.Errorf("layer %d digest = %s, want %s", i, got, want)
+		}
+	}
+
+	decConfig, _ := dec.ConfigFile()
+	if len(decConfig.RootFS.DiffIDs) != len(origConfig.RootFS.DiffIDs) {
+		t.Errorf("decrypted config has %d diff_ids, want %d", len(decConfig.RootFS.DiffIDs), len(origConfig.RootFS.DiffIDs))
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	"github.com/nbctools/oci-store/pkg/ocistore"
+	"github.com/spf13/cobra"
+	"google.golang.org/api/googleapi"
+)
+
+// Exit codes of the CLI. Anything not classified below exits with
+// exitFailure.
+const (
+	exitOK         = 0
+	exitFailure    = 1
+	exitValidation = 2
+	exitAuth       = 3
+	exitNotFound   = 4
+	exitNetwork    = 5
+	// exitInterrupted follows the shell convention for SIGINT.
+	exitInterrupted = 130
+)
+
+// validationError marks errors caused by invalid arguments, flags or
+// configuration rather than by the storage.
+type validationError struct {
+	err error
+}
+
+func (e validationError) Error() string { return e.err.Error() }
+
+func (e validationError) Unwrap() error { return e.err }
+
+func invalidf(format string, args ...any) error {
+	return validationError{err: fmt.Errorf(format, args...)}
+}
+
+func invalid(err error) error {
+	if err == nil {
+		return nil
+	}
+	return validationError{err: err}
+}
+
+// markValidationErrors makes argument, flag and PreRunE errors of cmd and its
+// subcommands validation errors. PreRunE only checks the configuration.
+func markValidationErrors(cmd *cobra.Command) {
+	cmd.SetFlagErrorFunc(func(_ *cobra.Command, err error) error {
+		return invalid(err)
+	})
+	if args := cmd.Args; args != nil {
+		cmd.Args = func(cmd *cobra.Command, a []string) error {
+			return invalid(args(cmd, a))
+		}
+	}
+	if pre := cmd.PreRunE; pre != nil {
+		cmd.PreRunE = func(cmd *cobra.Command, a []string) error {
+			return invalid(pre(cmd, a))
+		}
+	}
+	for _, sub := range cmd.Commands() {
+		markValidationErrors(sub)
+	}
+}
+
+// Errors from the storage reach us either directly from a storage driver or
+// as the detail of an embedded registry error, where only the message is
+// left. These markers classify the latter.
+var (
+	authMarkers = []string{
+		"accessdenied", "invalidaccesskeyid", "signaturedoesnotmatch", "expiredtoken",
+		"nocredentialproviders", "authenticationfailed", "authorizationfailure",
+		"status code: 401", "status code: 403", "error 401", "error 403", "response 401", "response 403",
+	}
+	notFoundMarkers = []string{"nosuchbucket", "containernotfound", "bucket does not exist"}
+	networkMarkers  = []string{
+		"dial tcp", "no such host", "connection refused", "connection reset", "i/o timeout",
+		"tls handshake timeout", "send request failed", "network is unreachable",
+	}
+)
+
+// exitCode maps err to the exit code of the CLI.
+func exitCode(err error) int {
+	if err == nil {
+		return exitOK
+	}
+	if errors.Is(err, errInterrupted) {
+		return exitInterrupted
+	}
+	var verr validationError
+	if errors.As(err, &verr) || errors.Is(err, ocistore.ErrInvalid) {
+		return exitValidation
+	}
+	var derr storagedriver.Error
+	if errors.As(err, &derr) && derr.Detail != nil {
+		if code := exitCode(derr.Detail); code != exitFailure {
+			return code
+		}
+	}
+	if code := statusExitCode(err); code != exitFailure {
+		return code
+	}
+	var notFound interface{ NotFound() }
+	if isPathNotFound(err) || errors.As(err, &notFound) || errors.Is(err, fs.ErrNotExist) {
+		return exitNotFound
+	}
+
+	var terr *transport.Error
+	if errors.As(err, &terr) && terr.StatusCode >= http.StatusInternalServerError {
+		if code := markerExitCode(terr.Error()); code != exitFailure {
+			return code
+		}
+	}
+	var nerr net.Error
+	if errors.As(err, &nerr) || errors.Is(err, context.DeadlineExceeded) {
+		return exitNetwork
+	}
+	return markerExitCode(err.Error())
+}
+
+// statusExitCode classifies errors carrying an HTTP status code, from the
+// embedded registry or one of the cloud SDKs.
+func statusExitCode(err error) int {
+	status := 0
+	var terr *transport.Error
+	var gerr *googleapi.Error
+	var aerr *azcore.ResponseError
+	var serr interface{ StatusCode() int }
+	switch {
+	case errors.As(err, &terr):
+		status = terr.StatusCode
+	case errors.As(err, &gerr):
+		status = gerr.Code
+	case errors.As(err, &aerr):
+		status = aerr.StatusCode
+	case errors.As(err, &serr):
+		status = serr.StatusCode()
+	}
+	switch status {
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return exitAuth
+	case http.StatusNotFound:
+		return exitNotFound
+	}
+	return exitFailure
+}
+
+func markerExitCode(msg string) int {
+	msg = strings.ToLower(msg)
+	for _, group := range []struct {
+		markers []string
+		code    int
+	}{
+		{authMarkers, exitAuth},
+		{notFoundMarkers, exitNotFound},
+		{networkMarkers, exitNetwork},
+	} {
+		for _, m := range group.markers {
+			if strings.Contains(msg, m) {
+				return group.code
+			}
+		}
+	}
+	return exitFailure
+}
+
+// exitKind names an exit code in JSON output.
+func exitKind(code int) string {
+	switch code {
+	case exitValidation:
+		return "validation"
+	case exitAuth:
+		return "auth"
+	case exitNotFound:
+		return "not_found"
+	case exitNetwork:
+		return "network"
+	case exitInterrupted:
+		return "interrupted"
+	}
+	return "error"
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"testing"
+
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	"github.com/spf13/cobra"
+	"google.golang.org/api/googleapi"
+)
+
+func TestExitCode(t *testing.T) {
+	registryError := func(status int, detail string) error {
+		return &transport.Error{
+			StatusCode: status,
+			Errors:     []transport.Diagnostic{{Code: transport.UnknownErrorCode, Message: "unknown error", Detail: detail}},
+		}
+	}
+	tests := []struct {
+		name string
+		err  error
+		want int
+	}{
+		{"nil", nil, exitOK},
+		{"plain", errors.New("boom"), exitFailure},
+		{"validation", fmt.Errorf("push: %w", invalidf("missing tag in reference")), exitValidation},
+		{"registry not found", fmt.Errorf("failed to fetch: %w", &transport.Error{StatusCode: http.StatusNotFound}), exitNotFound},
+		{"registry unauthorized", &transport.Error{StatusCode: http.StatusUnauthorized}, exitAuth},
+		{"path not found", storagedriver.PathNotFoundError{Path: "/oci-store/policy.json"}, exitNotFound},
+		{"local file", fmt.Errorf("read: %w", os.ErrNotExist), exitNotFound},
+		{"driver auth", storagedriver.Error{DriverName: "gcs", Detail: &googleapi.Error{Code: http.StatusForbidden}}, exitAuth},
+		{"driver network", storagedriver.Error{DriverName: "s3aws", Detail: &net.OpError{Op: "dial", Err: errors.New("connection refused")}}, exitNetwork},
+		{"storage auth behind registry", registryError(http.StatusInternalServerError, "s3aws: AccessDenied: Access Denied\n\tstatus code: 403"), exitAuth},
+		{"storage network behind registry", registryError(http.StatusInternalServerError, "dial tcp: lookup s3.example.com: no such host"), exitNetwork},
+		{"storage error behind registry", registryError(http.StatusInternalServerError, "disk full"), exitFailure},
+		{"timeout", context.DeadlineExceeded, exitNetwork},
+		{"interrupted", fmt.Errorf("%w by SIGINT: %w", errInterrupted, context.Canceled), exitInterrupted},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := exitCode(tt.err); got != tt.want {
+				t.Errorf("exitCode(%v) = %d, want %d", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMarkValidationErrors(t *testing.T) {
+	root := &cobra.Command{Use: "root"}
+	sub := &cobra.Command{
+		Use:     "sub",
+		Args:    cobra.ExactArgs(1),
+		PreRunE: func(cmd *cobra.Command, args []string) error { return errors.New("missing region") },
+		RunE:    func(cmd *cobra.Command, args []string) error { return errors.New("runtime failure") },
+	}
+	sub.Flags().Int("count", 0, "")
+	root.AddCommand(sub)
+	markValidationErrors(root)
+
+	for _, args := range [][]string{{"sub"}, {"sub", "a"}, {"sub", "--count", "x", "a"}} {
+		root.SetArgs(args)
+		root.SetOut(io.Discard)
+		root.SetErr(io.Discard)
+		if err := root.Execute(); exitCode(err) != exitValidation {
+			t.Errorf("Execute(%v) error = %v, want a validation error", args, err)
+		}
+	}
+
+	sub.PreRunE = nil
+	root.SetArgs([]string{"sub", "a"})
+	if err := root.Execute(); exitCode(err) != exitFailure {
+		t.Errorf("RunE error = %v, want exit code %d", err, exitFailure)
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+
+	"github.com/spf13/cobra"
+)
+
+var fsRootDirectory string
+
+var fsPushCmd = &cobra.Command{
+	Use:   "push <dir>/<image-path>:<tag> [<dir>/<image-path>:<tag>...]",
+	Long:  "Push a Docker image to the local filesystem. Further references in the same directory are tagged after the upload.",
+	Short: "Push a Docker image to the local filesystem",
+	Args:  cobra.MinimumNArgs(1),
+	PreRunE: func(cmd *cobra.Command, args []string) error {
+		return validateFSConfig()
+	},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return pushImage(cmd.Context(), "filesystem", args, pushOptionsFromFlags(cmd))
+	},
+}
+
+var fsPullCmd = &cobra.Command{
+	Use:   "pull <dir>/<image-path>:<tag>",
+	Short: "Pull a Docker image from the local filesystem",
+	Args:  cobra.ExactArgs(1),
+	PreRunE: func(cmd *cobra.Command, args []string) error {
+		return validateFSConfig()
+	},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return pullImage(cmd.Context(), "filesystem", args[0], pullOptionsFromFlags(cmd))
+	},
+}
+
+func validateFSConfig() error {
+	if fsRootDirectory == "" {
+		return errors.New("filesystem backend requires a root directory to be specified via --root-dir")
+	}
+	root, err := filepath.Abs(fsRootDirectory)
+	if err != nil {
+		return err
+	}
+	fsRootDirectory = root
+	return nil
+}
+
+func init() {
+	fsCmd.AddCommand(fsPushCmd, fsPullCmd)
+	fsCmd.AddCommand(newStorageCommands("filesystem", validateFSConfig)...)
+
+	fsCmd.PersistentFlags().StringVar(&fsRootDirectory, "root-dir", "", "Root directory holding one registry directory per bucket")
+
+	addPushFlags(fsPushCmd)
+	addPullFlags(fsPullCmd)
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestValidateFSConfig(t *testing.T) {
+	old := fsRootDirectory
+	defer func() { fsRootDirectory = old }()
+
+	fsRootDirectory = ""
+	if err := validateFSConfig(); err == nil {
+		t.Error("validateFSConfig() should fail without a root directory")
+	}
+
+	fsRootDirectory = "store"
+	if err := validateFSConfig(); err != nil {
+		t.Fatalf("validateFSConfig() error = %v", err)
+	}
+	if !filepath.IsAbs(fsRootDirectory) {
+		t.Errorf("fsRootDirectory = %q, want an absolute path", fsRootDirectory)
+	}
+}
+
+func TestFilesystemBackend(t *testing.T) {
+	old := fsRootDirectory
+	fsRootDirectory = "/srv/images"
+	defer func() { fsRootDirectory = old }()
+
+	backend, err := NewBackend("filesystem")
+	if err != nil {
+		t.Fatalf("NewBackend() error = %v", err)
+	}
+	if backend.Type() != "filesystem" {
+		t.Errorf("Type() = %q, want filesystem", backend.Type())
+	}
+	config := backend.GetStorageConfig("prod")
+	if config["rootdirectory"] != filepath.Join("/srv/images", "prod") {
+		t.Errorf("GetStorageConfig() rootdirectory = %v, want /srv/images/prod", config["rootdirectory"])
+	}
+}
@@ -3,7 +3,6 @@ package main
 import (
 	"errors"
 
-	_ "github.com/distribution/distribution/v3/registry/storage/driver/gcs"
 	"github.com/spf13/cobra"
 )
 
@@ -13,15 +12,15 @@ var (
 )
 
 var gcsPushCmd = &cobra.Command{
-	Use:   "push <bucket>/<image-path>:<tag>",
+	Use:   "push <bucket>/<image-path>:<tag> [<bucket>/<image-path>:<tag>...]",
+	Long:  "Push a Docker image to Google Cloud Storage. Further references in the same bucket are tagged after the upload.",
 	Short: "Push a Docker image to Google Cloud Storage",
-	Args:  cobra.ExactArgs(1),
+	Args:  cobra.MinimumNArgs(1),
 	PreRunE: func(cmd *cobra.Command, args []string) error {
 		return validateGCSConfig()
 	},
 	RunE: func(cmd *cobra.Command, args []string) error {
-		localImage, _ := cmd.Flags().GetString("image")
-		return pushImage(cmd.Context(), "gcs", args[0], localImage)
+		return pushImage(cmd.Context(), "gcs", args, pushOptionsFromFlags(cmd))
 	},
 }
 
@@ -33,7 +32,7 @@ var gcsPullCmd = &cobra.Command{
 		return validateGCSConfig()
 	},
 	RunE: func(cmd *cobra.Command, args []string) error {
-		return pullImage(cmd.Context(), "gcs", args[0])
+		return pullImage(cmd.Context(), "gcs", args[0], pullOptionsFromFlags(cmd))
 	},
 }
 
@@ -48,9 +47,11 @@ func validateGCSConfig() error {
 
 func init() {
 	gcsCmd.AddCommand(gcsPushCmd, gcsPullCmd)
+	gcsCmd.AddCommand(newStorageCommands("gcs", validateGCSConfig)...)
 
 	gcsCmd.PersistentFlags().StringVar(&gcsKeyfile, "keyfile", "", "GCS keyfile")
 	gcsCmd.PersistentFlags().StringVar(&gcsRootDirectory, "root-dir", "", "Root directory in GCS bucket (optional)")
 
-	gcsPushCmd.Flags().StringP("image", "i", "", "Local Docker image to push (defaults to image-path:tag)")
+	addPushFlags(gcsPushCmd)
+	addPullFlags(gcsPullCmd)
 }
@@ -95,8 +95,8 @@ func TestGCSCommandSetup(t *testing.T) {
 		t.Errorf("gcsCmd.Short = %q, want %q", gcsCmd.Short, "Google Cloud Storage operations")
 	}
 
-	if gcsPushCmd.Use != "push <bucket>/<image-path>:<tag>" {
-		t.Errorf("gcsPushCmd.Use = %q, want %q", gcsPushCmd.Use, "push <bucket>/<image-path>:<tag>")
+	if gcsPushCmd.Use != "push <bucket>/<image-path>:<tag> [<bucket>/<image-path>:<tag>...]" {
+		t.Errorf("gcsPushCmd.Use = %q, want %q", gcsPushCmd.Use, "push <bucket>/<image-path>:<tag> [<bucket>/<image-path>:<tag>...]")
 	}
 
 	if gcsPullCmd.Use != "pull <bucket>/<image-path>:<tag>" {
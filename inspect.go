@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/spf13/cobra"
+)
+
+// ImageSummary is the human-readable view of a stored image printed by inspect.
+type ImageSummary struct {
+	Reference  string            `json:"reference"`
+	Digest     string            `json:"digest"`
+	MediaType  string            `json:"mediaType"`
+	Platform   string            `json:"platform,omitempty"`
+	Created    time.Time         `json:"created,omitempty"`
+	Entrypoint []string          `json:"entrypoint,omitempty"`
+	Cmd        []string          `json:"cmd,omitempty"`
+	Labels     map[string]string `json:"labels,omitempty"`
+	Layers     []LayerSummary    `json:"layers"`
+	TotalSize  int64             `json:"totalSize"`
+}
+
+// IndexSummary is the view of a stored image index printed by inspect.
+type IndexSummary struct {
+	Reference string          `json:"reference"`
+	Digest    string          `json:"digest"`
+	MediaType string          `json:"mediaType"`
+	Manifests []v1.Descriptor `json:"manifests"`
+}
+
+// LayerSummary describes one layer of an ImageSummary.
+type LayerSummary struct {
+	Digest    string `json:"digest"`
+	MediaType string `json:"mediaType"`
+	Size      int64  `json:"size"`
+}
+
+func newInspectCmd(storageType string, validate func() error) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "inspect " + refUsage(storageType),
+		Short: "Show the manifest and config of a stored image without pulling it",
+		Args:  cobra.ExactArgs(1),
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			return validate()
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			raw, _ := cmd.Flags().GetBool("raw")
+			config, _ := cmd.Flags().GetBool("config")
+			return inspectImage(cmd.Context(), storageType, args[0], raw, config)
+		},
+	}
+	cmd.Flags().Bool("raw", false, "Print the raw manifest")
+	cmd.Flags().Bool("config", false, "Print the raw image config")
+	return cmd
+}
+
+func inspectImage(ctx context.Context, storageType string, storageRef string, raw bool, config bool) error {
+	_, target, err := openStorageRef(ctx, storageType, storageRef)
+	if err != nil {
+		return err
+	}
+	desc, err := remote.Get(target, remote.WithContext(ctx), withRegistryTransport())
+	if err != nil {
+		return fmt.Errorf("failed to fetch %s: %w", storageRef, err)
+	}
+
+	if raw {
+		return writeIndentedJSON(os.Stdout, desc.Manifest)
+	}
+	if desc.MediaType.IsIndex() {
+		if config {
+			return fmt.Errorf("%s is an image index and has no config, inspect one of its platforms instead", storageRef)
+		}
+		index, err := desc.ImageIndex()
+		if err != nil {
+			return err
+		}
+		indexManifest, err := index.IndexManifest()
+		if err != nil {
+			return err
+		}
+		summary := IndexSummary{Reference: storageRef, Digest: desc.Digest.String(), MediaType: string(indexManifest.MediaType), Manifests: indexManifest.Manifests}
+		return printResult(summary, func(w io.Writer) error {
+			return writeIndexSummary(w, storageRef, desc.Digest, indexManifest)
+		})
+	}
+
+	img, err := desc.Image()
+	if err != nil {
+		return err
+	}
+	if config {
+		rawConfig, err := img.RawConfigFile()
+		if err != nil {
+			return err
+		}
+		return writeIndentedJSON(os.Stdout, rawConfig)
+	}
+	summary, err := summarizeImage(storageRef, img)
+	if err != nil {
+		return err
+	}
+	return printResult(summary, func(w io.Writer) error { return writeImageSummary(w, summary) })
+}
+
+func summarizeImage(ref string, img v1.Image) (*ImageSummary, error) {
+	manifest, err := img.Manifest()
+	if err != nil {
+		return nil, err
+	}
+	digest, err := img.Digest()
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := img.ConfigFile()
+	if err != nil {
+		return nil, err
+	}
+
+	summary := &ImageSummary{
+		Reference:  ref,
+		Digest:     digest.String(),
+		MediaType:  string(manifest.MediaType),
+		Created:    cfg.Created.Time,
+		Entrypoint: cfg.Config.Entrypoint,
+		Cmd:        cfg.Config.Cmd,
+		Labels:     cfg.Config.Labels,
+		Layers:     make([]LayerSummary, 0, len(manifest.Layers)),
+		TotalSize:  manifest.Config.Size,
+	}
+	if cfg.OS != "" {
+		summary.Platform = cfg.Platform().String()
+	}
+	for _, layer := range manifest.Layers {
+		summary.Layers = append(summary.Layers, LayerSummary{
+			Digest:    layer.Digest.String(),
+			MediaType: string(layer.MediaType),
+			Size:      layer.Size,
+		})
+		summary.TotalSize += layer.Size
+	}
+	return summary, nil
+}
+
+func writeImageSummary(out io.Writer, s *ImageSummary) error {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintf(w, "Reference:\t%s\n", s.Reference)
+	_, _ = fmt.Fprintf(w, "Digest:\t%s\n", s.Digest)
+	_, _ = fmt.Fprintf(w, "Media type:\t%s\n", s.MediaType)
+	if s.Platform != "" {
+		_, _ = fmt.Fprintf(w, "Platform:\t%s\n", s.Platform)
+	}
+	if !s.Created.IsZero() {
+		_, _ = fmt.Fprintf(w, "Created:\t%s\n", s.Created.UTC().Format(time.RFC3339))
+	}
+	if len(s.Entrypoint) > 0 {
+		_, _ = fmt.Fprintf(w, "Entrypoint:\t%s\n", strings.Join(s.Entrypoint, " "))
+	}
+	if len(s.Cmd) > 0 {
+		_, _ = fmt.Fprintf(w, "Cmd:\t%s\n", strings.Join(s.Cmd, " "))
+	}
+	_, _ = fmt.Fprintf(w, "Total size:\t%s (%d bytes)\n", humanSize(s.TotalSize), s.TotalSize)
+
+	if len(s.Labels) > 0 {
+		_, _ = fmt.Fprintln(w, "Labels:")
+		keys := make([]string, 0, len(s.Labels))
+		for k := range s.Labels {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			_, _ = fmt.Fprintf(w, "  %s\t%s\n", k, s.Labels[k])
+		}
+	}
+
+	_, _ = fmt.Fprintf(w, "Layers (%d):\n", len(s.Layers))
+	for _, layer := range s.Layers {
+		_, _ = fmt.Fprintf(w, "  %s\t%s\t%s\n", layer.Digest, humanSize(layer.Size), layer.MediaType)
+	}
+	return w.Flush()
+}
+
+func writeIndexSummary(out io.Writer, ref string, digest v1.Hash, index *v1.IndexManifest) error {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintf(w, "Reference:\t%s\n", ref)
+	_, _ = fmt.Fprintf(w, "Digest:\t%s\n", digest)
+	_, _ = fmt.Fprintf(w, "Media type:\t%s\n", index.MediaType)
+	_, _ = fmt.Fprintf(w, "Manifests (%d):\n", len(index.Manifests))
+	for _, m := range index.Manifests {
+		platform := "-"
+		if m.Platform != nil {
+			platform = m.Platform.String()
+		}
+		_, _ = fmt.Fprintf(w, "  %s\t%s\t%s\n", m.Digest, platform, humanSize(m.Size))
+	}
+	return w.Flush()
+}
+
+// writeIndentedJSON pretty-prints raw JSON while keeping its key order.
+func writeIndentedJSON(out io.Writer, raw []byte) error {
+	var buf bytes.Buffer
+	if err := json.Indent(&buf, raw, "", "  "); err != nil {
+		return err
+	}
+	buf.WriteByte('\n')
+	_, err := buf.WriteTo(out)
+	return err
+}
+
+// humanSize formats a byte count using binary units, e.g. 1.5 MiB.
+func humanSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
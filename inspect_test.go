@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+)
+
+func TestHumanSize(t *testing.T) {
+	tests := []struct {
+		n    int64
+		want string
+	}{
+		{n: 0, want: "0 B"},
+		{n: 1023, want: "1023 B"},
+		{n: 1024, want: "1.0 KiB"},
+		{n: 1536 * 1024, want: "1.5 MiB"},
+		{n: 3 << 30, want: "3.0 GiB"},
+	}
+	for _, tt := range tests {
+		if got := humanSize(tt.n); got != tt.want {
+			t.Errorf("humanSize(%d) = %q, want %q", tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestSummarizeImage(t *testing.T) {
+	img, err := random.Image(2048, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, _ := img.ConfigFile()
+	cfg = cfg.DeepCopy()
+	cfg.OS = "linux"
+	cfg.Architecture = "arm64"
+	cfg.Created = v1.Time{Time: time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)}
+	cfg.Config.Entrypoint = []string{"/app", "serve"}
+	cfg.Config.Labels = map[string]string{"org.opencontainers.image.version": "1.2.3"}
+	img, err = mutate.ConfigFile(img, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	summary, err := summarizeImage("bucket/app:v1", img)
+	if err != nil {
+		t.Fatalf("summarizeImage() error = %v", err)
+	}
+	if summary.Platform != "linux/arm64" {
+		t.Errorf("Platform = %q, want linux/arm64", summary.Platform)
+	}
+	if len(summary.Layers) != 3 {
+		t.Errorf("len(Layers) = %d, want 3", len(summary.Layers))
+	}
+	manifest, _ := img.Manifest()
+	want := manifest.Config.Size
+	for _, l := range manifest.Layers {
+		want += l.Size
+	}
+	if summary.TotalSize != want {
+		t.Errorf("TotalSize = %d, want %d", summary.TotalSize, want)
+	}
+
+	var out bytes.Buffer
+	if err := writeImageSummary(&out, summary); err != nil {
+		t.Fatalf("writeImageSummary() error = %v", err)
+	}
+	for _, s := range []string{"bucket/app:v1", "linux/arm64", "2024-05-01T12:00:00Z", "/app serve", "org.opencontainers.image.version", "Layers (3):"} {
+		if !strings.Contains(out.String(), s) {
+			t.Errorf("summary output does not contain %q:\n%s", s, out.String())
+		}
+	}
+}
@@ -3,6 +3,8 @@ package main
 import (
 	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
 	"os"
 	"os/exec"
 	"strings"
@@ -51,6 +53,22 @@ func runCommand(t *testing.T, args ...string) (string, error) {
 	return stdout.String(), err
 }
 
+// runCommandOutputs runs the binary and returns stdout, stderr and the exit
+// code.
+func runCommandOutputs(t *testing.T, args ...string) (string, string, int) {
+	cmd := exec.Command("./test-oci-store", args...)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	err := cmd.Run()
+	var exitErr *exec.ExitError
+	if err != nil && !errors.As(err, &exitErr) {
+		t.Fatalf("Failed to run command: %v", err)
+	}
+	return stdout.String(), stderr.String(), cmd.ProcessState.ExitCode()
+}
+
 func testHelpCommands(t *testing.T) {
 	tests := []struct {
 		name     string
@@ -107,57 +125,96 @@ func testValidationCommands(t *testing.T) {
 		name      string
 		args      []string
 		wantError bool
+		wantCode  int
 		contains  string
 	}{
 		{
 			name:      "s3 push without region",
 			args:      []string{"s3", "push", "test-bucket/app:v1.0"},
 			wantError: true,
+			wantCode:  exitValidation,
 			contains:  "requires region",
 		},
 		{
 			name:      "gcs push without project",
 			args:      []string{"gcs", "push", "test-bucket/app:v1.0"},
 			wantError: true,
+			wantCode:  exitValidation,
 			contains:  "requires project ID to be specified",
 		},
 		{
 			name:      "azure push without account",
 			args:      []string{"azure", "push", "test-container/app:v1.0"},
 			wantError: true,
+			wantCode:  exitValidation,
 			contains:  "account name needs to be specified",
 		},
 		{
 			name:      "s3 pull without region",
 			args:      []string{"s3", "pull", "test-bucket/app:v1.0"},
 			wantError: true,
+			wantCode:  exitValidation,
 			contains:  "requires region",
 		},
 		{
 			name:      "invalid command",
 			args:      []string{"invalid", "command"},
 			wantError: true,
+			wantCode:  exitFailure,
 			contains:  "unknown command",
 		},
+		{
+			name:      "unsupported output format",
+			args:      []string{"--output", "yaml", "s3", "pull", "test-bucket/app:v1.0"},
+			wantError: true,
+			wantCode:  exitValidation,
+			contains:  "unsupported output format",
+		},
+		{
+			name:      "missing image on filesystem",
+			args:      []string{"filesystem", "inspect", "--root-dir", t.TempDir(), "bucket/app:v1"},
+			wantError: true,
+			wantCode:  exitNotFound,
+			contains:  "failed to fetch",
+		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			output, err := runCommand(t, tt.args...)
+			stdout, stderr, code := runCommandOutputs(t, tt.args...)
 
-			if tt.wantError && err == nil {
+			if tt.wantError && code == 0 {
 				t.Errorf("Expected command to fail, but it succeeded")
 			}
 
-			if !tt.wantError && err != nil {
-				t.Errorf("Expected command to succeed, but it failed: %v, output: %s", err, output)
+			if !tt.wantError && code != 0 {
+				t.Errorf("Expected command to succeed, but it failed with %d, output: %s", code, stderr)
 			}
 
-			if tt.contains != "" && !strings.Contains(output, tt.contains) {
-				t.Errorf("Output does not contain %q: %s", tt.contains, output)
+			if tt.wantError && code != tt.wantCode {
+				t.Errorf("Exit code = %d, want %d, output: %s", code, tt.wantCode, stderr)
+			}
+
+			// Logs and errors go to stderr, stdout only holds results.
+			if tt.contains != "" && !strings.Contains(stderr, tt.contains) {
+				t.Errorf("Stderr does not contain %q: %s", tt.contains, stderr)
+			}
+			if strings.Contains(stdout, tt.contains) {
+				t.Errorf("Stdout should not contain logs: %s", stdout)
 			}
 		})
 	}
+
+	t.Run("json error result", func(t *testing.T) {
+		stdout, _, code := runCommandOutputs(t, "--output", "json", "s3", "pull", "test-bucket/app:v1.0")
+		var result ErrorResult
+		if err := json.Unmarshal([]byte(stdout), &result); err != nil {
+			t.Fatalf("stdout is not a JSON error result: %v: %s", err, stdout)
+		}
+		if result.ExitCode != code || result.Kind != "validation" || !strings.Contains(result.Error, "requires region") {
+			t.Errorf("error result = %+v, exit code %d", result, code)
+		}
+	})
 }
 
 func testCommandStructure(t *testing.T) {
@@ -196,12 +253,10 @@ func TestEnvironmentVariableHandling(t *testing.T) {
 	}()
 
 	// This should not fail due to region being set via env var
-	output, err := runCommand(t, "s3", "push", "test-bucket/app:v1.0")
-	if err == nil {
-		// Command might still fail for other reasons (Docker not running), but should not fail due to region
-		if strings.Contains(output, "requires region") {
-			t.Error("Environment variable AWS_REGION was not respected")
-		}
+	_, stderr, _ := runCommandOutputs(t, "s3", "push", "test-bucket/app:v1.0")
+	// Command might still fail for other reasons (Docker not running), but should not fail due to region
+	if strings.Contains(stderr, "requires region") {
+		t.Error("Environment variable AWS_REGION was not respected")
 	}
 }
 
@@ -215,16 +270,16 @@ func TestVerboseFlag(t *testing.T) {
 	defer cleanupBinary(t)
 
 	// Test with verbose flag
-	output, err := runCommand(t, "--verbose", "s3", "push", "test-bucket/app:v1.0")
+	_, stderr, code := runCommandOutputs(t, "--verbose", "s3", "push", "test-bucket/app:v1.0")
 
 	// The command should fail (no region), but we're testing the verbose flag
-	if err == nil {
+	if code == 0 {
 		t.Error("Expected command to fail without region")
 	}
 
-	// With verbose flag, we should see more detailed output
+	// With verbose flag, we should see more detailed output on stderr
 	// This is a basic test - in a real scenario, you'd check for specific debug output
-	if len(output) == 0 {
+	if len(stderr) == 0 {
 		t.Error("Verbose flag should produce output")
 	}
 }
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	logFormat = "text"
+	logLevel  = "info"
+	logFile   string
+)
+
+// redacted replaces secrets in log output.
+const redacted = "[REDACTED]"
+
+// sensitiveKeys are the keys whose values are never logged, normalized by
+// normalizeKey. They cover the storage configuration of every backend.
+var sensitiveKeys = map[string]bool{
+	"accesskey":    true,
+	"secretkey":    true,
+	"accountkey":   true,
+	"secret":       true,
+	"password":     true,
+	"token":        true,
+	"sessiontoken": true,
+}
+
+// sensitivePattern finds key=value and key: value pairs of sensitive keys in
+// free text, e.g. a configuration map formatted into an error message.
+var sensitivePattern = regexp.MustCompile(`(?i)\b(access[-_]?key|secret[-_]?key|account[-_]?key|secret|password|session[-_]?token|token)("?\s*[=:]\s*"?)([^\s",}\]]+)`)
+
+func normalizeKey(key string) string {
+	return strings.NewReplacer("-", "", "_", "").Replace(strings.ToLower(key))
+}
+
+// secretValues returns the credentials set by flags or environment, which
+// are removed from log output wherever they appear.
+func secretValues() []string {
+	var values []string
+	for _, v := range append([]string{s3AccessKey, s3SecretKey, azureAccountKey, azureSecret, proxyPassword, getEnv("AWS_SESSION_TOKEN")}, notifyHeaderSecrets()...) {
+		if len(v) >= 4 {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+// redactString removes credentials from free text.
+func redactString(s string) string {
+	for _, v := range secretValues() {
+		s = strings.ReplaceAll(s, v, redacted)
+	}
+	return sensitivePattern.ReplaceAllString(s, "${1}${2}"+redacted)
+}
+
+// redactValue returns v with the values of sensitive keys replaced, looking
+// into maps such as the storage driver parameters.
+func redactValue(key string, v any) any {
+	if sensitiveKeys[normalizeKey(key)] {
+		return redacted
+	}
+	switch v := v.(type) {
+	case nil:
+		return nil
+	case string:
+		return redactString(v)
+	case error:
+		return redactString(v.Error())
+	case fmt.Stringer:
+		return redactString(v.String())
+	}
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Map {
+		return v
+	}
+	out := make(map[string]any, rv.Len())
+	iter := rv.MapRange()
+	for iter.Next() {
+		k := fmt.Sprint(iter.Key().Interface())
+		out[k] = redactValue(k, iter.Value().Interface())
+	}
+	return out
+}
+
+func redactAttr(a slog.Attr) slog.Attr {
+	a.Value = a.Value.Resolve()
+	switch a.Value.Kind() {
+	case slog.KindGroup:
+		attrs := a.Value.Group()
+		redactedAttrs := make([]slog.Attr, len(attrs))
+		for i, attr := range attrs {
+			redactedAttrs[i] = redactAttr(attr)
+		}
+		return slog.Attr{Key: a.Key, Value: slog.GroupValue(redactedAttrs...)}
+	case slog.KindString:
+		if sensitiveKeys[normalizeKey(a.Key)] {
+			return slog.String(a.Key, redacted)
+		}
+		return slog.String(a.Key, redactString(a.Value.String()))
+	case slog.KindAny:
+		return slog.Any(a.Key, redactValue(a.Key, a.Value.Any()))
+	}
+	if sensitiveKeys[normalizeKey(a.Key)] {
+		return slog.String(a.Key, redacted)
+	}
+	return a
+}
+
+// redactingHandler removes credentials from every record before passing it
+// on, so no log line depends on its caller to leave secrets out.
+type redactingHandler struct {
+	next slog.Handler
+}
+
+func (h redactingHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.next.Enabled(ctx, level)
+}
+
+func (h redactingHandler) Handle(ctx context.Context, r slog.Record) error {
+	out := slog.NewRecord(r.Time, r.Level, redactString(r.Message), r.PC)
+	r.Attrs(func(a slog.Attr) bool {
+		out.AddAttrs(redactAttr(a))
+		return true
+	})
+	return h.next.Handle(ctx, out)
+}
+
+func (h redactingHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	redactedAttrs := make([]slog.Attr, len(attrs))
+	for i, a := range attrs {
+		redactedAttrs[i] = redactAttr(a)
+	}
+	return redactingHandler{next: h.next.WithAttrs(redactedAttrs)}
+}
+
+func (h redactingHandler) WithGroup(name string) slog.Handler {
+	return redactingHandler{next: h.next.WithGroup(name)}
+}
+
+// redactingWriter removes credentials from output that does not go through
+// slog, such as the embedded registry's logs and cobra's error messages.
+type redactingWriter struct {
+	w io.Writer
+}
+
+func (w redactingWriter) Write(p []byte) (int, error) {
+	if _, err := io.WriteString(w.w, redactString(string(p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func newLogHandler(out io.Writer) slog.Handler {
+	var h slog.Handler
+	if logFormat == "json" {
+		h = slog.NewJSONHandler(out, logopts)
+	} else {
+		h = slog.NewTextHandler(out, logopts)
+	}
+	return redactingHandler{next: h}
+}
+
+// setupLogging applies the logging flags to slog and to logrus, which the
+// embedded registry logs through.
+func setupLogging() error {
+	if logFormat != "text" && logFormat != "json" {
+		return invalidf("unsupported log format %q, expected text or json", logFormat)
+	}
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(logLevel)); err != nil {
+		return invalidf("unsupported log level %q, expected debug, info, warn or error", logLevel)
+	}
+	// --verbose is short for --log-level debug, which also turns on the
+	// registry and driver logs.
+	if verbose {
+		level = slog.LevelDebug
+	}
+	verbose = level == slog.LevelDebug
+	logopts.Level = level
+
+	var out io.Writer = os.Stderr
+	if logFile != "" {
+		f, err := os.OpenFile(filepath.Clean(logFile), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+		if err != nil {
+			return invalidf("failed to open log file: %w", err)
+		}
+		out = f
+	}
+	slog.SetDefault(slog.New(newLogHandler(out)))
+	logrus.SetOutput(redactingWriter{w: out})
+	return nil
+}
+
+// registryLogFormatter returns the logrus formatter of the embedded registry
+// matching --log-format.
+func registryLogFormatter() string {
+	if logFormat == "json" {
+		return "json"
+	}
+	return "text"
+}
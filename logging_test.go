@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestRedactingHandler(t *testing.T) {
+	oldKey, oldSecret := s3AccessKey, s3SecretKey
+	s3AccessKey, s3SecretKey = "AKIAEXAMPLEKEY", "wJalrXUtnFEMIexamplesecret"
+	t.Cleanup(func() { s3AccessKey, s3SecretKey = oldKey, oldSecret })
+
+	for _, format := range []string{"text", "json"} {
+		t.Run(format, func(t *testing.T) {
+			old := logFormat
+			logFormat = format
+			t.Cleanup(func() { logFormat = old })
+
+			var buf bytes.Buffer
+			logger := slog.New(newLogHandler(&buf)).With("secret", "client-secret-value")
+			azure := &AzureBackend{AccountName: "acct", AccountKey: "azure-account-key", CredentialType: "client_secret", Secret: "azure-client-secret"}
+			logger.Info("Using key "+s3SecretKey,
+				"s3", newS3Backend().GetStorageConfig("my-bucket"),
+				"azure", azure.GetStorageConfig("my-container"),
+				"error", errors.New("request failed with secretkey=inline-secret"),
+				slog.Group("auth", slog.String("password", "hunter22")),
+			)
+
+			out := buf.String()
+			for _, secret := range []string{"AKIAEXAMPLEKEY", "wJalrXUtnFEMIexamplesecret", "azure-account-key", "azure-client-secret", "client-secret-value", "inline-secret", "hunter22"} {
+				if strings.Contains(out, secret) {
+					t.Errorf("log output contains %q: %s", secret, out)
+				}
+			}
+			for _, kept := range []string{"my-bucket", "my-container", "acct", redacted} {
+				if !strings.Contains(out, kept) {
+					t.Errorf("log output lacks %q: %s", kept, out)
+				}
+			}
+		})
+	}
+}
+
+func TestRedactingWriter(t *testing.T) {
+	old := azureAccountKey
+	azureAccountKey = "azure-account-key"
+	t.Cleanup(func() { azureAccountKey = old })
+
+	var buf bytes.Buffer
+	line := `level=info msg="storage config" accountkey:other-key account=azure-account-key` + "\n"
+	n, err := redactingWriter{w: &buf}.Write([]byte(line))
+	if err != nil || n != len(line) {
+		t.Fatalf("Write() = %d, %v", n, err)
+	}
+	if strings.Contains(buf.String(), "other-key") || strings.Contains(buf.String(), "azure-account-key") {
+		t.Errorf("redactingWriter output = %q", buf.String())
+	}
+}
+
+func TestSetupLogging(t *testing.T) {
+	oldFormat, oldLevel, oldFile, oldVerbose := logFormat, logLevel, logFile, verbose
+	oldLogger := slog.Default()
+	t.Cleanup(func() {
+		logFormat, logLevel, logFile, verbose = oldFormat, oldLevel, oldFile, oldVerbose
+		logopts.Level = nil
+		slog.SetDefault(oldLogger)
+	})
+
+	logFormat, logLevel = "xml", "info"
+	if err := setupLogging(); exitCode(err) != exitValidation {
+		t.Errorf("setupLogging() with an invalid format error = %v", err)
+	}
+	logFormat, logLevel = "json", "loud"
+	if err := setupLogging(); exitCode(err) != exitValidation {
+		t.Errorf("setupLogging() with an invalid level error = %v", err)
+	}
+
+	logLevel, logFile, verbose = "debug", t.TempDir()+"/oci-store.log", false
+	if err := setupLogging(); err != nil {
+		t.Fatalf("setupLogging() error = %v", err)
+	}
+	if !verbose {
+		t.Error("--log-level debug should enable verbose registry logs")
+	}
+	if !slog.Default().Enabled(t.Context(), slog.LevelDebug) {
+		t.Error("debug records should be enabled")
+	}
+}
@@ -2,8 +2,11 @@ package main
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"log/slog"
 	"os"
+	"time"
 
 	"github.com/spf13/cobra"
 )
@@ -11,6 +14,8 @@ import (
 var (
 	verbose bool
 	logopts = &slog.HandlerOptions{}
+	// shutdownTelemetry flushes traces and metrics before the CLI exits.
+	shutdownTelemetry = func(context.Context) error { return nil }
 )
 
 var rootCmd = &cobra.Command{
@@ -34,21 +39,99 @@ var azureCmd = &cobra.Command{
 	Short: "Azure Blob Storage operations",
 }
 
+var fsCmd = &cobra.Command{
+	Use:   "filesystem",
+	Short: "Local filesystem operations",
+}
+
 func init() {
 	rootCmd.PersistentFlags().BoolVarP(&verbose, "verbose", "v", false, "Verbose")
-	rootCmd.AddCommand(s3Cmd, gcsCmd, azureCmd)
+	rootCmd.PersistentFlags().StringVar(&logFormat, "log-format", "text", "Log format: text or json")
+	rootCmd.PersistentFlags().StringVar(&logLevel, "log-level", "info", "Log level: debug, info, warn or error")
+	rootCmd.PersistentFlags().StringVar(&logFile, "log-file", "", "Append logs to this file instead of stderr")
+	rootCmd.PersistentFlags().StringVar(&outputFormat, "output", outputText, "Result format on stdout: text or json")
+	rootCmd.PersistentFlags().BoolVar(&uploadPurging, "upload-purging", true, "Let the embedded registry purge abandoned uploads in the background")
+	rootCmd.PersistentFlags().DurationVar(&uploadPurgeAge, "upload-purge-age", 168*time.Hour, "Age after which the embedded registry purges abandoned uploads")
+	rootCmd.PersistentFlags().DurationVar(&uploadPurgeInterval, "upload-purge-interval", 24*time.Hour, "Interval between background upload purges")
+	rootCmd.PersistentFlags().BoolVar(&uploadPurgeDryRun, "upload-purge-dry-run", false, "Only log the uploads the background purge would delete")
+	rootCmd.PersistentFlags().StringVar(&cacheDir, "cache-dir", cacheDir, "Directory of the local blob cache used by pull")
+	rootCmd.PersistentFlags().Var(&cacheMaxSize, "cache-max-size", "Size above which the least recently used cached layers are evicted, 0 disables the cache")
+	rootCmd.PersistentFlags().StringArrayVar(&notifyURLs, "notify-url", nil, "Send registry events to this webhook, repeatable")
+	rootCmd.PersistentFlags().StringArrayVar(&notifyHeaders, "notify-header", nil, "Header sent with every webhook request, \"Name: value\", repeatable")
+	rootCmd.PersistentFlags().DurationVar(&notifyTimeout, "notify-timeout", notifyTimeout, "Timeout of each webhook request, and of the wait for undelivered events on exit")
+	rootCmd.PersistentFlags().StringVar(&auditLogPath, "audit-log", "", "Append push, pull and delete events to this JSONL file")
+	rootCmd.PersistentFlags().StringVar(&auditActor, "audit-actor", "", "Actor recorded in the audit log for this host (default user@hostname)")
+	rootCmd.AddCommand(s3Cmd, gcsCmd, azureCmd, fsCmd, newCacheCmd(), newSyncCmd())
 
-	rootCmd.PersistentPreRun = func(cmd *cobra.Command, args []string) {
-		if verbose {
-			logopts.Level = slog.LevelDebug
+	rootCmd.PersistentPreRunE = func(cmd *cobra.Command, args []string) error {
+		if err := setupLogging(); err != nil {
+			return err
+		}
+		if err := validateOutputFormat(); err != nil {
+			return err
 		}
+		if err := setupNotifications(); err != nil {
+			return err
+		}
+		shutdown, err := setupTelemetry(cmd.Context())
+		if err != nil {
+			return fmt.Errorf("failed to set up telemetry: %w", err)
+		}
+		shutdownTelemetry = shutdown
+		startCommandSpan(cmd)
+		return nil
+	}
+	rootCmd.SetErr(redactingWriter{w: os.Stderr})
+}
+
+// newStorageCommands returns the subcommands shared by every storage backend.
+func newStorageCommands(storageType string, validate func() error) []*cobra.Command {
+	return []*cobra.Command{
+		newSignCmd(storageType, validate),
+		newArtifactCmd(storageType, validate),
+		newAttachCmd(storageType, validate),
+		newReferrersCmd(storageType, validate),
+		newInspectCmd(storageType, validate),
+		newTagCmd(storageType, validate),
+		newExportCmd(storageType, validate),
+		newImportCmd(storageType, validate),
+		newVerifyCmd(storageType, validate),
+		newUploadsCmd(storageType, validate),
+		newDuCmd(storageType, validate),
+		newDiffCmd(storageType, validate),
+		newStatusCmd(storageType, validate),
+		newPolicyCmd(storageType, validate),
+		newServeCmd(storageType, validate),
+		newPushAllCmd(storageType, validate),
+		newPullAllCmd(storageType, validate),
 	}
 }
 
 func main() {
-	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stdout, logopts)))
-	if err := rootCmd.ExecuteContext(context.Background()); err != nil {
-		slog.Error("Command failed", "error", err)
-		os.Exit(1)
+	slog.SetDefault(slog.New(newLogHandler(os.Stderr)))
+	markValidationErrors(rootCmd)
+	cmdCtx, stop := withInterrupt(context.Background())
+	err := interruptedError(cmdCtx, rootCmd.ExecuteContext(cmdCtx))
+	stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	flushNotifications(ctx)
+	stopRegistries(ctx)
+	closeAuditLog(ctx)
+	cancel()
+	endSpan(commandSpan, err)
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	if serr := shutdownTelemetry(ctx); serr != nil {
+		slog.Warn("Failed to flush telemetry", "error", serr)
+	}
+	cancel()
+	if err != nil {
+		code := exitCode(err)
+		slog.Error("Command failed", "error", err, "exit_code", code)
+		var reported reportedError
+		if jsonOutput() && !errors.As(err, &reported) {
+			printErrorResult(err, code)
+		}
+		os.Exit(code)
 	}
 }
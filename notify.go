@@ -0,0 +1,345 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/user"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/distribution/distribution/v3/configuration"
+	"github.com/distribution/distribution/v3/notifications"
+)
+
+// The notification flags apply to every registry the command starts, the
+// embedded ones as well as serve.
+var (
+	notifyURLs    []string
+	notifyHeaders []string
+	notifyTimeout = 5 * time.Second
+	auditLogPath  string
+	auditActor    string
+)
+
+// webhookEndpoints are the --notify-url endpoints, set up by
+// setupNotifications.
+var webhookEndpoints []configuration.Endpoint
+
+// sensitiveHeaderPattern matches the --notify-header names whose values are
+// redacted from the logs; distribution logs the headers of every endpoint.
+var sensitiveHeaderPattern = regexp.MustCompile(`(?i)auth|token|secret|key|password`)
+
+// setupNotifications validates the notification flags.
+func setupNotifications() error {
+	headers := http.Header{}
+	for _, h := range notifyHeaders {
+		k, v, ok := strings.Cut(h, ":")
+		k, v = strings.TrimSpace(k), strings.TrimSpace(v)
+		if !ok || k == "" {
+			return invalidf("invalid --notify-header %q, expected Name: value", h)
+		}
+		headers.Add(k, v)
+	}
+	if len(headers) > 0 && len(notifyURLs) == 0 {
+		return invalidf("--notify-header requires --notify-url")
+	}
+	if notifyTimeout <= 0 {
+		return invalidf("--notify-timeout must be positive")
+	}
+
+	webhookEndpoints = nil
+	for i, u := range notifyURLs {
+		parsed, err := url.Parse(u)
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			return invalidf("invalid --notify-url %q, expected an http or https URL", u)
+		}
+		webhookEndpoints = append(webhookEndpoints, configuration.Endpoint{
+			Name:      fmt.Sprintf("webhook-%d", i+1),
+			URL:       u,
+			Headers:   headers,
+			Timeout:   notifyTimeout,
+			Threshold: 3,
+			Backoff:   time.Second,
+		})
+	}
+	return nil
+}
+
+// notifyHeaderSecrets returns the values of the sensitive --notify-header
+// flags.
+func notifyHeaderSecrets() []string {
+	var values []string
+	for _, h := range notifyHeaders {
+		if k, v, ok := strings.Cut(h, ":"); ok && sensitiveHeaderPattern.MatchString(k) {
+			values = append(values, strings.TrimSpace(v))
+		}
+	}
+	return values
+}
+
+// registryNotifications returns the notification endpoints of a registry,
+// starting the receiver of the audit log on first use.
+func registryNotifications() (configuration.Notifications, error) {
+	endpoints := append([]configuration.Endpoint(nil), webhookEndpoints...)
+	if auditLogPath != "" {
+		r, err := openAuditLog()
+		if err != nil {
+			return configuration.Notifications{}, err
+		}
+		endpoints = append(endpoints, r.endpoint())
+	}
+	return configuration.Notifications{Endpoints: endpoints}, nil
+}
+
+// notificationMetrics returns the delivery metrics of every notification
+// endpoint of the process. Distribution only exposes them through expvar.
+func notificationMetrics() []notifications.EndpointMetrics {
+	registry, ok := expvar.Get("registry").(*expvar.Map)
+	if !ok {
+		return nil
+	}
+	n, ok := registry.Get("notifications").(*expvar.Map)
+	if !ok {
+		return nil
+	}
+	var endpoints []struct {
+		Metrics notifications.EndpointMetrics
+	}
+	if v := n.Get("endpoints"); v == nil || json.Unmarshal([]byte(v.String()), &endpoints) != nil {
+		return nil
+	}
+	metrics := make([]notifications.EndpointMetrics, len(endpoints))
+	for i, e := range endpoints {
+		metrics[i] = e.Metrics
+	}
+	return metrics
+}
+
+// flushNotifications waits until the registries delivered their events.
+// Distribution sends them in the background and drops the queue on
+// shutdown, which would lose the events of a short command. It waits at most
+// --notify-timeout, and not at all for an endpoint that keeps failing, such
+// as an unreachable webhook, whose events distribution would retry forever.
+func flushNotifications(ctx context.Context) {
+	if len(webhookEndpoints) == 0 && auditLogPath == "" {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, notifyTimeout)
+	defer cancel()
+	start := notificationMetrics()
+	for {
+		pending, dropped := 0, 0
+		for i, m := range notificationMetrics() {
+			// Endpoints only ever get added, so start[i] is the same one.
+			if i < len(start) && m.Successes == start[i].Successes &&
+				m.Failures+m.Errors > start[i].Failures+start[i].Errors {
+				dropped += m.Pending
+				continue
+			}
+			pending += m.Pending
+		}
+		if pending == 0 {
+			if dropped > 0 {
+				slog.Warn("Giving up on notifications of failing endpoints", "events", dropped)
+			}
+			return
+		}
+		select {
+		case <-ctx.Done():
+			slog.Warn("Giving up on undelivered notifications", "events", pending)
+			return
+		case <-time.After(20 * time.Millisecond):
+		}
+	}
+}
+
+// AuditEvent is one line of the --audit-log file.
+type AuditEvent struct {
+	Timestamp  time.Time `json:"timestamp"`
+	Action     string    `json:"action"`
+	Repository string    `json:"repository"`
+	Tag        string    `json:"tag,omitempty"`
+	Digest     string    `json:"digest"`
+	Size       int64     `json:"size"`
+	MediaType  string    `json:"mediaType"`
+	Actor      string    `json:"actor"`
+	ID         string    `json:"id"`
+}
+
+// auditReceiver is a local notification endpoint appending the events it
+// receives to the audit log.
+type auditReceiver struct {
+	file   *os.File
+	server *http.Server
+	url    string
+	// token authenticates the registries, so other local processes cannot
+	// forge entries.
+	token string
+	// localActor is reported for requests made from this host, which
+	// include every request of the embedded registries.
+	localActor string
+
+	mu sync.Mutex
+}
+
+var (
+	auditMu  sync.Mutex
+	auditLog *auditReceiver
+)
+
+// openAuditLog starts the audit log receiver unless it is running.
+func openAuditLog() (*auditReceiver, error) {
+	auditMu.Lock()
+	defer auditMu.Unlock()
+	if auditLog != nil {
+		return auditLog, nil
+	}
+	f, err := os.OpenFile(auditLogPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, invalid(fmt.Errorf("failed to open audit log: %w", err))
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		_ = f.Close()
+		return nil, fmt.Errorf("failed to listen for audit events: %w", err)
+	}
+	token := make([]byte, 16)
+	_, _ = rand.Read(token)
+	r := &auditReceiver{
+		file:       f,
+		url:        "http://" + listener.Addr().String() + "/events",
+		token:      hex.EncodeToString(token),
+		localActor: auditActor,
+	}
+	if r.localActor == "" {
+		r.localActor = defaultActor()
+	}
+	r.server = &http.Server{Handler: r, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		if err := r.server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("Audit log receiver failed", "error", err)
+		}
+	}()
+	auditLog = r
+	return r, nil
+}
+
+// closeAuditLog stops the audit log receiver, once the registries are
+// stopped.
+func closeAuditLog(ctx context.Context) {
+	auditMu.Lock()
+	r := auditLog
+	auditLog = nil
+	auditMu.Unlock()
+	if r == nil {
+		return
+	}
+	if err := r.server.Shutdown(ctx); err != nil {
+		slog.Warn("Failed stopping audit log receiver", "error", err)
+	}
+	if err := r.file.Close(); err != nil {
+		slog.Error("Failed closing audit log", "error", err)
+	}
+}
+
+// defaultActor names the local user as user@host.
+func defaultActor() string {
+	name := "unknown"
+	if u, err := user.Current(); err == nil {
+		name = u.Username
+	}
+	if host, err := os.Hostname(); err == nil {
+		name += "@" + host
+	}
+	return name
+}
+
+func (r *auditReceiver) endpoint() configuration.Endpoint {
+	return configuration.Endpoint{
+		Name:    "audit-log",
+		URL:     r.url,
+		Headers: http.Header{"Authorization": []string{"Bearer " + r.token}},
+		Timeout: notifyTimeout,
+		// The receiver is local, failures are write errors worth retrying
+		// quickly.
+		Threshold: 3,
+		Backoff:   100 * time.Millisecond,
+	}
+}
+
+func (r *auditReceiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost || req.Header.Get("Authorization") != "Bearer "+r.token {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	var envelope struct {
+		Events []notifications.Event `json:"events"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&envelope); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var lines []byte
+	for _, e := range envelope.Events {
+		line, err := json.Marshal(r.auditEvent(e))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		lines = append(append(lines, line...), '\n')
+	}
+	// One write per batch keeps the lines of processes sharing the file
+	// apart.
+	r.mu.Lock()
+	_, err := r.file.Write(lines)
+	r.mu.Unlock()
+	if err != nil {
+		slog.Error("Failed writing audit log", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (r *auditReceiver) auditEvent(e notifications.Event) AuditEvent {
+	return AuditEvent{
+		Timestamp:  e.Timestamp.UTC(),
+		Action:     e.Action,
+		Repository: e.Target.Repository,
+		Tag:        e.Target.Tag,
+		Digest:     e.Target.Digest.String(),
+		Size:       e.Target.Size,
+		MediaType:  e.Target.MediaType,
+		Actor:      r.actor(e),
+		ID:         e.ID,
+	}
+}
+
+// actor names who made the request of e. Without registry authentication
+// that is the client address, or the local user for requests from this
+// host.
+func (r *auditReceiver) actor(e notifications.Event) string {
+	if e.Actor.Name != "" {
+		return e.Actor.Name
+	}
+	host, _, err := net.SplitHostPort(e.Request.Addr)
+	if err != nil {
+		host = e.Request.Addr
+	}
+	if ip := net.ParseIP(host); ip != nil && !ip.IsLoopback() {
+		return host
+	}
+	return r.localActor
+}
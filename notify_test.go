@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/distribution/distribution/v3/notifications"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+func TestNotifications(t *testing.T) {
+	oldURLs, oldHeaders, oldPath, oldActor := notifyURLs, notifyHeaders, auditLogPath, auditActor
+	t.Cleanup(func() {
+		notifyURLs, notifyHeaders, auditLogPath, auditActor = oldURLs, oldHeaders, oldPath, oldActor
+		webhookEndpoints = nil
+	})
+
+	var mu sync.Mutex
+	var received []notifications.Event
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Token") != "s3cret" {
+			t.Errorf("webhook request without the configured header")
+		}
+		var envelope struct {
+			Events []notifications.Event `json:"events"`
+		}
+		_ = json.NewDecoder(r.Body).Decode(&envelope)
+		mu.Lock()
+		received = append(received, envelope.Events...)
+		mu.Unlock()
+	}))
+	t.Cleanup(webhook.Close)
+
+	notifyURLs, notifyHeaders = []string{webhook.URL}, []string{"X-Token: s3cret"}
+	auditLogPath, auditActor = filepath.Join(t.TempDir(), "audit.jsonl"), "ci-bot"
+	if err := setupNotifications(); err != nil {
+		t.Fatal(err)
+	}
+	reg, _ := startFSRegistry(t)
+	img, _ := random.Image(1024, 2)
+	tag, _ := name.NewTag(reg.RegistryStr()+"/app:v1", name.Insecure)
+	if err := remote.Write(tag, img); err != nil {
+		t.Fatal(err)
+	}
+	digest, _ := img.Digest()
+	manifest, _ := img.RawManifest()
+
+	flushNotifications(context.Background())
+	stopRegistries(context.Background())
+	closeAuditLog(context.Background())
+
+	f, err := os.Open(auditLogPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = f.Close() }()
+	var events []AuditEvent
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e AuditEvent
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			t.Fatalf("invalid audit log line %q: %v", scanner.Text(), err)
+		}
+		events = append(events, e)
+	}
+	var pushed *AuditEvent
+	for i, e := range events {
+		if e.Action == "push" && e.Tag == "v1" {
+			pushed = &events[i]
+		}
+	}
+	if pushed == nil {
+		t.Fatalf("no push of the tag in the audit log: %+v", events)
+	}
+	if pushed.Repository != "app" || pushed.Digest != digest.String() || pushed.Size != int64(len(manifest)) ||
+		pushed.Actor != "ci-bot" || pushed.Timestamp.IsZero() {
+		t.Errorf("push event = %+v", *pushed)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(received) != len(events) {
+		t.Errorf("webhook received %d events, audit log has %d", len(received), len(events))
+	}
+}
+
+func TestFlushNotificationsDeadEndpoint(t *testing.T) {
+	oldURLs, oldTimeout := notifyURLs, notifyTimeout
+	t.Cleanup(func() { notifyURLs, notifyTimeout, webhookEndpoints = oldURLs, oldTimeout, nil })
+
+	// Nothing listens on the address of a closed server.
+	dead := httptest.NewServer(http.NotFoundHandler())
+	dead.Close()
+	notifyURLs, notifyTimeout = []string{dead.URL}, time.Minute
+	if err := setupNotifications(); err != nil {
+		t.Fatal(err)
+	}
+	reg, _ := startFSRegistry(t)
+	img, _ := random.Image(256, 1)
+	tag, _ := name.NewTag(reg.RegistryStr()+"/app:v1", name.Insecure)
+	if err := remote.Write(tag, img); err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	flushNotifications(context.Background())
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("flushNotifications() waited %s for an unreachable webhook", elapsed)
+	}
+
+	// Without any progress the wait ends after --notify-timeout.
+	notifyTimeout = 100 * time.Millisecond
+	start = time.Now()
+	flushNotifications(context.Background())
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("flushNotifications() waited %s, want at most --notify-timeout", elapsed)
+	}
+}
+
+func TestSetupNotificationsValidation(t *testing.T) {
+	oldURLs, oldHeaders := notifyURLs, notifyHeaders
+	t.Cleanup(func() { notifyURLs, notifyHeaders, webhookEndpoints = oldURLs, oldHeaders, nil })
+
+	tests := []struct {
+		urls, headers []string
+	}{
+		{[]string{"hooks.example.com"}, nil},
+		{[]string{"https://hooks.example.com"}, []string{"no colon"}},
+		{nil, []string{"Authorization: Bearer x"}},
+	}
+	for _, tt := range tests {
+		notifyURLs, notifyHeaders = tt.urls, tt.headers
+		if err := setupNotifications(); exitCode(err) != exitValidation {
+			t.Errorf("setupNotifications(%v, %v) = %v, want a validation error", tt.urls, tt.headers, err)
+		}
+	}
+	notifyURLs, notifyHeaders = []string{"https://hooks.example.com"}, []string{"Authorization: Bearer abcd"}
+	if err := setupNotifications(); err != nil || len(webhookEndpoints) != 1 {
+		t.Fatalf("setupNotifications() = %v, %+v", err, webhookEndpoints)
+	}
+	if got := notifyHeaderSecrets(); len(got) != 1 || got[0] != "Bearer abcd" {
+		t.Errorf("notifyHeaderSecrets() = %v", got)
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"time"
+)
+
+const (
+	outputText = "text"
+	outputJSON = "json"
+)
+
+// outputFormat selects how commands print their results on stdout. Logs
+// always go to stderr.
+var outputFormat = outputText
+
+func validateOutputFormat() error {
+	switch outputFormat {
+	case outputText, outputJSON:
+		return nil
+	}
+	return invalidf("unsupported output format %q, expected %s or %s", outputFormat, outputText, outputJSON)
+}
+
+func jsonOutput() bool {
+	return outputFormat == outputJSON
+}
+
+// printResult writes result to stdout as JSON with --output json, and calls
+// text otherwise. text may be nil for commands that only log in text mode.
+func printResult(result any, text func(io.Writer) error) error {
+	if jsonOutput() {
+		return writeJSON(os.Stdout, result)
+	}
+	if text == nil {
+		return nil
+	}
+	return text(os.Stdout)
+}
+
+func writeJSON(out io.Writer, v any) error {
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// ErrorResult is printed on stdout with --output json when a command fails.
+type ErrorResult struct {
+	Error    string `json:"error"`
+	Kind     string `json:"kind"`
+	ExitCode int    `json:"exitCode"`
+}
+
+// PushResult is the result of a push.
+type PushResult struct {
+	Ref             string   `json:"ref"`
+	Image           string   `json:"image"`
+	Digest          string   `json:"digest"`
+	Size            int64    `json:"size"`
+	Tags            []string `json:"tags,omitempty"`
+	Skipped         bool     `json:"skipped"`
+	DurationSeconds float64  `json:"durationSeconds"`
+}
+
+// PullResult is the result of a pull.
+type PullResult struct {
+	Ref             string  `json:"ref"`
+	Image           string  `json:"image"`
+	Digest          string  `json:"digest"`
+	Size            int64   `json:"size"`
+	CachedBytes     int64   `json:"cachedBytes"`
+	DurationSeconds float64 `json:"durationSeconds"`
+}
+
+func durationSince(start time.Time) float64 {
+	return time.Since(start).Round(time.Millisecond).Seconds()
+}
+
+// reportedError marks the error of a command that already printed its
+// result, which describes the failure. main sets the exit code from it but
+// prints no ErrorResult, so stdout holds a single JSON document.
+type reportedError struct {
+	err error
+}
+
+func (e reportedError) Error() string { return e.err.Error() }
+
+func (e reportedError) Unwrap() error { return e.err }
+
+// printErrorResult reports err as JSON on stdout, so scripts reading the
+// output of a failed command still get a parseable document.
+func printErrorResult(err error, code int) {
+	_ = writeJSON(os.Stdout, ErrorResult{Error: redactString(err.Error()), Kind: exitKind(code), ExitCode: code})
+}
@@ -0,0 +1,167 @@
+package ocistore
+
+import (
+	"fmt"
+	"path/filepath"
+
+	_ "github.com/distribution/distribution/v3/registry/storage/driver/azure"
+	_ "github.com/distribution/distribution/v3/registry/storage/driver/filesystem"
+	_ "github.com/distribution/distribution/v3/registry/storage/driver/gcs"
+	_ "github.com/distribution/distribution/v3/registry/storage/driver/s3-aws"
+)
+
+type S3Backend struct {
+	RootDir   string
+	Region    string
+	Endpoint  string
+	AccessKey string /* #nosec G117 */
+	SecretKey string
+}
+
+func (s *S3Backend) Type() string {
+	return "s3"
+}
+
+func (s *S3Backend) ParseRef(ref string) (*StorageRef, error) {
+	return ParseStorageRef(ref, "s3")
+}
+
+func (s *S3Backend) GetStorageConfig(bucket string) map[string]interface{} {
+	config := map[string]interface{}{
+		"bucket": bucket,
+	}
+
+	if s.Region != "" {
+		config["region"] = s.Region
+	}
+	if s.Endpoint != "" {
+		config["regionendpoint"] = s.Endpoint
+	}
+	if s.AccessKey != "" {
+		config["accesskey"] = s.AccessKey
+	}
+	if s.SecretKey != "" {
+		config["secretkey"] = s.SecretKey
+	}
+	if s.RootDir != "" {
+		config["rootdirectory"] = s.RootDir
+	}
+	return config
+}
+
+func (s *S3Backend) ValidateConfig() error {
+	if s.Region == "" {
+		return fmt.Errorf("S3 requires region to be specified")
+	}
+	return nil
+}
+
+type GCSBackend struct {
+	RootDir string
+	Keyfile string // For GCS
+}
+
+func (g *GCSBackend) Type() string {
+	return "gcs"
+}
+
+func (g *GCSBackend) ParseRef(ref string) (*StorageRef, error) {
+	return ParseStorageRef(ref, "gcs")
+}
+
+func (g *GCSBackend) GetStorageConfig(bucket string) map[string]interface{} {
+	config := map[string]interface{}{
+		"bucket": bucket,
+	}
+
+	if g.Keyfile != "" {
+		config["keyfile"] = g.Keyfile
+	}
+	if g.RootDir != "" {
+		config["rootdirectory"] = g.RootDir
+	}
+	return config
+}
+
+func (g *GCSBackend) ValidateConfig() error {
+	return nil
+}
+
+type AzureBackend struct {
+	AccountName    string // For Azure
+	AccountKey     string // For Azure
+	Container      string // For Azure
+	CredentialType string //For Azure
+	RootDir        string
+	Secret         string /* #nosec G117 */
+	TenantID       string
+	ClientID       string
+}
+
+func (a *AzureBackend) Type() string {
+	return "azure"
+}
+
+func (a *AzureBackend) ParseRef(ref string) (*StorageRef, error) {
+	return ParseStorageRef(ref, "azure")
+}
+
+func (a *AzureBackend) GetStorageConfig(container string) map[string]interface{} {
+	config := map[string]interface{}{
+		"container": container,
+	}
+
+	if a.AccountName != "" {
+		config["accountname"] = a.AccountName
+	}
+	if a.AccountKey != "" {
+		config["accountkey"] = a.AccountKey
+	}
+	if a.RootDir != "" {
+		config["rootdirectory"] = a.RootDir
+	}
+	if a.CredentialType != "" {
+		config["credentials"] = map[string]string{"type": a.CredentialType,
+			"secret":   a.Secret,
+			"clientid": a.ClientID,
+			"tenantid": a.TenantID}
+	}
+	return config
+}
+
+func (a *AzureBackend) ValidateConfig() error {
+	if a.AccountName == "" {
+		return fmt.Errorf("missing required Azure account name")
+	}
+	if a.AccountKey == "" {
+		return fmt.Errorf("missing required account key")
+	}
+	return nil
+}
+
+type FilesystemBackend struct {
+	RootDir string
+}
+
+func (f *FilesystemBackend) Type() string {
+	return "filesystem"
+}
+
+func (f *FilesystemBackend) ParseRef(ref string) (*StorageRef, error) {
+	return ParseStorageRef(ref, "filesystem")
+}
+
+// GetStorageConfig maps a bucket to a directory below the root directory, so
+// references look the same as for the cloud backends.
+func (f *FilesystemBackend) GetStorageConfig(bucket string) map[string]interface{} {
+	return map[string]interface{}{
+		"rootdirectory": filepath.Join(f.RootDir, bucket),
+	}
+}
+
+func (f *FilesystemBackend) ValidateConfig() error {
+	if f.RootDir == "" {
+		return fmt.Errorf("filesystem backend requires a root directory")
+	}
+	return nil
+}
@@ -0,0 +1,315 @@
+// Package ocistore stores OCI images in cloud storage buckets, using the
+// distribution registry's storage drivers. Images are written in the
+// registry's own layout, so a bucket can also be served by a plain registry.
+//
+// A Client talks to the buckets of one storage backend through embedded
+// registries on localhost, started per bucket on first use. Its writes obey
+// the policy.json of each bucket, as the oci-store commands do:
+//
+//	client, err := ocistore.NewClient(&ocistore.S3Backend{Region: "us-east-1"}, ocistore.ClientOptions{})
+//	if err != nil {
+//		return err
+//	}
+//	defer client.Close(context.Background())
+//	digest, err := client.Push(ctx, img, "my-bucket/myapp:v1.0")
+package ocistore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+	"sync"
+
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/distribution/distribution/v3/registry/storage/driver/factory"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+)
+
+// ClientOptions configures a Client.
+type ClientOptions struct {
+	Registry RegistryOptions
+	// Transport carries the requests to the embedded registries,
+	// remote.DefaultTransport if nil.
+	Transport http.RoundTripper
+	// Policy, if set, is enforced in addition to the write policy stored in
+	// each bucket.
+	Policy *Policy
+	// Transfer sets the retries, timeouts and bandwidth limits of requests.
+	// Pushes upload layers in resumable chunks, retrying failed chunks.
+	Transfer TransferOptions
+}
+
+// Client pushes, pulls and manages images in the buckets of a storage
+// backend. It is safe for concurrent use.
+type Client struct {
+	backend StorageBackend
+	opts    ClientOptions
+
+	mu         sync.Mutex
+	registries map[string]*Registry
+	drivers    map[string]storagedriver.StorageDriver // read the policies
+}
+
+// NewClient returns a Client for the buckets of backend.
+func NewClient(backend StorageBackend, opts ClientOptions) (*Client, error) {
+	if err := backend.ValidateConfig(); err != nil {
+		return nil, invalidError{err: err}
+	}
+	if err := opts.Transfer.Validate(); err != nil {
+		return nil, err
+	}
+	if opts.Transport == nil {
+		opts.Transport = remote.DefaultTransport
+	}
+	return &Client{backend: backend, opts: opts, registries: map[string]*Registry{}, drivers: map[string]storagedriver.StorageDriver{}}, nil
+}
+
+// Close stops the embedded registries, waiting for requests in flight until
+// ctx expires. Images returned by Pull cannot be read after Close.
+func (c *Client) Close(ctx context.Context) error {
+	c.mu.Lock()
+	running := slices.Collect(maps.Values(c.registries))
+	c.registries = map[string]*Registry{}
+	c.drivers = map[string]storagedriver.StorageDriver{}
+	c.mu.Unlock()
+
+	return ShutdownRegistries(ctx, c.opts.Transport, running)
+}
+
+// Reference returns the tag ref, a <bucket>/<path>:<tag> reference, maps to
+// on the embedded registry of its bucket, for use with go-containerregistry.
+func (c *Client) Reference(ctx context.Context, ref string) (name.Tag, error) {
+	r, err := c.backend.ParseRef(ref)
+	if err != nil {
+		return name.Tag{}, err
+	}
+	reg, err := c.registry(ctx, r.Bucket)
+	if err != nil {
+		return name.Tag{}, err
+	}
+	tag, err := name.NewTag(fmt.Sprintf("%s/%s:%s", reg.Addr, r.Path, r.Tag), name.Insecure)
+	if err != nil {
+		return name.Tag{}, invalidError{err: err}
+	}
+	return tag, nil
+}
+
+// registry returns the embedded registry of bucket, starting it if needed.
+// It serves later calls too, so it does not stop with ctx.
+func (c *Client) registry(ctx context.Context, bucket string) (*Registry, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if reg, ok := c.registries[bucket]; ok {
+		return reg, nil
+	}
+	reg, err := StartRegistry(context.WithoutCancel(ctx), c.backend, bucket, c.opts.Registry)
+	if err != nil {
+		return nil, err
+	}
+	c.registries[bucket] = reg
+	return reg, nil
+}
+
+// driver returns the storage driver of bucket, creating it on first use.
+func (c *Client) driver(ctx context.Context, bucket string) (storagedriver.StorageDriver, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if d, ok := c.drivers[bucket]; ok {
+		return d, nil
+	}
+	d, err := factory.Create(context.WithoutCancel(ctx), c.backend.Type(), c.backend.GetStorageConfig(bucket))
+	if err != nil {
+		return nil, err
+	}
+	c.drivers[bucket] = d
+	return d, nil
+}
+
+// policies returns the write policy of the bucket of ref, if any, and the one
+// of the options.
+func (c *Client) policies(ctx context.Context, ref string) (PolicySet, error) {
+	r, err := c.backend.ParseRef(ref)
+	if err != nil {
+		return nil, err
+	}
+	d, err := c.driver(ctx, r.Bucket)
+	if err != nil {
+		return nil, err
+	}
+	var policies PolicySet
+	p, err := ReadPolicy(ctx, d)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the policy of %s: %w", r.Bucket, err)
+	}
+	if p != nil {
+		policies = append(policies, p)
+	}
+	if c.opts.Policy != nil {
+		policies = append(policies, c.opts.Policy)
+	}
+	return policies, nil
+}
+
+func (c *Client) remoteOptions(ctx context.Context) []remote.Option {
+	return c.opts.Transfer.RemoteOptions(ctx, c.opts.Transport)
+}
+
+// Push writes img to ref, uploading only the blobs the bucket lacks, and
+// returns the digest of its manifest. It fails without writing anything if
+// the policies forbid the repository, moving an immutable tag or the size of
+// img.
+func (c *Client) Push(ctx context.Context, img v1.Image, ref string) (v1.Hash, error) {
+	tag, err := c.Reference(ctx, ref)
+	if err != nil {
+		return v1.Hash{}, err
+	}
+	policies, err := c.policies(ctx, ref)
+	if err != nil {
+		return v1.Hash{}, err
+	}
+	digest, err := img.Digest()
+	if err != nil {
+		return v1.Hash{}, err
+	}
+	if err := policies.CheckImageSize(img); err != nil {
+		return v1.Hash{}, err
+	}
+	if err := policies.CheckTag(tag, digest, c.remoteOptions(ctx)...); err != nil {
+		return v1.Hash{}, err
+	}
+	if err := WriteImage(ctx, tag, img, c.opts.Transport, c.opts.Transfer); err != nil {
+		return v1.Hash{}, fmt.Errorf("failed to push %s: %w", ref, err)
+	}
+	return digest, nil
+}
+
+// Pull returns the image stored at ref. Its layers are read from the bucket
+// when accessed, until the Client is closed; load it into Docker with
+// daemon.Write or copy it elsewhere with remote.Write.
+func (c *Client) Pull(ctx context.Context, ref string) (v1.Image, error) {
+	tag, err := c.Reference(ctx, ref)
+	if err != nil {
+		return nil, err
+	}
+	img, err := remote.Image(tag, c.remoteOptions(ctx)...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to pull %s: %w", ref, err)
+	}
+	return img, nil
+}
+
+// List returns every tag stored in bucket.
+func (c *Client) List(ctx context.Context, bucket string) ([]StorageRef, error) {
+	reg, err := c.registry(ctx, bucket)
+	if err != nil {
+		return nil, err
+	}
+	registry, err := name.NewRegistry(reg.Addr, name.Insecure)
+	if err != nil {
+		return nil, err
+	}
+	repos, err := remote.Catalog(ctx, registry, c.remoteOptions(ctx)...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list repositories of %s: %w", bucket, err)
+	}
+	var refs []StorageRef
+	for _, repo := range repos {
+		tags, err := remote.List(registry.Repo(repo), c.remoteOptions(ctx)...)
+		// Repositories holding only uploads have no tags.
+		if isNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to list tags of %s: %w", repo, err)
+		}
+		for _, tag := range tags {
+			refs = append(refs, StorageRef{Bucket: bucket, Path: repo, Tag: tag, Type: c.backend.Type()})
+		}
+	}
+	return refs, nil
+}
+
+// Delete removes the tag ref. The blobs of its image stay in the bucket.
+// Immutable tags and tags outside the allowed repositories of the policies
+// cannot be deleted.
+func (c *Client) Delete(ctx context.Context, ref string) error {
+	tag, err := c.Reference(ctx, ref)
+	if err != nil {
+		return err
+	}
+	policies, err := c.policies(ctx, ref)
+	if err != nil {
+		return err
+	}
+	if err := policies.CheckRepository(tag.RepositoryStr()); err != nil {
+		return err
+	}
+	if policies.Immutable(tag.RepositoryStr(), tag.TagStr()) {
+		return fmt.Errorf("%s:%s is immutable, refusing to delete it", tag.RepositoryStr(), tag.TagStr())
+	}
+	if err := remote.Delete(tag, c.remoteOptions(ctx)...); err != nil {
+		return fmt.Errorf("failed to delete %s: %w", ref, err)
+	}
+	return nil
+}
+
+// Copy points dst at the image or index of src. Both are references on the
+// client's backend and may be in different buckets; only the blobs the
+// destination lacks are copied. The policies of the bucket of dst apply as
+// for Push.
+func (c *Client) Copy(ctx context.Context, src string, dst string) error {
+	srcTag, err := c.Reference(ctx, src)
+	if err != nil {
+		return err
+	}
+	dstTag, err := c.Reference(ctx, dst)
+	if err != nil {
+		return err
+	}
+	desc, err := remote.Get(srcTag, c.remoteOptions(ctx)...)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", src, err)
+	}
+	policies, err := c.policies(ctx, dst)
+	if err != nil {
+		return err
+	}
+	if err := policies.CheckManifestSize(desc); err != nil {
+		return err
+	}
+	if err := policies.CheckTag(dstTag, desc.Digest, c.remoteOptions(ctx)...); err != nil {
+		return err
+	}
+	if err := CopyManifest(desc, dstTag, c.remoteOptions(ctx)...); err != nil {
+		return fmt.Errorf("failed to copy %s to %s: %w", src, dst, err)
+	}
+	return nil
+}
+
+// CopyManifest writes the image or index of desc, with the blobs tag's
+// repository lacks, to tag.
+func CopyManifest(desc *remote.Descriptor, tag name.Tag, options ...remote.Option) error {
+	if desc.MediaType.IsIndex() {
+		idx, err := desc.ImageIndex()
+		if err != nil {
+			return err
+		}
+		return remote.WriteIndex(tag, idx, options...)
+	}
+	img, err := desc.Image()
+	if err != nil {
+		return err
+	}
+	return remote.Write(tag, img, options...)
+}
+
+func isNotFound(err error) bool {
+	var terr *transport.Error
+	return errors.As(err, &terr) && terr.StatusCode == http.StatusNotFound
+}
@@ -0,0 +1,165 @@
+package ocistore
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/distribution/distribution/v3/registry/storage/driver/factory"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+)
+
+func TestClient(t *testing.T) {
+	ctx := context.Background()
+	client, err := NewClient(&FilesystemBackend{RootDir: t.TempDir()}, ClientOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = client.Close(context.Background()) })
+
+	img, _ := random.Image(1024, 2)
+	digest, err := client.Push(ctx, img, "prod/team/app:v1")
+	if err != nil {
+		t.Fatalf("Push() error = %v", err)
+	}
+	if want, _ := img.Digest(); digest != want {
+		t.Errorf("Push() = %s, want %s", digest, want)
+	}
+
+	pulled, err := client.Pull(ctx, "prod/team/app:v1")
+	if err != nil {
+		t.Fatalf("Pull() error = %v", err)
+	}
+	if got, _ := pulled.Digest(); got != digest {
+		t.Errorf("Pull() digest = %s, want %s", got, digest)
+	}
+	layers, _ := pulled.Layers()
+	for _, l := range layers {
+		rc, err := l.Compressed()
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = rc.Close()
+	}
+
+	// Copies into another bucket bring their blobs along.
+	if err := client.Copy(ctx, "prod/team/app:v1", "dr/team/app:v1"); err != nil {
+		t.Fatalf("Copy() error = %v", err)
+	}
+	if err := client.Copy(ctx, "prod/team/app:v1", "prod/team/app:stable"); err != nil {
+		t.Fatalf("Copy() error = %v", err)
+	}
+	copied, err := client.Pull(ctx, "dr/team/app:v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := copied.ConfigFile(); err != nil {
+		t.Errorf("copied image lacks its config: %v", err)
+	}
+
+	if err := client.Delete(ctx, "prod/team/app:v1"); err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+	refs, err := client.List(ctx, "prod")
+	if err != nil {
+		t.Fatalf("List() error = %v", err)
+	}
+	want := []StorageRef{{Bucket: "prod", Path: "team/app", Tag: "stable", Type: "filesystem"}}
+	if !reflect.DeepEqual(refs, want) {
+		t.Errorf("List() = %+v, want %+v", refs, want)
+	}
+	if refs, err := client.List(ctx, "empty"); err != nil || len(refs) != 0 {
+		t.Errorf("List() of an empty bucket = %+v, %v", refs, err)
+	}
+
+	if _, err := client.Pull(ctx, "prod/team/app"); !errors.Is(err, ErrInvalid) {
+		t.Errorf("Pull() without a tag = %v, want ErrInvalid", err)
+	}
+	if _, err := NewClient(&S3Backend{}, ClientOptions{}); !errors.Is(err, ErrInvalid) {
+		t.Errorf("NewClient() without a region = %v, want ErrInvalid", err)
+	}
+}
+
+func TestClientListMany(t *testing.T) {
+	ctx := context.Background()
+	client, err := NewClient(&FilesystemBackend{RootDir: t.TempDir()}, ClientOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = client.Close(context.Background()) })
+
+	img, _ := random.Image(256, 1)
+	want := []string{"api:v1", "api:v2", "web/frontend:latest"}
+	for _, ref := range want {
+		if _, err := client.Push(ctx, img, "bucket/"+ref); err != nil {
+			t.Fatal(err)
+		}
+	}
+	refs, err := client.List(ctx, "bucket")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, r := range refs {
+		got = append(got, r.Path+":"+r.Tag)
+	}
+	sort.Strings(got)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("List() = %v, want %v", got, want)
+	}
+}
+
+func TestClientPolicy(t *testing.T) {
+	ctx := context.Background()
+	backend := &FilesystemBackend{RootDir: t.TempDir()}
+	d, err := factory.Create(ctx, backend.Type(), backend.GetStorageConfig("prod"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.PutContent(ctx, PolicyPath, []byte(`{"immutableTags": ["v*"], "allowedRepositories": ["team/"]}`)); err != nil {
+		t.Fatal(err)
+	}
+	client, err := NewClient(backend, ClientOptions{Policy: &Policy{MaxImageBytes: 10000}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = client.Close(context.Background()) })
+
+	img, _ := random.Image(512, 1)
+	other, _ := random.Image(512, 1)
+	big, _ := random.Image(8192, 2)
+	if _, err := client.Push(ctx, img, "prod/team/app:v1"); err != nil {
+		t.Fatalf("Push() error = %v", err)
+	}
+	if _, err := client.Push(ctx, img, "prod/team/app:v1"); err != nil {
+		t.Errorf("Push() of the same image to an immutable tag error = %v", err)
+	}
+	if _, err := client.Push(ctx, other, "prod/team/app:v1"); err == nil || !strings.Contains(err.Error(), "immutable") {
+		t.Errorf("Push() over an immutable tag error = %v, want immutable error", err)
+	}
+	if _, err := client.Push(ctx, img, "prod/other/app:latest"); err == nil {
+		t.Error("Push() outside the allowed repositories should fail")
+	}
+	if _, err := client.Push(ctx, big, "prod/team/big:latest"); !errors.As(err, &SizeError{}) {
+		t.Errorf("Push() above the size of the client policy error = %v, want SizeError", err)
+	}
+	if _, err := client.Push(ctx, other, "dr/other/app:v1"); err != nil {
+		t.Errorf("Push() to a bucket without a policy error = %v", err)
+	}
+
+	if err := client.Copy(ctx, "dr/other/app:v1", "prod/team/app:v1"); err == nil || !strings.Contains(err.Error(), "immutable") {
+		t.Errorf("Copy() over an immutable tag error = %v, want immutable error", err)
+	}
+	if err := client.Copy(ctx, "dr/other/app:v1", "prod/team/app:latest"); err != nil {
+		t.Errorf("Copy() error = %v", err)
+	}
+	if err := client.Delete(ctx, "prod/team/app:v1"); err == nil || !strings.Contains(err.Error(), "immutable") {
+		t.Errorf("Delete() of an immutable tag error = %v, want immutable error", err)
+	}
+	if err := client.Delete(ctx, "prod/team/app:latest"); err != nil {
+		t.Errorf("Delete() error = %v", err)
+	}
+}
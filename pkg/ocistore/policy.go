@@ -0,0 +1,235 @@
+package ocistore
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+// PolicyPath is where a bucket's write policy is kept, next to the registry
+// layout.
+const PolicyPath = "/oci-store/policy.json"
+
+// Policy restricts what may be written to a bucket.
+type Policy struct {
+	// ImmutableTags are glob patterns of tags that cannot be moved once
+	// written. A pattern containing ':' is matched against <repository>:<tag>,
+	// otherwise against the tag alone.
+	ImmutableTags []string `json:"immutableTags,omitempty"`
+	// AllowedRepositories are the repository prefixes that can be written,
+	// e.g. "team-a/". Any repository is allowed when empty.
+	AllowedRepositories []string `json:"allowedRepositories,omitempty"`
+	// MaxImageBytes limits the size of a written image or artifact, config
+	// and layers.
+	MaxImageBytes int64 `json:"maxImageBytes,omitempty"`
+}
+
+// PolicySet is the bucket policy and any further policies of the writer.
+// Writes must satisfy all of them.
+type PolicySet []*Policy
+
+// ParsePolicy decodes a policy.json, rejecting unknown fields and invalid
+// patterns.
+func ParsePolicy(content []byte) (*Policy, error) {
+	dec := json.NewDecoder(bytes.NewReader(content))
+	dec.DisallowUnknownFields()
+	var p Policy
+	if err := dec.Decode(&p); err != nil {
+		return nil, err
+	}
+	for _, pattern := range p.ImmutableTags {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid immutable tag pattern %q: %w", pattern, err)
+		}
+	}
+	if p.MaxImageBytes < 0 {
+		return nil, fmt.Errorf("maxImageBytes must not be negative")
+	}
+	return &p, nil
+}
+
+// ReadPolicy returns the policy stored in the bucket of d, or nil if it has
+// none.
+func ReadPolicy(ctx context.Context, d storagedriver.StorageDriver) (*Policy, error) {
+	content, err := d.GetContent(ctx, PolicyPath)
+	var notFound storagedriver.PathNotFoundError
+	if errors.As(err, &notFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	p, err := ParsePolicy(content)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", PolicyPath, err)
+	}
+	return p, nil
+}
+
+// CheckRepository fails unless every policy allows writing to repo.
+func (ps PolicySet) CheckRepository(repo string) error {
+	for _, p := range ps {
+		if len(p.AllowedRepositories) == 0 {
+			continue
+		}
+		allowed := false
+		for _, prefix := range p.AllowedRepositories {
+			if strings.HasPrefix(repo, prefix) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return fmt.Errorf("policy does not allow writing to repository %s, allowed prefixes: %s", repo, strings.Join(p.AllowedRepositories, ", "))
+		}
+	}
+	return nil
+}
+
+// Immutable reports whether any policy declares repo:tag immutable.
+func (ps PolicySet) Immutable(repo string, tag string) bool {
+	for _, p := range ps {
+		for _, pattern := range p.ImmutableTags {
+			subject := tag
+			if strings.Contains(pattern, ":") {
+				subject = repo + ":" + tag
+			}
+			if ok, _ := path.Match(pattern, subject); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// CheckSize fails with a SizeError when size exceeds the limit of any
+// policy.
+func (ps PolicySet) CheckSize(size int64) error {
+	for _, p := range ps {
+		if p.MaxImageBytes > 0 && size > p.MaxImageBytes {
+			return SizeError{Size: size, Limit: p.MaxImageBytes}
+		}
+	}
+	return nil
+}
+
+// CheckImageSize fails with a SizeError when the stored size of img exceeds
+// the limit of any policy.
+func (ps PolicySet) CheckImageSize(img v1.Image) error {
+	size, err := StoredImageSize(img)
+	if err != nil {
+		return err
+	}
+	return ps.CheckSize(size)
+}
+
+// CheckIndexSize checks each image of index, and of the indexes nested in
+// it, like CheckImageSize.
+func (ps PolicySet) CheckIndexSize(index v1.ImageIndex) error {
+	manifest, err := index.IndexManifest()
+	if err != nil {
+		return err
+	}
+	for _, d := range manifest.Manifests {
+		switch {
+		case d.MediaType.IsIndex():
+			child, err := index.ImageIndex(d.Digest)
+			if err != nil {
+				return err
+			}
+			if err := ps.CheckIndexSize(child); err != nil {
+				return err
+			}
+		case d.MediaType.IsImage():
+			img, err := index.Image(d.Digest)
+			if err != nil {
+				return err
+			}
+			if err := ps.CheckImageSize(img); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// CheckManifestSize checks the image or index of desc like CheckImageSize
+// and CheckIndexSize.
+func (ps PolicySet) CheckManifestSize(desc *remote.Descriptor) error {
+	switch {
+	case desc.MediaType.IsIndex():
+		index, err := desc.ImageIndex()
+		if err != nil {
+			return err
+		}
+		return ps.CheckIndexSize(index)
+	case desc.MediaType.IsImage():
+		img, err := desc.Image()
+		if err != nil {
+			return err
+		}
+		return ps.CheckImageSize(img)
+	}
+	return nil
+}
+
+// CheckTag fails if the policies forbid pointing tag at digest, either
+// because its repository is not allowed or because it is an immutable tag
+// that already holds something else. The options are used to look up the
+// current digest of immutable tags.
+func (ps PolicySet) CheckTag(tag name.Tag, digest v1.Hash, options ...remote.Option) error {
+	if err := ps.CheckRepository(tag.RepositoryStr()); err != nil {
+		return err
+	}
+	if !ps.Immutable(tag.RepositoryStr(), tag.TagStr()) {
+		return nil
+	}
+	existing, err := remote.Head(tag, options...)
+	if isNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to check %s: %w", tag.String(), err)
+	}
+	if existing.Digest != digest {
+		return fmt.Errorf("%s:%s is immutable and already holds %s", tag.RepositoryStr(), tag.TagStr(), existing.Digest)
+	}
+	return nil
+}
+
+// SizeError is an image larger than a policy allows.
+type SizeError struct {
+	Size  int64
+	Limit int64
+}
+
+func (e SizeError) Error() string {
+	return fmt.Sprintf("image is %d bytes, policy allows at most %d", e.Size, e.Limit)
+}
+
+// StoredImageSize returns the stored size of img: its manifest, config and
+// layers.
+func StoredImageSize(img v1.Image) (int64, error) {
+	manifest, err := img.Manifest()
+	if err != nil {
+		return 0, err
+	}
+	size, err := img.Size()
+	if err != nil {
+		return 0, err
+	}
+	size += manifest.Config.Size
+	for _, layer := range manifest.Layers {
+		size += layer.Size
+	}
+	return size, nil
+}
@@ -0,0 +1,111 @@
+package ocistore
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+func TestParsePolicy(t *testing.T) {
+	p, err := ParsePolicy([]byte(`{"immutableTags": ["v*"], "allowedRepositories": ["team-a/"], "maxImageBytes": 1024}`))
+	if err != nil {
+		t.Fatalf("ParsePolicy() error = %v", err)
+	}
+	if len(p.ImmutableTags) != 1 || len(p.AllowedRepositories) != 1 || p.MaxImageBytes != 1024 {
+		t.Errorf("ParsePolicy() = %+v", p)
+	}
+
+	for _, bad := range []string{
+		`{"immutableTag": ["v*"]}`,
+		`{"immutableTags": ["v["]}`,
+		`{"maxImageBytes": -1}`,
+	} {
+		if _, err := ParsePolicy([]byte(bad)); err == nil {
+			t.Errorf("ParsePolicy(%s) should fail", bad)
+		}
+	}
+}
+
+func TestPolicySet(t *testing.T) {
+	ps := PolicySet{
+		{ImmutableTags: []string{"v*", "app:stable"}, AllowedRepositories: []string{"team-a/", "app"}},
+		{MaxImageBytes: 100},
+	}
+
+	for repo, want := range map[string]bool{"team-a/web": true, "app": true, "team-b/web": false} {
+		if err := ps.CheckRepository(repo); (err == nil) != want {
+			t.Errorf("CheckRepository(%q) error = %v, want allowed %v", repo, err, want)
+		}
+	}
+
+	tests := []struct {
+		repo, tag string
+		want      bool
+	}{
+		{"app", "v1.0", true},
+		{"other", "v2", true},
+		{"app", "stable", true},
+		{"other", "stable", false},
+		{"app", "latest", false},
+	}
+	for _, tt := range tests {
+		if got := ps.Immutable(tt.repo, tt.tag); got != tt.want {
+			t.Errorf("Immutable(%q, %q) = %v, want %v", tt.repo, tt.tag, got, tt.want)
+		}
+	}
+
+	if err := ps.CheckSize(100); err != nil {
+		t.Errorf("CheckSize(100) error = %v", err)
+	}
+	if err := ps.CheckSize(101); err == nil {
+		t.Error("CheckSize(101) should fail")
+	}
+	if err := (PolicySet{}).CheckRepository("anything"); err != nil {
+		t.Errorf("empty policy set should allow any repository, got %v", err)
+	}
+}
+
+func TestPolicySetCheckTag(t *testing.T) {
+	srv := httptest.NewServer(registry.New())
+	t.Cleanup(srv.Close)
+	host := strings.TrimPrefix(srv.URL, "http://")
+	tag := func(s string) name.Tag {
+		t.Helper()
+		tag, err := name.NewTag(host+"/app:"+s, name.Insecure)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tag
+	}
+	img, _ := random.Image(256, 1)
+	other, _ := random.Image(256, 1)
+	if err := remote.Write(tag("v1"), img); err != nil {
+		t.Fatal(err)
+	}
+	digest, _ := img.Digest()
+	otherDigest, _ := other.Digest()
+
+	ps := PolicySet{{ImmutableTags: []string{"v*"}, AllowedRepositories: []string{"app"}}}
+	if err := ps.CheckTag(tag("v1"), digest); err != nil {
+		t.Errorf("retagging the same digest error = %v", err)
+	}
+	if err := ps.CheckTag(tag("v2"), otherDigest); err != nil {
+		t.Errorf("writing a new immutable tag error = %v", err)
+	}
+	if err := ps.CheckTag(tag("latest"), otherDigest); err != nil {
+		t.Errorf("moving a mutable tag error = %v", err)
+	}
+	if err := ps.CheckTag(tag("v1"), otherDigest); err == nil || !strings.Contains(err.Error(), "immutable") {
+		t.Errorf("moving an immutable tag error = %v, want immutable error", err)
+	}
+
+	mirror, _ := name.NewTag(host+"/mirror:v1", name.Insecure)
+	if err := ps.CheckTag(mirror, digest); err == nil {
+		t.Error("writing to a repository outside the allowed prefixes should fail")
+	}
+}
@@ -0,0 +1,163 @@
+package ocistore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/distribution/distribution/v3/configuration"
+	"github.com/distribution/distribution/v3/registry"
+)
+
+// RegistryOptions configures the embedded registries.
+type RegistryOptions struct {
+	// Verbose logs the registry at info level instead of only fatal errors.
+	Verbose bool
+	// Configure, if set, adjusts the configuration before the registry is
+	// created, e.g. to add notifications or change upload purging.
+	Configure func(*configuration.Configuration) error
+}
+
+// Registry is an embedded registry serving a bucket on localhost.
+type Registry struct {
+	// Addr is the host:port the registry listens on.
+	Addr string
+	reg  *registry.Registry
+}
+
+// StartRegistry starts a registry serving bucket on a free local port. It
+// keeps running after ctx is cancelled, until Shutdown.
+func StartRegistry(ctx context.Context, backend StorageBackend, bucket string, opts RegistryOptions) (*Registry, error) {
+	port, err := findFreePort()
+	if err != nil {
+		return nil, err
+	}
+	regAddr := fmt.Sprintf("localhost:%d", port)
+
+	if err := backend.ValidateConfig(); err != nil {
+		return nil, invalidError{err: err}
+	}
+
+	config, err := RegistryConfig(backend, bucket, regAddr, opts)
+	if err != nil {
+		return nil, err
+	}
+	// Creating the registry also sets up the storage driver.
+	reg, err := NewRegistry(ctx, config)
+	if err != nil {
+		return nil, err
+	}
+
+	go func() {
+		slog.Debug("Starting registry", "addr", regAddr)
+		err := reg.ListenAndServe()
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("Failed starting server", "error", err)
+		}
+	}()
+	if err := waitForListener(regAddr); err != nil {
+		return nil, err
+	}
+	return &Registry{Addr: regAddr, reg: reg}, nil
+}
+
+// waitForListener waits until addr accepts connections, so the first
+// request to a new registry does not race its server.
+func waitForListener(addr string) error {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		conn, err := net.DialTimeout("tcp", addr, time.Second)
+		if err == nil {
+			return conn.Close()
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("registry on %s did not start: %w", addr, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Shutdown stops the registry, waiting for requests in flight until ctx
+// expires.
+func (r *Registry) Shutdown(ctx context.Context) error {
+	slog.Debug("Stopping registry", "addr", r.Addr)
+	return r.reg.Shutdown(ctx)
+}
+
+// ShutdownRegistries stops registries like Shutdown, first closing the idle
+// connections of transport, the one their clients use: Shutdown waits
+// seconds for connections that were dialed but never sent a request, which
+// concurrent transfers leave behind.
+func ShutdownRegistries(ctx context.Context, transport http.RoundTripper, registries []*Registry) error {
+	if t, ok := transport.(interface{ CloseIdleConnections() }); ok {
+		t.CloseIdleConnections()
+	}
+	var errs []error
+	for _, r := range registries {
+		if err := r.Shutdown(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("failed to stop the registry on %s: %w", r.Addr, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// RegistryConfig returns the configuration of a registry serving bucket on
+// addr.
+func RegistryConfig(backend StorageBackend, bucket string, addr string, opts RegistryOptions) (*configuration.Configuration, error) {
+	if err := ValidateBucket(bucket); err != nil {
+		return nil, err
+	}
+	storageDriverConfig := configuration.Storage{}
+	storageDriverConfig[backend.Type()] = backend.GetStorageConfig(bucket)
+
+	log := configuration.Log{Level: configuration.Loglevel("fatal"), AccessLog: configuration.AccessLog{Disabled: true}}
+	if opts.Verbose {
+		log.Level = configuration.Loglevel("info")
+	}
+	config := &configuration.Configuration{
+		Storage: storageDriverConfig,
+		HTTP:    configuration.HTTP{Addr: addr},
+		Log:     log,
+		// The YAML loader defaults this to 1000; without it the catalog
+		// endpoint rejects the page size clients ask for.
+		Catalog: configuration.Catalog{MaxEntries: 1000},
+	}
+	if opts.Configure != nil {
+		if err := opts.Configure(config); err != nil {
+			return nil, err
+		}
+	}
+	return config, nil
+}
+
+// NewRegistry creates a registry from config. Distribution panics when the
+// storage driver cannot be set up, e.g. for an unknown S3 region; that is
+// returned as an error matching ErrInvalid.
+func NewRegistry(ctx context.Context, config *configuration.Configuration) (reg *registry.Registry, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = invalidf("invalid storage configuration: %v", r)
+		}
+	}()
+	return registry.NewRegistry(ctx, config)
+}
+
+// findFreePort listens on a random available TCP port (by specifying :0)
+func findFreePort() (int, error) {
+	// Listen on TCP port 0. The operating system will assign a free, ephemeral port.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, fmt.Errorf("failed to listen on a free port: %w", err)
+	}
+	defer func() { _ = listener.Close() }()
+
+	tcpAddr, ok := listener.Addr().(*net.TCPAddr)
+	if !ok {
+		return 0, fmt.Errorf("listener address is not a TCP address: %T", listener.Addr())
+	}
+	return tcpAddr.Port, nil
+}
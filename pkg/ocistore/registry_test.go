@@ -0,0 +1,27 @@
+package ocistore
+
+import (
+	"fmt"
+	"net"
+	"testing"
+)
+
+func TestFindFreePort(t *testing.T) {
+	// Test that findFreePort returns a valid port
+	port, err := findFreePort()
+	if err != nil {
+		t.Fatalf("findFreePort() error = %v", err)
+	}
+
+	if port <= 0 || port > 65535 {
+		t.Errorf("findFreePort() = %d, want valid port range (1-65535)", port)
+	}
+
+	// Test that the port is actually free
+	testListener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		t.Errorf("Port %d returned by findFreePort is not actually free: %v", port, err)
+	} else {
+		testListener.Close()
+	}
+}
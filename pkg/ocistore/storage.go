@@ -0,0 +1,72 @@
+package ocistore
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrInvalid is matched by errors.Is for errors caused by an invalid
+// reference, option or storage configuration rather than by the storage.
+var ErrInvalid = errors.New("invalid argument")
+
+type invalidError struct {
+	err error
+}
+
+func (e invalidError) Error() string { return e.err.Error() }
+
+func (e invalidError) Unwrap() error { return e.err }
+
+func (e invalidError) Is(target error) bool { return target == ErrInvalid }
+
+func invalidf(format string, args ...any) error {
+	return invalidError{err: fmt.Errorf(format, args...)}
+}
+
+// StorageRef is a tag in a bucket: <bucket>/<path>:<tag>.
+type StorageRef struct {
+	Bucket string
+	Path   string
+	Tag    string
+	Type   string
+}
+
+// StorageBackend configures the distribution storage driver of a bucket.
+type StorageBackend interface {
+	Type() string
+	ParseRef(ref string) (*StorageRef, error)
+	GetStorageConfig(bucket string) map[string]interface{}
+	ValidateConfig() error
+}
+
+// ValidateBucket rejects names that do not name a single bucket. The
+// filesystem backend maps buckets to directories, where "..", or a name
+// with a path separator, would point outside its root directory.
+func ValidateBucket(bucket string) error {
+	if bucket == "" || bucket == "." || bucket == ".." || strings.ContainsAny(bucket, `/\`) {
+		return invalidf("invalid bucket name %q", bucket)
+	}
+	return nil
+}
+
+func ParseStorageRef(ref string, storageType string) (*StorageRef, error) {
+	bucket, pathTag, ok := strings.Cut(ref, "/")
+	if !ok {
+		return nil, invalidf("invalid %s reference format, expected: bucket/path:tag", storageType)
+	}
+	if err := ValidateBucket(bucket); err != nil {
+		return nil, err
+	}
+	path, tag, ok := strings.Cut(pathTag, ":")
+	if !ok {
+		return nil, invalidf("missing tag in reference")
+	}
+
+	return &StorageRef{
+		Bucket: bucket,
+		Path:   path,
+		Tag:    tag,
+		Type:   storageType,
+	}, nil
+}
@@ -0,0 +1,112 @@
+package ocistore
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParseStorageRef(t *testing.T) {
+	tests := []struct {
+		name        string
+		ref         string
+		storageType string
+		want        *StorageRef
+		wantErr     bool
+	}{
+		{
+			name:        "valid S3 ref",
+			ref:         "my-bucket/path/to/image:v1.0",
+			storageType: "s3",
+			want: &StorageRef{
+				Bucket: "my-bucket",
+				Path:   "path/to/image",
+				Tag:    "v1.0",
+				Type:   "s3",
+			},
+			wantErr: false,
+		},
+		{
+			name:        "valid GCS ref",
+			ref:         "my-gcs-bucket/app:v2.0",
+			storageType: "gcs",
+			want: &StorageRef{
+				Bucket: "my-gcs-bucket",
+				Path:   "app",
+				Tag:    "v2.0",
+				Type:   "gcs",
+			},
+			wantErr: false,
+		},
+		{
+			name:        "valid Azure ref",
+			ref:         "my-container/service:v3.0",
+			storageType: "azure",
+			want: &StorageRef{
+				Bucket: "my-container",
+				Path:   "service",
+				Tag:    "v3.0",
+				Type:   "azure",
+			},
+			wantErr: false,
+		},
+		{
+			name:        "invalid ref - no slash",
+			ref:         "invalid-ref",
+			storageType: "s3",
+			want:        nil,
+			wantErr:     true,
+		},
+		{
+			name:        "invalid ref - parent directory as bucket",
+			ref:         "../etc/app:v1",
+			storageType: "filesystem",
+			want:        nil,
+			wantErr:     true,
+		},
+		{
+			name:        "invalid ref - no tag",
+			ref:         "bucket/path",
+			storageType: "s3",
+			want:        nil,
+			wantErr:     true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseStorageRef(tt.ref, tt.storageType)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ParseStorageRef() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if tt.wantErr && !errors.Is(err, ErrInvalid) {
+				t.Errorf("ParseStorageRef() error = %v, want ErrInvalid", err)
+			}
+			if !tt.wantErr {
+				if got == nil {
+					t.Errorf("ParseStorageRef() returned nil, want %v", tt.want)
+					return
+				}
+				if got.Bucket != tt.want.Bucket || got.Path != tt.want.Path || got.Tag != tt.want.Tag || got.Type != tt.want.Type {
+					t.Errorf("ParseStorageRef() = %+v, want %+v", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestValidateBucket(t *testing.T) {
+	for _, bucket := range []string{"", ".", "..", "../x", "a/b", `a\b`} {
+		if err := ValidateBucket(bucket); !errors.Is(err, ErrInvalid) {
+			t.Errorf("ValidateBucket(%q) = %v, want ErrInvalid", bucket, err)
+		}
+	}
+	if err := ValidateBucket("my-bucket.v2"); err != nil {
+		t.Errorf("ValidateBucket(my-bucket.v2) = %v", err)
+	}
+	// The registry of a bucket must not be set up outside the root directory.
+	backend := &FilesystemBackend{RootDir: t.TempDir()}
+	if _, err := RegistryConfig(backend, "..", "localhost:0", RegistryOptions{}); !errors.Is(err, ErrInvalid) {
+		t.Errorf("RegistryConfig(..) = %v, want ErrInvalid", err)
+	}
+}
@@ -0,0 +1,193 @@
+package ocistore
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	"golang.org/x/time/rate"
+)
+
+// maxThrottleBurst bounds the bytes passed on at once, so a limited transfer
+// is smooth rather than bursty.
+const maxThrottleBurst = 256 << 10
+
+// TransferOptions holds the retry, timeout and bandwidth settings of
+// transfers. The zero value transfers without retries or limits.
+type TransferOptions struct {
+	Retries          int
+	Backoff          time.Duration
+	OperationTimeout time.Duration
+	// UploadLimit and DownloadLimit cap the bandwidth of all requests made
+	// with these options together, nil for no limit. See NewRateLimiter.
+	UploadLimit   *rate.Limiter
+	DownloadLimit *rate.Limiter
+	// OnRetry, if set, is called before each retry of operation.
+	OnRetry func(ctx context.Context, operation string)
+}
+
+// Validate fails with ErrInvalid for negative settings.
+func (o TransferOptions) Validate() error {
+	switch {
+	case o.Retries < 0:
+		return invalidf("retries must not be negative")
+	case o.Backoff < 0:
+		return invalidf("retry backoff must not be negative")
+	case o.OperationTimeout < 0:
+		return invalidf("operation timeout must not be negative")
+	}
+	return nil
+}
+
+// RemoteOptions applies the settings to go-containerregistry, which retries
+// failed requests and blob uploads itself. Requests go through base with
+// the timeout and bandwidth limits applied.
+func (o TransferOptions) RemoteOptions(ctx context.Context, base http.RoundTripper) []remote.Option {
+	return []remote.Option{
+		remote.WithContext(ctx),
+		remote.WithTransport(o.Transport(base)),
+		remote.WithRetryBackoff(remote.Backoff{Duration: o.Backoff, Factor: 2, Jitter: 0.1, Steps: o.Retries + 1}),
+	}
+}
+
+// Transport returns base with the per-operation timeout and bandwidth
+// limits applied.
+func (o TransferOptions) Transport(base http.RoundTripper) http.RoundTripper {
+	t := base
+	if o.UploadLimit != nil || o.DownloadLimit != nil {
+		t = &throttledTransport{base: t, upload: o.UploadLimit, download: o.DownloadLimit}
+	}
+	if o.OperationTimeout > 0 {
+		t = &timeoutTransport{base: t, timeout: o.OperationTimeout}
+	}
+	return t
+}
+
+// Retry calls fn until it succeeds, fails with an error that is not
+// transient, or runs out of retries.
+func (o TransferOptions) Retry(ctx context.Context, operation string, fn func() error) error {
+	delay := o.Backoff
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || attempt > o.Retries || !IsRetryable(err) || ctx.Err() != nil {
+			return err
+		}
+		slog.Warn("Retrying "+operation, "attempt", attempt, "retries", o.Retries, "delay", delay, "error", err)
+		if o.OnRetry != nil {
+			o.OnRetry(ctx, operation)
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+		delay *= 2
+	}
+}
+
+// IsRetryable reports whether err is a transient failure: a dropped
+// connection, a timeout or a server error the storage may recover from.
+func IsRetryable(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+	if errors.Is(err, errUploadOutOfSync) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE) {
+		return true
+	}
+	var terr *transport.Error
+	if errors.As(err, &terr) {
+		switch terr.StatusCode {
+		case http.StatusRequestTimeout, http.StatusTooManyRequests, http.StatusInternalServerError,
+			http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return true
+		}
+		return false
+	}
+	var nerr net.Error
+	return errors.As(err, &nerr) || errors.Is(err, context.DeadlineExceeded)
+}
+
+// NewRateLimiter returns a limiter for bytesPerSecond, or nil for no limit.
+func NewRateLimiter(bytesPerSecond int64) *rate.Limiter {
+	if bytesPerSecond <= 0 {
+		return nil
+	}
+	return rate.NewLimiter(rate.Limit(bytesPerSecond), int(min(bytesPerSecond, maxThrottleBurst)))
+}
+
+// timeoutTransport limits each request, including reading its response, to
+// timeout.
+type timeoutTransport struct {
+	base    http.RoundTripper
+	timeout time.Duration
+}
+
+func (t *timeoutTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	ctx, cancel := context.WithTimeout(r.Context(), t.timeout)
+	resp, err := t.base.RoundTrip(r.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	resp.Body = &cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelOnClose) Close() error {
+	defer c.cancel()
+	return c.ReadCloser.Close()
+}
+
+// throttledTransport limits the bandwidth of request and response bodies.
+// The limiters are shared by all requests, so concurrent layer transfers
+// stay under the limit together.
+type throttledTransport struct {
+	base             http.RoundTripper
+	upload, download *rate.Limiter
+}
+
+func (t *throttledTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if t.upload != nil && r.Body != nil && r.Body != http.NoBody {
+		r = r.Clone(r.Context())
+		r.Body = &throttledReader{ReadCloser: r.Body, ctx: r.Context(), limiter: t.upload}
+	}
+	resp, err := t.base.RoundTrip(r)
+	if err == nil && t.download != nil && resp.Body != nil {
+		resp.Body = &throttledReader{ReadCloser: resp.Body, ctx: r.Context(), limiter: t.download}
+	}
+	return resp, err
+}
+
+type throttledReader struct {
+	io.ReadCloser
+	ctx     context.Context
+	limiter *rate.Limiter
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	if len(p) > t.limiter.Burst() {
+		p = p[:t.limiter.Burst()]
+	}
+	n, err := t.ReadCloser.Read(p)
+	if n > 0 {
+		if werr := t.limiter.WaitN(t.ctx, n); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,137 @@
+package ocistore
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+)
+
+func TestIsRetryable(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"nil", nil, false},
+		{"plain", errors.New("boom"), false},
+		{"invalid", invalidf("bad option"), false},
+		{"canceled", fmt.Errorf("push: %w", context.Canceled), false},
+		{"timeout", context.DeadlineExceeded, true},
+		{"unavailable", &transport.Error{StatusCode: http.StatusServiceUnavailable}, true},
+		{"throttled", &transport.Error{StatusCode: http.StatusTooManyRequests}, true},
+		{"not found", &transport.Error{StatusCode: http.StatusNotFound}, false},
+		{"unauthorized", &transport.Error{StatusCode: http.StatusUnauthorized}, false},
+		{"connection refused", &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}, true},
+		{"out of sync", fmt.Errorf("%w: 416", errUploadOutOfSync), true},
+	}
+	for _, tt := range tests {
+		if got := IsRetryable(tt.err); got != tt.want {
+			t.Errorf("IsRetryable(%s) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRetry(t *testing.T) {
+	opts := TransferOptions{Retries: 2, Backoff: time.Millisecond}
+	unavailable := &transport.Error{StatusCode: http.StatusServiceUnavailable}
+
+	calls := 0
+	err := opts.Retry(context.Background(), "test", func() error {
+		calls++
+		if calls < 3 {
+			return unavailable
+		}
+		return nil
+	})
+	if err != nil || calls != 3 {
+		t.Errorf("Retry() = %v after %d calls, want success on the third", err, calls)
+	}
+
+	calls = 0
+	err = opts.Retry(context.Background(), "test", func() error { calls++; return unavailable })
+	if !errors.Is(err, unavailable) || calls != 3 {
+		t.Errorf("Retry() = %v after %d calls, want the error after 3", err, calls)
+	}
+
+	calls = 0
+	err = opts.Retry(context.Background(), "test", func() error { calls++; return errors.New("bad manifest") })
+	if err == nil || calls != 1 {
+		t.Errorf("Retry() = %v after %d calls, want permanent errors returned at once", err, calls)
+	}
+
+	if err := (TransferOptions{Retries: -1}).Validate(); !errors.Is(err, ErrInvalid) {
+		t.Errorf("Validate() with negative retries = %v", err)
+	}
+}
+
+func TestTimeoutTransport(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			select {
+			case <-release:
+			case <-r.Context().Done():
+			}
+		}
+	}))
+	t.Cleanup(srv.Close)
+	t.Cleanup(func() { close(release) })
+
+	client := &http.Client{Transport: &timeoutTransport{base: http.DefaultTransport, timeout: 50 * time.Millisecond}}
+	resp, err := client.Get(srv.URL + "/fast")
+	if err != nil {
+		t.Fatalf("fast request error = %v", err)
+	}
+	_ = resp.Body.Close()
+
+	_, err = client.Get(srv.URL + "/slow")
+	if !errors.Is(err, context.DeadlineExceeded) || !IsRetryable(err) {
+		t.Errorf("slow request error = %v, want a retryable timeout", err)
+	}
+}
+
+func TestThrottledTransport(t *testing.T) {
+	const size = 128 << 10
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPut {
+			_, _ = io.Copy(io.Discard, r.Body)
+			return
+		}
+		_, _ = w.Write(make([]byte, size))
+	}))
+	t.Cleanup(srv.Close)
+
+	// The first 64 KiB pass at once, the rest at 64 KiB per second.
+	client := &http.Client{Transport: &throttledTransport{base: http.DefaultTransport, upload: NewRateLimiter(64 << 10), download: NewRateLimiter(64 << 10)}}
+
+	start := time.Now()
+	resp, err := client.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, _ := io.Copy(io.Discard, resp.Body)
+	_ = resp.Body.Close()
+	if elapsed := time.Since(start); n != size || elapsed < 700*time.Millisecond {
+		t.Errorf("downloaded %d bytes in %v, want %d bytes limited to about a second", n, elapsed, size)
+	}
+
+	start = time.Now()
+	req, _ := http.NewRequest(http.MethodPut, srv.URL, bytes.NewReader(make([]byte, size)))
+	if resp, err = client.Do(req); err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	if elapsed := time.Since(start); elapsed < 700*time.Millisecond {
+		t.Errorf("uploaded %d bytes in %v, want it limited to about a second", size, elapsed)
+	}
+}
@@ -0,0 +1,270 @@
+package ocistore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	"golang.org/x/sync/errgroup"
+)
+
+// uploadChunkSize is the size of the chunks layers are uploaded in. An
+// interrupted upload resumes after the last byte the registry stored, so at
+// most one chunk is sent again.
+var uploadChunkSize int64 = 32 << 20
+
+// abortTimeout limits the cleanup of a failed upload.
+const abortTimeout = 10 * time.Second
+
+// uploadJobs is the number of layers uploaded concurrently.
+const uploadJobs = 4
+
+// errUploadOutOfSync means the registry stored a different part of an upload
+// than expected, and the upload has to start over.
+var errUploadOutOfSync = errors.New("upload offset does not match the registry")
+
+// WriteImage writes img to tag through base. Layers the repository does not
+// hold yet are uploaded in resumable chunks, retried as opts allow, so
+// remote.Write only writes the config and manifest.
+func WriteImage(ctx context.Context, tag name.Tag, img v1.Image, base http.RoundTripper, opts TransferOptions) error {
+	if err := uploadLayers(ctx, tag.Context(), img, base, opts); err != nil {
+		return fmt.Errorf("failed to upload layers: %w", err)
+	}
+	return remote.Write(tag, img, opts.RemoteOptions(ctx, base)...)
+}
+
+// uploadLayers uploads the layers of img that repo does not hold yet, in
+// resumable chunks.
+func uploadLayers(ctx context.Context, repo name.Repository, img v1.Image, base http.RoundTripper, opts TransferOptions) error {
+	layers, err := img.Layers()
+	if err != nil {
+		return err
+	}
+	g, ctx := errgroup.WithContext(ctx)
+	g.SetLimit(uploadJobs)
+	seen := map[v1.Hash]bool{}
+	for _, layer := range layers {
+		mediaType, err := layer.MediaType()
+		if err != nil {
+			return err
+		}
+		if !mediaType.IsDistributable() {
+			continue
+		}
+		digest, err := layer.Digest()
+		if err != nil {
+			return err
+		}
+		if seen[digest] {
+			continue
+		}
+		seen[digest] = true
+		g.Go(func() error { return uploadBlob(ctx, repo, layer, base, opts) })
+	}
+	return g.Wait()
+}
+
+// blobUpload is the state of one chunked blob upload.
+type blobUpload struct {
+	client *http.Client
+	blobs  string // URL of the repository's blobs endpoint
+	layer  v1.Layer
+	digest v1.Hash
+	size   int64
+
+	location string // URL of the upload session, empty before it starts
+	offset   int64  // bytes stored by the registry
+}
+
+// uploadBlob uploads layer to repo unless it is already stored. Failed
+// attempts resume the same upload where the registry supports it.
+func uploadBlob(ctx context.Context, repo name.Repository, layer v1.Layer, base http.RoundTripper, opts TransferOptions) error {
+	digest, err := layer.Digest()
+	if err != nil {
+		return err
+	}
+	size, err := layer.Size()
+	if err != nil {
+		return err
+	}
+	u := &blobUpload{
+		client: &http.Client{Transport: opts.Transport(base)},
+		blobs:  fmt.Sprintf("%s://%s/v2/%s/blobs/", repo.Scheme(), repo.RegistryStr(), repo.RepositoryStr()),
+		layer:  layer,
+		digest: digest,
+		size:   size,
+	}
+	err = opts.Retry(ctx, "blob upload", func() error {
+		exists, err := u.exists(ctx)
+		if err != nil || exists {
+			return err
+		}
+		if err := u.prepare(ctx); err != nil {
+			return err
+		}
+		return u.send(ctx)
+	})
+	if err != nil && u.location != "" {
+		u.abort(ctx)
+	}
+	return err
+}
+
+func (u *blobUpload) do(ctx context.Context, method, target string, body io.Reader, size int64, header map[string]string, codes ...int) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, target, body)
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = size
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_, _ = io.Copy(io.Discard, resp.Body)
+		_ = resp.Body.Close()
+	}()
+	if err := transport.CheckError(resp, codes...); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// exists reports whether the registry already holds the blob, for instance
+// from an earlier push or from an attempt whose response was lost.
+func (u *blobUpload) exists(ctx context.Context) (bool, error) {
+	resp, err := u.do(ctx, http.MethodHead, u.blobs+u.digest.String(), nil, 0, nil, http.StatusOK, http.StatusNotFound)
+	if err != nil {
+		return false, err
+	}
+	if resp.StatusCode == http.StatusOK {
+		slog.Debug("Blob already stored", "digest", u.digest)
+		return true, nil
+	}
+	return false, nil
+}
+
+// prepare starts an upload session, or asks the registry how much of an
+// interrupted one it stored. A session the registry no longer knows, or
+// cannot report on, is started over.
+func (u *blobUpload) prepare(ctx context.Context) error {
+	if u.location != "" {
+		resp, err := u.do(ctx, http.MethodGet, u.location, nil, 0, nil, http.StatusNoContent)
+		if err == nil {
+			if err := u.setLocation(resp); err != nil {
+				return err
+			}
+			if u.offset, err = storedBytes(resp.Header.Get("Range")); err != nil {
+				return err
+			}
+			slog.Info("Resuming blob upload", "digest", u.digest, "offset", u.offset, "size", u.size)
+			return nil
+		}
+		if IsRetryable(err) {
+			return err
+		}
+		slog.Debug("Upload cannot be resumed, starting over", "digest", u.digest, "error", err)
+	}
+	resp, err := u.do(ctx, http.MethodPost, u.blobs+"uploads/", nil, 0, nil, http.StatusAccepted)
+	if err != nil {
+		return err
+	}
+	u.offset = 0
+	return u.setLocation(resp)
+}
+
+// abort cancels the upload session, so the registry deletes the partial
+// data and, on S3, aborts the multipart upload holding it. It also runs when
+// ctx was cancelled by an interrupt.
+func (u *blobUpload) abort(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), abortTimeout)
+	defer cancel()
+	if _, err := u.do(ctx, http.MethodDelete, u.location, nil, 0, nil, http.StatusNoContent); err != nil {
+		slog.Warn("Failed to abort upload, uploads purge removes it later", "digest", u.digest, "error", err)
+		return
+	}
+	slog.Debug("Aborted upload", "digest", u.digest)
+}
+
+// setLocation moves the upload to the session URL of a registry response,
+// which changes with every request.
+func (u *blobUpload) setLocation(resp *http.Response) error {
+	loc, err := resp.Location()
+	if err != nil {
+		return fmt.Errorf("upload response has no location: %w", err)
+	}
+	u.location = loc.String()
+	return nil
+}
+
+// storedBytes returns the size of an upload from its Range header.
+// Registries report both an empty upload and a single stored byte as 0-0;
+// the former is assumed, and a wrong guess restarts the upload.
+func storedBytes(r string) (int64, error) {
+	_, end, ok := strings.Cut(r, "-")
+	last, err := strconv.ParseInt(end, 10, 64)
+	if !ok || err != nil || last < 0 {
+		return 0, fmt.Errorf("invalid upload range %q", r)
+	}
+	if last == 0 {
+		return 0, nil
+	}
+	return last + 1, nil
+}
+
+// send uploads the blob from the stored offset in chunks and completes the
+// upload.
+func (u *blobUpload) send(ctx context.Context) error {
+	rc, err := u.layer.Compressed()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = rc.Close() }()
+	if _, err := io.CopyN(io.Discard, rc, u.offset); err != nil {
+		return fmt.Errorf("failed to skip the stored part of %s: %w", u.digest, err)
+	}
+
+	for u.offset < u.size {
+		n := min(uploadChunkSize, u.size-u.offset)
+		resp, err := u.do(ctx, http.MethodPatch, u.location, io.LimitReader(rc, n), n, map[string]string{
+			"Content-Type":  "application/octet-stream",
+			"Content-Range": fmt.Sprintf("%d-%d", u.offset, u.offset+n-1),
+		}, http.StatusAccepted, http.StatusNoContent)
+		var terr *transport.Error
+		if errors.As(err, &terr) && terr.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+			u.location = ""
+			return fmt.Errorf("%w: %v", errUploadOutOfSync, err)
+		}
+		if err != nil {
+			return err
+		}
+		if err := u.setLocation(resp); err != nil {
+			return err
+		}
+		u.offset += n
+	}
+
+	complete, err := url.Parse(u.location)
+	if err != nil {
+		return err
+	}
+	q := complete.Query()
+	q.Set("digest", u.digest.String())
+	complete.RawQuery = q.Encode()
+	_, err = u.do(ctx, http.MethodPut, complete.String(), nil, 0, nil, http.StatusCreated)
+	return err
+}
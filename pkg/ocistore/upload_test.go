@@ -0,0 +1,180 @@
+package ocistore
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// flakyTransport fails chosen PATCH requests, counting the bytes the
+// registry received.
+type flakyTransport struct {
+	base http.RoundTripper
+
+	mu      sync.Mutex
+	patches int
+	sent    int64
+	posts   int
+	// lost are the PATCH requests whose response is dropped after the
+	// registry stored the chunk; unavailable are rejected before that.
+	lost, unavailable map[int]bool
+	// beforePatch is called with the number of each PATCH request.
+	beforePatch func(patch int)
+}
+
+func (t *flakyTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	t.mu.Lock()
+	if r.Method == http.MethodPost {
+		t.posts++
+	}
+	patch := 0
+	if r.Method == http.MethodPatch {
+		t.patches++
+		patch = t.patches
+	}
+	t.mu.Unlock()
+
+	if patch > 0 && t.beforePatch != nil {
+		t.beforePatch(patch)
+	}
+	if t.unavailable[patch] {
+		_, _ = io.Copy(io.Discard, r.Body)
+		_ = r.Body.Close()
+		return &http.Response{StatusCode: http.StatusServiceUnavailable, Body: http.NoBody, Request: r, Header: http.Header{}}, nil
+	}
+	resp, err := t.base.RoundTrip(r)
+	if patch > 0 && err == nil {
+		t.mu.Lock()
+		t.sent += r.ContentLength
+		t.mu.Unlock()
+	}
+	if t.lost[patch] && err == nil {
+		_ = resp.Body.Close()
+		return nil, io.ErrUnexpectedEOF
+	}
+	return resp, err
+}
+
+// startTestRegistry starts a registry on a bucket in a temporary directory
+// and returns its address and the directory.
+func startTestRegistry(t *testing.T) (string, string) {
+	t.Helper()
+	dir := t.TempDir()
+	reg, err := StartRegistry(context.Background(), &FilesystemBackend{RootDir: dir}, "bucket", RegistryOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = reg.Shutdown(context.Background()) })
+	return reg.Addr, dir
+}
+
+func TestUploadBlobResumes(t *testing.T) {
+	addr, _ := startTestRegistry(t)
+	repo, _ := name.NewRepository(addr+"/app", name.Insecure)
+
+	oldChunk := uploadChunkSize
+	t.Cleanup(func() { uploadChunkSize = oldChunk })
+	uploadChunkSize = 1024
+	flaky := &flakyTransport{base: http.DefaultTransport, lost: map[int]bool{2: true}, unavailable: map[int]bool{4: true}}
+
+	layer, err := random.Layer(5000, types.DockerLayer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	size, _ := layer.Size()
+	opts := TransferOptions{Retries: 3}
+	if err := uploadBlob(context.Background(), repo, layer, flaky, opts); err != nil {
+		t.Fatalf("uploadBlob() error = %v", err)
+	}
+	if flaky.posts != 1 {
+		t.Errorf("upload was started %d times, want it resumed", flaky.posts)
+	}
+	if flaky.sent != size {
+		t.Errorf("registry received %d bytes, want each of the %d bytes once", flaky.sent, size)
+	}
+
+	digest, _ := layer.Digest()
+	stored, err := remote.Layer(repo.Digest(digest.String()), remote.WithTransport(http.DefaultTransport))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if storedSize, err := stored.Size(); err != nil || storedSize != size {
+		t.Errorf("stored blob size = %d, %v, want %d", storedSize, err, size)
+	}
+
+	// A stored blob is not uploaded again.
+	flaky.posts = 0
+	if err := uploadBlob(context.Background(), repo, layer, flaky, opts); err != nil || flaky.posts != 0 {
+		t.Errorf("uploadBlob() of a stored blob = %v with %d uploads started", err, flaky.posts)
+	}
+
+	// Without retries the first failure is returned.
+	other, _ := random.Layer(3000, types.DockerLayer)
+	flaky.patches, flaky.unavailable = 0, map[int]bool{1: true}
+	if err := uploadBlob(context.Background(), repo, other, flaky, TransferOptions{}); err == nil {
+		t.Error("uploadBlob() with --retries 0 succeeded despite a failed request")
+	}
+}
+
+func TestUploadBlobAbortsWhenCancelled(t *testing.T) {
+	addr, dir := startTestRegistry(t)
+	repo, _ := name.NewRepository(addr+"/app", name.Insecure)
+
+	oldChunk := uploadChunkSize
+	t.Cleanup(func() { uploadChunkSize = oldChunk })
+	uploadChunkSize = 1024
+	ctx, cancel := context.WithCancel(context.Background())
+	flaky := &flakyTransport{base: http.DefaultTransport, beforePatch: func(patch int) {
+		if patch == 3 {
+			cancel()
+		}
+	}}
+
+	layer, _ := random.Layer(5000, types.DockerLayer)
+	if err := uploadBlob(ctx, repo, layer, flaky, TransferOptions{Retries: 3}); !errors.Is(err, context.Canceled) {
+		t.Fatalf("uploadBlob() error = %v, want it cancelled", err)
+	}
+
+	// The registry keeps the hash state of a cancelled upload, which
+	// uploads purge removes, but not its data.
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err == nil && d.Name() == "data" && strings.Contains(p, "_uploads") {
+			t.Errorf("upload data left after cancelling: %s", p)
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStoredBytes(t *testing.T) {
+	tests := []struct {
+		header  string
+		want    int64
+		wantErr bool
+	}{
+		{"0-0", 0, false},
+		{"0-1023", 1024, false},
+		{"bytes=0-99", 100, false},
+		{"", 0, true},
+		{"0-x", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := storedBytes(tt.header)
+		if got != tt.want || (err != nil) != tt.wantErr {
+			t.Errorf("storedBytes(%q) = %d, %v, want %d", tt.header, got, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/nbctools/oci-store/pkg/ocistore"
+	"github.com/spf13/cobra"
+)
+
+func newPolicyCmd(storageType string, validate func() error) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "policy",
+		Short: "Manage the write policy stored in a bucket",
+		Long: `Manage the write policy stored in a bucket. push, tag, artifact push,
+attach, import and sync check it before writing.`,
+	}
+	showCmd := &cobra.Command{
+		Use:   "show <bucket>",
+		Short: "Print the write policy of a bucket",
+		Args:  cobra.ExactArgs(1),
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			return validate()
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return showPolicy(cmd.Context(), storageType, args[0])
+		},
+	}
+	setCmd := &cobra.Command{
+		Use:   "set <bucket> <policy.json>",
+		Short: "Store a write policy in a bucket",
+		Args:  cobra.ExactArgs(2),
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			return validate()
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return setPolicy(cmd.Context(), storageType, args[0], args[1])
+		},
+	}
+	cmd.AddCommand(showCmd, setCmd)
+	return cmd
+}
+
+func showPolicy(ctx context.Context, storageType string, bucket string) error {
+	d, err := openStorageDriver(ctx, storageType, bucket)
+	if err != nil {
+		return err
+	}
+	content, err := d.GetContent(ctx, ocistore.PolicyPath)
+	if isPathNotFound(err) {
+		return fmt.Errorf("bucket %s has no policy", bucket)
+	}
+	if err != nil {
+		return err
+	}
+	return writeIndentedJSON(os.Stdout, content)
+}
+
+func setPolicy(ctx context.Context, storageType string, bucket string, file string) error {
+	content, err := os.ReadFile(filepath.Clean(file))
+	if err != nil {
+		return err
+	}
+	if _, err := ocistore.ParsePolicy(content); err != nil {
+		return fmt.Errorf("invalid policy %s: %w", file, err)
+	}
+	d, err := openStorageDriver(ctx, storageType, bucket)
+	if err != nil {
+		return err
+	}
+	return d.PutContent(ctx, ocistore.PolicyPath, content)
+}
+
+// loadPolicies returns the policy stored in bucket and the one in localFile,
+// each if present.
+func loadPolicies(ctx context.Context, storageType string, bucket string, localFile string) (ocistore.PolicySet, error) {
+	d, err := openStorageDriver(ctx, storageType, bucket)
+	if err != nil {
+		return nil, err
+	}
+	return readPolicies(ctx, d, bucket, localFile)
+}
+
+// readPolicies is loadPolicies for a bucket already opened as d.
+func readPolicies(ctx context.Context, d storagedriver.StorageDriver, bucket string, localFile string) (ocistore.PolicySet, error) {
+	var policies ocistore.PolicySet
+	p, err := ocistore.ReadPolicy(ctx, d)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the policy of %s: %w", bucket, err)
+	}
+	if p != nil {
+		policies = append(policies, p)
+	}
+
+	if localFile != "" {
+		content, err := os.ReadFile(filepath.Clean(localFile))
+		if err != nil {
+			return nil, err
+		}
+		p, err := ocistore.ParsePolicy(content)
+		if err != nil {
+			return nil, fmt.Errorf("invalid policy %s: %w", localFile, err)
+		}
+		policies = append(policies, p)
+	}
+	return policies, nil
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+func TestLoadPolicies(t *testing.T) {
+	startFSRegistry(t)
+	ctx := context.Background()
+
+	policies, err := loadPolicies(ctx, "filesystem", "bucket", "")
+	if err != nil {
+		t.Fatalf("loadPolicies() error = %v", err)
+	}
+	if len(policies) != 0 {
+		t.Errorf("loadPolicies() without policies = %d entries, want 0", len(policies))
+	}
+
+	bucketFile := filepath.Join(t.TempDir(), "bucket.json")
+	localFile := filepath.Join(t.TempDir(), "local.json")
+	if err := os.WriteFile(bucketFile, []byte(`{"immutableTags": ["v*"]}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(localFile, []byte(`{"maxImageBytes": 10}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := setPolicy(ctx, "filesystem", "bucket", bucketFile); err != nil {
+		t.Fatalf("setPolicy() error = %v", err)
+	}
+
+	policies, err = loadPolicies(ctx, "filesystem", "bucket", localFile)
+	if err != nil {
+		t.Fatalf("loadPolicies() error = %v", err)
+	}
+	if len(policies) != 2 || !policies.Immutable("app", "v1") || policies.CheckSize(11) == nil {
+		t.Errorf("loadPolicies() = %+v, want bucket and local policy", policies)
+	}
+
+	if err := os.WriteFile(bucketFile, []byte(`{"unknown": true}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := setPolicy(ctx, "filesystem", "bucket", bucketFile); err == nil {
+		t.Error("setPolicy() with an invalid policy should fail")
+	}
+}
+
+func TestArtifactPolicy(t *testing.T) {
+	_, bucketDir := startFSRegistry(t)
+	ctx := context.Background()
+	dir := t.TempDir()
+	policyFile := filepath.Join(dir, "policy.json")
+	if err := os.WriteFile(policyFile, []byte(`{"immutableTags": ["v*"], "allowedRepositories": ["models/"], "maxImageBytes": 100}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := setPolicy(ctx, "filesystem", "bucket", policyFile); err != nil {
+		t.Fatal(err)
+	}
+	file := func(content string) string {
+		t.Helper()
+		f, err := os.CreateTemp(dir, "file-*.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() { _ = f.Close() }()
+		if _, err := f.WriteString(content); err != nil {
+			t.Fatal(err)
+		}
+		return f.Name()
+	}
+	small, other, large := file("small"), file("other"), file(strings.Repeat("x", 200))
+
+	if err := pushArtifact(ctx, "filesystem", "bucket/models/a:v1", defaultArtifactType, []string{small}, ""); err != nil {
+		t.Fatalf("pushArtifact() error = %v", err)
+	}
+	if err := pushArtifact(ctx, "filesystem", "bucket/models/a:v1", defaultArtifactType, []string{other}, ""); err == nil || !strings.Contains(err.Error(), "immutable") {
+		t.Errorf("pushArtifact() over an immutable tag error = %v, want immutable error", err)
+	}
+	refused, err := newFileLayer(other, defaultFileMediaType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest, _ := refused.Digest()
+	blob := filepath.Join(bucketDir, blobsRoot, "sha256", digest.Hex[:2], digest.Hex)
+	if _, err := os.Stat(blob); !os.IsNotExist(err) {
+		t.Errorf("refused pushArtifact() left blob %s, stat error = %v", digest, err)
+	}
+	if err := pushArtifact(ctx, "filesystem", "bucket/mirror/a:latest", defaultArtifactType, []string{small}, ""); err == nil {
+		t.Error("pushArtifact() outside the allowed repositories should fail")
+	}
+	if err := pushArtifact(ctx, "filesystem", "bucket/models/b:latest", defaultArtifactType, []string{large}, ""); err == nil {
+		t.Error("pushArtifact() above maxImageBytes should fail")
+	}
+	if err := attachArtifact(ctx, "filesystem", "bucket/models/a:v1", "text/plain", []string{large}, ""); err == nil {
+		t.Error("attachArtifact() above maxImageBytes should fail")
+	}
+	if err := attachArtifact(ctx, "filesystem", "bucket/models/a:v1", "text/plain", []string{other}, ""); err != nil {
+		t.Errorf("attachArtifact() error = %v", err)
+	}
+}
+
+func TestSignPolicy(t *testing.T) {
+	reg, _ := startFSRegistry(t)
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	img, _ := random.Image(512, 1)
+	target := reg.Repo("mirror/app").Tag("v1")
+	if err := remote.Write(target, img, withRegistryTransport()); err != nil {
+		t.Fatal(err)
+	}
+	policyFile := filepath.Join(dir, "policy.json")
+	if err := os.WriteFile(policyFile, []byte(`{"allowedRepositories": ["models/"]}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := setPolicy(ctx, "filesystem", "bucket", policyFile); err != nil {
+		t.Fatal(err)
+	}
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	der, _ := x509.MarshalPKCS8PrivateKey(key)
+	keyPath := filepath.Join(dir, "cosign.key")
+	writePEM(t, keyPath, "PRIVATE KEY", der)
+
+	if err := signImage(ctx, "filesystem", "bucket/mirror/app:v1", keyPath, ""); err == nil {
+		t.Fatal("signImage() outside the allowed repositories should fail")
+	}
+	tags, err := remote.List(target.Repository, withRegistryTransport())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tags) != 1 {
+		t.Errorf("tags after a refused signature = %v, want only v1", tags)
+	}
+}
@@ -2,15 +2,59 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log/slog"
+	"os"
+	"time"
 
-	"github.com/google/go-containerregistry/pkg/crane"
 	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
 	"github.com/google/go-containerregistry/pkg/v1/daemon"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/nbctools/oci-store/pkg/ocistore"
+	"github.com/spf13/cobra"
+	"go.opentelemetry.io/otel/attribute"
 )
 
-func pullImage(ctx context.Context, storageType string, storageRef string) error {
+// PullOptions holds the flags shared by the pull commands of every backend.
+type PullOptions struct {
+	DecryptionKeys []string
+	Verify         bool
+	VerifyKey      string
+	NoCache        bool
+	Transfer       ocistore.TransferOptions
+}
+
+func addPullFlags(cmd *cobra.Command) {
+	cmd.Flags().StringSlice("decryption-key", nil, "Private key used to decrypt encrypted layers, as path[:password] (repeatable)")
+	cmd.Flags().Bool("verify", false, "Refuse images without a valid signature for --key")
+	cmd.Flags().String("key", "", "Public key used by --verify (e.g. cosign.pub)")
+	cmd.Flags().Bool("no-cache", false, "Download every layer instead of using the local blob cache")
+	addTransferFlags(cmd)
+}
+
+func pullOptionsFromFlags(cmd *cobra.Command) PullOptions {
+	keys, _ := cmd.Flags().GetStringSlice("decryption-key")
+	verify, _ := cmd.Flags().GetBool("verify")
+	verifyKey, _ := cmd.Flags().GetString("key")
+	noCache, _ := cmd.Flags().GetBool("no-cache")
+	return PullOptions{DecryptionKeys: keys, Verify: verify, VerifyKey: verifyKey, NoCache: noCache, Transfer: transferOptionsFromFlags(cmd)}
+}
+
+func (o PullOptions) validate() error {
+	if o.Verify && o.VerifyKey == "" {
+		return invalidf("--verify requires a public key via --key")
+	}
+	return o.Transfer.Validate()
+}
+
+func pullImage(ctx context.Context, storageType string, storageRef string, opts PullOptions) (err error) {
+	start := time.Now()
+	defer func() { recordOperation(ctx, "pull", storageType, start, err) }()
+	if err := opts.validate(); err != nil {
+		return err
+	}
 	backend, err := NewBackend(storageType)
 	if err != nil {
 		return err
@@ -19,22 +63,109 @@ func pullImage(ctx context.Context, storageType string, storageRef string) error
 	if err != nil {
 		return err
 	}
-	slog.Info("Pulling image", "bucket", ref.Bucket, "image", ref.Path+":"+ref.Tag)
-
 	regAddr, err := startRegistry(ctx, backend, ref.Bucket)
 	if err != nil {
 		return err
 	}
-	srcRef := fmt.Sprintf("%s/%s:%s", regAddr, ref.Path, ref.Tag)
-	img, err := crane.Pull(srcRef, crane.Insecure)
+	result, err := pullFromRegistry(ctx, regAddr, ref, storageRef, "", opts)
 	if err != nil {
 		return err
 	}
-	tag, err := name.NewTag(storageRef)
+	return printResult(result, nil)
+}
+
+// pullFromRegistry loads the image of storageRef, parsed as ref, into the
+// local Docker daemon through the registry at regAddr. The image is named
+// localImage, or storageRef if that is empty.
+func pullFromRegistry(ctx context.Context, regAddr string, ref *StorageRef, storageRef string, localImage string, opts PullOptions) (PullResult, error) {
+	start := time.Now()
+	slog.Info("Pulling image", "bucket", ref.Bucket, "image", ref.Path+":"+ref.Tag)
+	srcRef := fmt.Sprintf("%s/%s:%s", regAddr, ref.Path, ref.Tag)
+	src, err := name.NewTag(srcRef, name.Insecure)
+	if err != nil {
+		return PullResult{}, err
+	}
+	img, err := remote.Image(src, transferOptions(ctx, opts.Transfer)...)
 	if err != nil {
-		return err
+		return PullResult{}, err
 	}
-	_, err = daemon.Write(tag, img)
-	slog.Info("Image pulled", "name", storageRef)
+	var blobs *blobCache
+	if !opts.NoCache && cacheDir != "" && cacheMaxSize > 0 {
+		blobs = newBlobCache(cacheDir, int64(cacheMaxSize))
+		img = cacheImage(img, blobs)
+	}
+	digest, err := img.Digest()
+	if err != nil {
+		return PullResult{}, err
+	}
+	size, err := ocistore.StoredImageSize(img)
+	if err != nil {
+		return PullResult{}, err
+	}
+
+	if opts.Verify {
+		repo, err := name.NewRepository(fmt.Sprintf("%s/%s", regAddr, ref.Path), name.Insecure)
+		if err != nil {
+			return PullResult{}, err
+		}
+		if err := verifyImageSignature(ctx, repo, img, opts.VerifyKey); err != nil {
+			return PullResult{}, fmt.Errorf("signature verification failed: %w", err)
+		}
+	}
+
+	encrypted, err := isEncrypted(img)
+	if err != nil {
+		return PullResult{}, err
+	}
+	if encrypted {
+		if len(opts.DecryptionKeys) == 0 {
+			return PullResult{}, errors.New("image has encrypted layers, a --decryption-key is required")
+		}
+		tmpDir, err := os.MkdirTemp("", "oci-store-decrypt-")
+		if err != nil {
+			return PullResult{}, err
+		}
+		defer func() { _ = os.RemoveAll(tmpDir) }()
+
+		slog.Info("Decrypting image layers")
+		img, err = decryptImage(img, opts.DecryptionKeys, tmpDir)
+		if err != nil {
+			return PullResult{}, err
+		}
+	}
+
+	if localImage == "" {
+		localImage = storageRef
+	}
+	tag, err := name.NewTag(localImage)
+	if err != nil {
+		return PullResult{}, err
+	}
+	// Requests are retried individually, but a download dropped halfway
+	// through fails the daemon write, so that is retried as a whole.
+	if err := opts.Transfer.Retry(ctx, "image download", func() error { return writeToDaemon(ctx, tag, img) }); err != nil {
+		return PullResult{}, err
+	}
+	var cached int64
+	if blobs != nil {
+		cached = blobs.cachedBytes()
+	}
+	slog.Info("Image pulled", "name", storageRef, "from_cache", humanSize(cached))
+	return PullResult{
+		Ref:             storageRef,
+		Image:           tag.String(),
+		Digest:          digest.String(),
+		Size:            size,
+		CachedBytes:     cached,
+		DurationSeconds: durationSince(start),
+	}, nil
+}
+
+// writeToDaemon loads img into the local Docker daemon. Its blobs are
+// downloaded from storage while it is written.
+func writeToDaemon(ctx context.Context, tag name.Tag, img v1.Image) (err error) {
+	ctx, span := startSpan(ctx, "image download", attribute.String("image.ref", tag.String()))
+	defer func() { endSpan(span, err) }()
+	_, err = daemon.Write(tag, img, daemon.WithContext(ctx))
 	return err
 }
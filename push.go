@@ -6,61 +6,229 @@ import (
 	"log/slog"
 	"os"
 	"strings"
-
-	_ "github.com/distribution/distribution/v3/registry/storage/driver/s3-aws"
+	"time"
 
 	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
 	"github.com/google/go-containerregistry/pkg/v1/daemon"
 	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/nbctools/oci-store/pkg/ocistore"
+	"github.com/spf13/cobra"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 func getEnv(key string) string {
 	return strings.TrimSpace(os.Getenv(key))
 }
 
-func pushImage(ctx context.Context, storageType string, storageRef string, localImage string) (err error) {
+// PushOptions holds the flags shared by the push commands of every backend.
+type PushOptions struct {
+	Image             string
+	EncryptRecipients []string
+	IfChanged         bool
+	NoClobber         bool
+	PolicyFile        string
+	Transfer          ocistore.TransferOptions
+}
+
+func addPushFlags(cmd *cobra.Command) {
+	cmd.Flags().StringP("image", "i", "", "Local Docker image to push (defaults to image-path:tag)")
+	addPushOptionFlags(cmd)
+}
+
+// addPushOptionFlags adds the push flags that apply to every image of
+// push-all.
+func addPushOptionFlags(cmd *cobra.Command) {
+	cmd.Flags().StringSlice("encrypt-recipient", nil, "Encrypt layers for a recipient before upload, e.g. jwe:pubkey.pem (repeatable)")
+	cmd.Flags().Bool("if-changed", false, "Skip the upload when the tag already holds the local image")
+	cmd.Flags().Bool("no-clobber", false, "Refuse to overwrite a tag that holds a different image")
+	cmd.Flags().String("policy", "", "Local policy file enforced in addition to the bucket policy")
+	addTransferFlags(cmd)
+}
+
+func pushOptionsFromFlags(cmd *cobra.Command) PushOptions {
+	localImage, _ := cmd.Flags().GetString("image")
+	recipients, _ := cmd.Flags().GetStringSlice("encrypt-recipient")
+	ifChanged, _ := cmd.Flags().GetBool("if-changed")
+	noClobber, _ := cmd.Flags().GetBool("no-clobber")
+	policyFile, _ := cmd.Flags().GetString("policy")
+	return PushOptions{Image: localImage, EncryptRecipients: recipients, IfChanged: ifChanged, NoClobber: noClobber, PolicyFile: policyFile, Transfer: transferOptionsFromFlags(cmd)}
+}
+
+// pushImage pushes a local image to the first of storageRefs. Any further
+// references must be in the same bucket and are tagged after the upload, so
+// blobs are only uploaded once.
+func pushImage(ctx context.Context, storageType string, storageRefs []string, opts PushOptions) (err error) {
+	start := time.Now()
+	defer func() { recordOperation(ctx, "push", storageType, start, err) }()
+	if err := opts.Transfer.Validate(); err != nil {
+		return err
+	}
 	backend, err := NewBackend(storageType)
 	if err != nil {
 		return err
 	}
-
-	ref, err := backend.ParseRef(storageRef)
+	ref, err := backend.ParseRef(storageRefs[0])
+	if err != nil {
+		return err
+	}
+	regAddr, err := startRegistry(ctx, backend, ref.Bucket)
 	if err != nil {
 		return err
 	}
+	result, err := pushToRegistry(ctx, storageType, regAddr, ref, storageRefs, opts)
+	if err != nil {
+		return err
+	}
+	return printResult(result, nil)
+}
 
+// pushToRegistry pushes a local image through the registry at regAddr,
+// which serves the bucket of ref, the parsed first of storageRefs.
+func pushToRegistry(ctx context.Context, storageType string, regAddr string, ref *StorageRef, storageRefs []string, opts PushOptions) (PushResult, error) {
+	start := time.Now()
+	storageRef := storageRefs[0]
+	localImage := opts.Image
 	if localImage == "" {
 		localImage = storageRef
 	}
-
 	slog.Info("Pushing image", "image", localImage, "dest", fmt.Sprintf("%s://%s/%s:%s", ref.Type, ref.Bucket, ref.Path, ref.Tag), "bucket", ref.Bucket)
-	regAddr, err := startRegistry(ctx, backend, ref.Bucket)
-	if err != nil {
-		return err
-	}
 
 	targetRef := fmt.Sprintf("%s/%s:%s", regAddr, ref.Path, ref.Tag)
 	slog.Info("Target image reference", "ref", targetRef)
+	extraTags, err := destinationTags(storageType, ref, regAddr, storageRefs[1:])
+	if err != nil {
+		return PushResult{}, err
+	}
+	dest, err := name.NewTag(targetRef, name.Insecure)
+	if err != nil {
+		return PushResult{}, fmt.Errorf("failed to parse target reference %s: %w", targetRef, err)
+	}
+	tags := append([]name.Tag{dest}, extraTags...)
+
+	policies, err := loadPolicies(ctx, storageType, ref.Bucket, opts.PolicyFile)
+	if err != nil {
+		return PushResult{}, err
+	}
+	protected := func(tag name.Tag) bool {
+		return opts.NoClobber || policies.Immutable(tag.RepositoryStr(), tag.TagStr())
+	}
+	checkExisting := opts.IfChanged
+	for _, tag := range tags {
+		if err := policies.CheckRepository(tag.RepositoryStr()); err != nil {
+			return PushResult{}, err
+		}
+		checkExisting = checkExisting || protected(tag)
+	}
 	slog.Info("Loading image from local Docker daemon", "source_image", localImage)
 
 	localRef, err := name.ParseReference(localImage)
 	if err != nil {
-		return err
+		return PushResult{}, err
+	}
+	img, err := daemon.Image(localRef, daemon.WithContext(ctx))
+	if err != nil {
+		return PushResult{}, fmt.Errorf("failed to load image '%s' from local Docker daemon: %w", localImage, err)
+	}
+	var stored *remote.Descriptor
+	if checkExisting {
+		stored, err = checkDestinations(ctx, tags, img, protected)
+		if err != nil {
+			return PushResult{}, err
+		}
+	}
+	skipped := stored != nil
+	if skipped {
+		slog.Info("Image unchanged, skipping upload", "target", targetRef, "digest", stored.Digest.String())
+	} else if stored, err = uploadImage(ctx, dest, img, opts, policies); err != nil {
+		return PushResult{}, err
 	}
-	img, err := daemon.Image(localRef)
+
+	if len(extraTags) > 0 {
+		if err := applyTags(ctx, dest.Context(), stored, extraTags); err != nil {
+			return PushResult{}, err
+		}
+	}
+	storedImg, err := stored.Image()
 	if err != nil {
-		return fmt.Errorf("failed to load image '%s' from local Docker daemon: %w", localImage, err)
+		return PushResult{}, err
 	}
-	slog.Info("Pushing image directly to target registry", "target", targetRef)
-	dest, err := name.ParseReference(targetRef, name.Insecure) // Tell ParseReference that this might be insecure
+	size, err := ocistore.StoredImageSize(storedImg)
 	if err != nil {
-		return fmt.Errorf("failed to parse target reference %s: %w", targetRef, err)
+		return PushResult{}, err
 	}
+	return PushResult{
+		Ref:             storageRef,
+		Image:           localImage,
+		Digest:          stored.Digest.String(),
+		Size:            size,
+		Tags:            storageRefs[1:],
+		Skipped:         skipped,
+		DurationSeconds: durationSince(start),
+	}, nil
+}
+
+// uploadImage writes img to dest, encrypting it first if requested, and
+// returns the stored descriptor.
+func uploadImage(ctx context.Context, dest name.Tag, img v1.Image, opts PushOptions, policies ocistore.PolicySet) (_ *remote.Descriptor, err error) {
+	ctx, span := startSpan(ctx, "image upload", attribute.String("image.ref", dest.String()))
+	defer func() { endSpan(span, err) }()
 
-	err = remote.Write(dest, img) // Push the image
+	if len(opts.EncryptRecipients) > 0 {
+		tmpDir, err := os.MkdirTemp("", "oci-store-encrypt-")
+		if err != nil {
+			return nil, err
+		}
+		defer func() { _ = os.RemoveAll(tmpDir) }()
+
+		slog.Info("Encrypting image layers", "recipients", len(opts.EncryptRecipients))
+		img, err = encryptImage(img, opts.EncryptRecipients, tmpDir)
+		if err != nil {
+			return nil, err
+		}
+	}
+	size, err := ocistore.StoredImageSize(img)
 	if err != nil {
-		return fmt.Errorf("failed to push image directly to registry %s: %w", targetRef, err)
+		return nil, err
+	}
+	if err := policies.CheckSize(size); err != nil {
+		return nil, err
+	}
+	span.SetAttributes(attribute.Int64("image.size", size))
+	slog.Info("Pushing image directly to target registry", "target", dest.String())
+	if err := ocistore.WriteImage(ctx, dest, img, registryTransport, opts.Transfer); err != nil {
+		return nil, fmt.Errorf("failed to push image directly to registry %s: %w", dest.String(), err)
+	}
+	slog.Info("Image pushed directly to registry successfully!", "target", dest.String())
+	return remote.Get(dest, transferOptions(ctx, opts.Transfer)...)
+}
+
+// checkDestinations looks at the existing tags a push would write. It fails
+// if a protected tag holds a different image, and returns the stored
+// descriptor of the first tag when that already holds img.
+func checkDestinations(ctx context.Context, tags []name.Tag, img v1.Image, protected func(name.Tag) bool) (*remote.Descriptor, error) {
+	id, err := img.ConfigName()
+	if err != nil {
+		return nil, err
+	}
+	var first *remote.Descriptor
+	for i, tag := range tags {
+		desc, err := remote.Get(tag, remote.WithContext(ctx), withRegistryTransport())
+		if isNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to check %s: %w", tag.String(), err)
+		}
+		if storedImageMatches(desc, id) {
+			if i == 0 {
+				first = desc
+			}
+			continue
+		}
+		if protected(tag) {
+			return nil, fmt.Errorf("%s:%s already holds %s, refusing to overwrite it", tag.RepositoryStr(), tag.TagStr(), desc.Digest)
+		}
 	}
-	slog.Info("Image pushed directly to registry successfully!", "target", targetRef)
-	return nil
+	return first, nil
 }
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"text/tabwriter"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/spf13/cobra"
+)
+
+const createdAnnotation = "org.opencontainers.image.created"
+
+// Referrer describes an artifact attached to a stored image.
+type Referrer struct {
+	Digest       string            `json:"digest"`
+	ArtifactType string            `json:"artifactType"`
+	Size         int64             `json:"size"`
+	Annotations  map[string]string `json:"annotations,omitempty"`
+}
+
+func newAttachCmd(storageType string, validate func() error) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "attach --subject " + refUsage(storageType) + " <file>[:<media-type>]...",
+		Short: "Attach files (SBOMs, attestations) to a stored image",
+		Long: `Attach files to a stored image as an OCI 1.1 artifact whose subject is the
+image. Attached artifacts are listed with the referrers command.`,
+		Args: cobra.MinimumNArgs(1),
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			return validate()
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			subject, _ := cmd.Flags().GetString("subject")
+			artifactType, _ := cmd.Flags().GetString("artifact-type")
+			policyFile, _ := cmd.Flags().GetString("policy")
+			return attachArtifact(cmd.Context(), storageType, subject, artifactType, args, policyFile)
+		},
+	}
+	cmd.Flags().String("subject", "", "Stored image the files are attached to")
+	cmd.Flags().String("artifact-type", "", "Artifact type of the attached files (e.g. application/spdx+json)")
+	cmd.Flags().String("policy", "", "Local policy file enforced in addition to the bucket policy")
+	_ = cmd.MarkFlagRequired("subject")
+	_ = cmd.MarkFlagRequired("artifact-type")
+	return cmd
+}
+
+func newReferrersCmd(storageType string, validate func() error) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "referrers " + refUsage(storageType),
+		Short: "List artifacts attached to a stored image",
+		Args:  cobra.ExactArgs(1),
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			return validate()
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			artifactType, _ := cmd.Flags().GetString("artifact-type")
+			return listReferrers(cmd.Context(), storageType, args[0], artifactType)
+		},
+	}
+	cmd.Flags().String("artifact-type", "", "Only list artifacts of this type")
+	return cmd
+}
+
+func attachArtifact(ctx context.Context, storageType string, subjectRef string, artifactType string, files []string, policyFile string) error {
+	ref, target, err := openStorageRef(ctx, storageType, subjectRef)
+	if err != nil {
+		return err
+	}
+	// The artifact is stored by digest, so only the repository and size
+	// limits apply.
+	policies, err := loadPolicies(ctx, storageType, ref.Bucket, policyFile)
+	if err != nil {
+		return err
+	}
+	if err := policies.CheckRepository(target.RepositoryStr()); err != nil {
+		return err
+	}
+	subject, err := remote.Head(target, remote.WithContext(ctx), withRegistryTransport())
+	if err != nil {
+		return fmt.Errorf("failed to resolve subject %s: %w", subjectRef, err)
+	}
+
+	layers := make([]v1.Layer, 0, len(files))
+	for _, file := range files {
+		path, mediaType := parseFileArg(file)
+		layer, err := newFileLayer(path, types.MediaType(mediaType))
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", path, err)
+		}
+		layers = append(layers, layer)
+	}
+	if err := checkArtifactSize(policies, layers); err != nil {
+		return err
+	}
+
+	d, err := writeReferrer(ctx, target.Repository, subject, artifactType, layers)
+	if err != nil {
+		return err
+	}
+	slog.Info("Artifact attached", "subject", subjectRef, "subject_digest", subject.Digest.String(), "digest", d.String())
+	return nil
+}
+
+// writeReferrer stores layers as an artifact whose subject is the given
+// descriptor. The registry has no referrers API, so the referrers index is
+// kept under the sha256-<digest> fallback tag as per the distribution spec.
+func writeReferrer(ctx context.Context, repo name.Repository, subject *v1.Descriptor, artifactType string, layers []v1.Layer) (v1.Hash, error) {
+	manifest := &artifactManifest{
+		ArtifactType: artifactType,
+		Subject:      &v1.Descriptor{MediaType: subject.MediaType, Digest: subject.Digest, Size: subject.Size},
+		Annotations:  map[string]string{createdAnnotation: time.Now().UTC().Format(time.RFC3339)},
+	}
+	raw, err := writeArtifact(ctx, repo, manifest, layers)
+	if err != nil {
+		return v1.Hash{}, err
+	}
+	d, _, err := v1.SHA256(bytes.NewReader(raw))
+	if err != nil {
+		return v1.Hash{}, err
+	}
+	if err := remote.Put(repo.Digest(d.String()), raw, remote.WithContext(ctx), withRegistryTransport()); err != nil {
+		return v1.Hash{}, fmt.Errorf("failed to write artifact manifest: %w", err)
+	}
+	return d, nil
+}
+
+func listReferrers(ctx context.Context, storageType string, storageRef string, artifactType string) error {
+	_, target, err := openStorageRef(ctx, storageType, storageRef)
+	if err != nil {
+		return err
+	}
+	subject, err := remote.Head(target, remote.WithContext(ctx), withRegistryTransport())
+	if err != nil {
+		return fmt.Errorf("failed to resolve %s: %w", storageRef, err)
+	}
+
+	referrers, err := fetchReferrers(ctx, target.Repository, subject.Digest, artifactType)
+	if err != nil {
+		return err
+	}
+
+	return printResult(referrers, func(out io.Writer) error {
+		w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+		_, _ = fmt.Fprintln(w, "DIGEST\tARTIFACT TYPE\tSIZE\tCREATED")
+		for _, r := range referrers {
+			_, _ = fmt.Fprintf(w, "%s\t%s\t%d\t%s\n", r.Digest, r.ArtifactType, r.Size, r.Annotations[createdAnnotation])
+		}
+		return w.Flush()
+	})
+}
+
+// fetchReferrers lists the artifacts whose subject is digest d in repo,
+// optionally filtered by artifact type.
+func fetchReferrers(ctx context.Context, repo name.Repository, d v1.Hash, artifactType string) ([]Referrer, error) {
+	index, err := remote.Referrers(repo.Digest(d.String()), remote.WithContext(ctx), withRegistryTransport())
+	if err != nil {
+		return nil, fmt.Errorf("failed to list referrers: %w", err)
+	}
+	indexManifest, err := index.IndexManifest()
+	if err != nil {
+		return nil, err
+	}
+
+	referrers := make([]Referrer, 0, len(indexManifest.Manifests))
+	for _, desc := range indexManifest.Manifests {
+		r := Referrer{
+			Digest:       desc.Digest.String(),
+			ArtifactType: desc.ArtifactType,
+			Size:         desc.Size,
+			Annotations:  desc.Annotations,
+		}
+		// Fallback tag indexes record the config media type instead of the
+		// manifest's artifactType, so read the manifest when it is missing.
+		if r.ArtifactType == "" || r.ArtifactType == emptyConfigMediaType || r.Annotations == nil {
+			if err := resolveReferrer(ctx, repo, desc.Digest, &r); err != nil {
+				return nil, err
+			}
+		}
+		if artifactType != "" && r.ArtifactType != artifactType {
+			continue
+		}
+		referrers = append(referrers, r)
+	}
+	return referrers, nil
+}
+
+func resolveReferrer(ctx context.Context, repo name.Repository, d v1.Hash, r *Referrer) error {
+	desc, err := remote.Get(repo.Digest(d.String()), remote.WithContext(ctx), withRegistryTransport())
+	if err != nil {
+		return fmt.Errorf("failed to fetch referrer %s: %w", d, err)
+	}
+	var manifest artifactManifest
+	if err := json.Unmarshal(desc.Manifest, &manifest); err != nil {
+		return fmt.Errorf("failed to parse referrer %s: %w", d, err)
+	}
+	r.ArtifactType = manifest.ArtifactType
+	if r.ArtifactType == "" {
+		r.ArtifactType = string(manifest.Config.MediaType)
+	}
+	r.Annotations = manifest.Annotations
+	return nil
+}
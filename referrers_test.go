@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+func TestWriteAndFetchReferrers(t *testing.T) {
+	ctx := context.Background()
+	host := newTestRegistry(t)
+	target, _ := name.NewTag(host+"/app:v1", name.Insecure)
+	img, _ := random.Image(256, 1)
+	if err := remote.Write(target, img); err != nil {
+		t.Fatalf("remote.Write() error = %v", err)
+	}
+	subject, err := remote.Head(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	attach := func(fileName, artifactType string) v1.Hash {
+		path := filepath.Join(dir, fileName)
+		if err := os.WriteFile(path, []byte(fileName), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		layer, err := newFileLayer(path, types.MediaType(artifactType))
+		if err != nil {
+			t.Fatal(err)
+		}
+		d, err := writeReferrer(ctx, target.Repository, subject, artifactType, []v1.Layer{layer})
+		if err != nil {
+			t.Fatalf("writeReferrer() error = %v", err)
+		}
+		return d
+	}
+	sbom := attach("sbom.spdx.json", "application/spdx+json")
+	attach("provenance.json", "application/vnd.in-toto+json")
+
+	all, err := fetchReferrers(ctx, target.Repository, subject.Digest, "")
+	if err != nil {
+		t.Fatalf("fetchReferrers() error = %v", err)
+	}
+	if len(all) != 2 {
+		t.Fatalf("fetchReferrers() returned %d referrers, want 2", len(all))
+	}
+	for _, r := range all {
+		if r.Annotations[createdAnnotation] == "" {
+			t.Errorf("referrer %s is missing the created annotation", r.Digest)
+		}
+	}
+
+	sboms, err := fetchReferrers(ctx, target.Repository, subject.Digest, "application/spdx+json")
+	if err != nil {
+		t.Fatalf("fetchReferrers() error = %v", err)
+	}
+	if len(sboms) != 1 || sboms[0].Digest != sbom.String() || sboms[0].ArtifactType != "application/spdx+json" {
+		t.Errorf("fetchReferrers() filtered = %+v, want only %s", sboms, sbom)
+	}
+}
@@ -4,70 +4,109 @@ import (
 	"context"
 	"fmt"
 	"log/slog"
-	"net"
+	"sync"
 
 	"github.com/distribution/distribution/v3/configuration"
-	"github.com/distribution/distribution/v3/registry"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/nbctools/oci-store/pkg/ocistore"
+	"go.opentelemetry.io/otel/attribute"
 )
 
-func startRegistry(ctx context.Context, backend StorageBackend, bucket string) (string, error) {
-	port, err := findFreePort()
+func startRegistry(ctx context.Context, backend StorageBackend, bucket string) (_ string, err error) {
+	// Creating the registry also sets up the storage driver.
+	_, span := startSpan(ctx, "registry start", attribute.String("storage.type", backend.Type()), attribute.String("storage.bucket", bucket))
+	defer func() { endSpan(span, err) }()
+
+	var reg *ocistore.Registry
+	err = newRegistry(ctx, func() (err error) {
+		reg, err = ocistore.StartRegistry(ctx, backend, bucket, registryOptions())
+		return err
+	})
 	if err != nil {
 		return "", err
 	}
-	regAddr := fmt.Sprintf("localhost:%d", port)
+	registriesMu.Lock()
+	registries = append(registries, reg)
+	registriesMu.Unlock()
+	return reg.Addr, nil
+}
 
-	if err := backend.ValidateConfig(); err != nil {
-		return "", err
+// registryOptions applies the logging, upload purging and notification
+// flags to the registries the CLI starts.
+func registryOptions() ocistore.RegistryOptions {
+	return ocistore.RegistryOptions{
+		Verbose: verbose,
+		Configure: func(config *configuration.Configuration) error {
+			config.Storage["maintenance"] = configuration.Parameters{"uploadpurging": uploadPurgingConfig()}
+			config.Log.Formatter = registryLogFormatter()
+			notifications, err := registryNotifications()
+			if err != nil {
+				return err
+			}
+			config.Notifications = notifications
+			return nil
+		},
 	}
+}
 
-	storageDriverConfig := configuration.Storage{}
-	storageDriverConfig[backend.Type()] = backend.GetStorageConfig(bucket)
+// registryConfig returns the configuration of a registry serving bucket on
+// addr.
+func registryConfig(backend StorageBackend, bucket string, addr string) (*configuration.Configuration, error) {
+	return ocistore.RegistryConfig(backend, bucket, addr, registryOptions())
+}
 
-	log := configuration.Log{Level: configuration.Loglevel("fatal"), AccessLog: configuration.AccessLog{Disabled: true}}
-	if verbose {
-		log = configuration.Log{Level: configuration.Loglevel("info"), AccessLog: configuration.AccessLog{Disabled: true}}
-	}
-	reg, err := registry.NewRegistry(ctx, &configuration.Configuration{
-		Storage: storageDriverConfig,
-		HTTP:    configuration.HTTP{Addr: regAddr},
-		Log:     log,
-	})
-	if err != nil {
-		return "", err
-	}
+// The embedded registries started by the command. They outlive the command's
+// context, so a cancelled command can still abort its uploads through them.
+var (
+	registriesMu sync.Mutex
+	registries   []*ocistore.Registry
+)
 
-	go func() {
-		<-ctx.Done()
-		slog.Debug("Stopping registry", "addr", regAddr)
-		err := reg.Shutdown(ctx)
-		if err != nil {
-			slog.Error("Failed stopping server", "error", err)
-		}
-	}()
+// registryClient is the transport clients of the embedded registries use,
+// before telemetry wraps it.
+var registryClient = remote.DefaultTransport
 
-	go func() {
-		slog.Debug("Starting registry", "addr", regAddr)
-		err := reg.ListenAndServe()
-		if err != nil {
-			slog.Error("Failed starting server", "error", err)
-		}
-	}()
-	return regAddr, nil
+// registryTransport carries every request to the embedded registries:
+// registryClient, instrumented by setupTelemetry when telemetry is on.
+var registryTransport = registryClient
+
+// withRegistryTransport sends a request through registryTransport.
+func withRegistryTransport() remote.Option {
+	return remote.WithTransport(registryTransport)
 }
 
-// findFreePort listens on a random available TCP port (by specifying :0)
-func findFreePort() (int, error) {
-	// Listen on TCP port 0. The operating system will assign a free, ephemeral port.
-	listener, err := net.Listen("tcp", "127.0.0.1:0")
-	if err != nil {
-		return 0, fmt.Errorf("failed to listen on a free port: %w", err)
+// stopRegistries shuts the embedded registries down once the command is
+// done, waiting for requests in flight until ctx expires.
+func stopRegistries(ctx context.Context) {
+	registriesMu.Lock()
+	running := registries
+	registries = nil
+	registriesMu.Unlock()
+
+	if err := ocistore.ShutdownRegistries(ctx, registryClient, running); err != nil {
+		slog.Error("Failed stopping server", "error", err)
 	}
-	defer func() { _ = listener.Close() }()
+}
 
-	tcpAddr, ok := listener.Addr().(*net.TCPAddr)
-	if !ok {
-		return 0, fmt.Errorf("listener address is not a TCP address: %T", listener.Addr())
+// openStorageRef parses storageRef for the given backend, starts a registry
+// on its bucket and returns the tag the reference maps to on that registry.
+func openStorageRef(ctx context.Context, storageType string, storageRef string) (*StorageRef, name.Tag, error) {
+	backend, err := NewBackend(storageType)
+	if err != nil {
+		return nil, name.Tag{}, err
+	}
+	ref, err := backend.ParseRef(storageRef)
+	if err != nil {
+		return nil, name.Tag{}, err
+	}
+	regAddr, err := startRegistry(ctx, backend, ref.Bucket)
+	if err != nil {
+		return nil, name.Tag{}, err
+	}
+	tag, err := name.NewTag(fmt.Sprintf("%s/%s:%s", regAddr, ref.Path, ref.Tag), name.Insecure)
+	if err != nil {
+		return nil, name.Tag{}, err
 	}
-	return tcpAddr.Port, nil
+	return ref, tag, nil
 }
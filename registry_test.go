@@ -1,29 +1,22 @@
 package main
 
 import (
-	"fmt"
-	"net"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
-)
-
-func TestFindFreePort(t *testing.T) {
-	// Test that findFreePort returns a valid port
-	port, err := findFreePort()
-	if err != nil {
-		t.Fatalf("findFreePort() error = %v", err)
-	}
+	"time"
 
-	if port <= 0 || port > 65535 {
-		t.Errorf("findFreePort() = %d, want valid port range (1-65535)", port)
-	}
+	"github.com/google/go-containerregistry/pkg/registry"
+)
 
-	// Test that the port is actually free
-	testListener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
-	if err != nil {
-		t.Errorf("Port %d returned by findFreePort is not actually free: %v", port, err)
-	} else {
-		testListener.Close()
-	}
+// newTestRegistry starts an in-memory registry and returns its host:port.
+func newTestRegistry(t *testing.T) string {
+	t.Helper()
+	srv := httptest.NewServer(registry.New())
+	t.Cleanup(srv.Close)
+	return strings.TrimPrefix(srv.URL, "http://")
 }
 
 func TestStartRegistry(t *testing.T) {
@@ -39,5 +32,32 @@ func TestStartRegistryCancellation(t *testing.T) {
 		t.Skip("Skipping registry cancellation test in short mode")
 	}
 
-	t.Skip("Registry cancellation test requires complex setup - skipping for now")
+	old := fsRootDirectory
+	fsRootDirectory = t.TempDir()
+	t.Cleanup(func() { fsRootDirectory = old })
+
+	// The registry outlives a cancelled command until stopRegistries.
+	ctx, cancel := context.WithCancel(context.Background())
+	addr, err := startRegistry(ctx, newFilesystemBackend(), "bucket")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	var resp *http.Response
+	for i := 0; ; i++ {
+		if resp, err = http.Get("http://" + addr + "/v2/"); err == nil {
+			break
+		}
+		if i == 100 {
+			t.Fatalf("registry stopped with the command context: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	_ = resp.Body.Close()
+
+	stopRegistries(context.Background())
+	if resp, err := http.Get("http://" + addr + "/v2/"); err == nil {
+		_ = resp.Body.Close()
+		t.Error("registry still serving after stopRegistries")
+	}
 }
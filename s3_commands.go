@@ -16,15 +16,15 @@ var (
 )
 
 var s3PushCmd = &cobra.Command{
-	Use:   "push <bucket>/<image-path>:<tag>",
+	Use:   "push <bucket>/<image-path>:<tag> [<bucket>/<image-path>:<tag>...]",
+	Long:  "Push a Docker image to S3. Further references in the same bucket are tagged after the upload.",
 	Short: "Push a Docker image to S3",
-	Args:  cobra.ExactArgs(1),
+	Args:  cobra.MinimumNArgs(1),
 	PreRunE: func(cmd *cobra.Command, args []string) error {
 		return validateS3Config()
 	},
 	RunE: func(cmd *cobra.Command, args []string) error {
-		localImage, _ := cmd.Flags().GetString("image")
-		return pushImage(cmd.Context(), "s3", args[0], localImage)
+		return pushImage(cmd.Context(), "s3", args, pushOptionsFromFlags(cmd))
 	},
 }
 
@@ -36,7 +36,7 @@ var s3PullCmd = &cobra.Command{
 		return validateS3Config()
 	},
 	RunE: func(cmd *cobra.Command, args []string) error {
-		return pullImage(cmd.Context(), "s3", args[0])
+		return pullImage(cmd.Context(), "s3", args[0], pullOptionsFromFlags(cmd))
 	},
 }
 
@@ -46,17 +46,24 @@ func validateS3Config() error {
 			return errors.New("S3 requires region to be specified via --region or AWS_REGION env var")
 		}
 	}
+	loadS3Credentials()
+	return nil
+}
+
+// loadS3Credentials fills in the S3 keys not given by flag from the
+// environment.
+func loadS3Credentials() {
 	if s3AccessKey == "" {
 		s3AccessKey = strings.TrimSpace(getEnv("AWS_ACCESS_KEY_ID"))
 	}
 	if s3SecretKey == "" {
 		s3SecretKey = strings.TrimSpace(getEnv("AWS_SECRET_ACCESS_KEY"))
 	}
-	return nil
 }
 
 func init() {
 	s3Cmd.AddCommand(s3PushCmd, s3PullCmd)
+	s3Cmd.AddCommand(newStorageCommands("s3", validateS3Config)...)
 
 	s3Cmd.PersistentFlags().StringVarP(&s3Region, "region", "r", "", "AWS region (defaults to AWS_REGION env var)")
 	s3Cmd.PersistentFlags().StringVarP(&s3Endpoint, "endpoint", "e", "", "S3-compatible endpoint (optional)")
@@ -64,5 +71,6 @@ func init() {
 	s3Cmd.PersistentFlags().StringVar(&s3SecretKey, "secret-key", "", "AWS secret key (defaults to AWS_SECRET_ACCESS_KEY env var)")
 	s3Cmd.PersistentFlags().StringVar(&s3RootDirectory, "root-dir", "", "Root directory in S3 bucket (optional)")
 
-	s3PushCmd.Flags().StringP("image", "i", "", "Local Docker image to push (defaults to image-path:tag)")
+	addPushFlags(s3PushCmd)
+	addPullFlags(s3PullCmd)
 }
@@ -95,8 +95,8 @@ func TestS3CommandSetup(t *testing.T) {
 		t.Errorf("s3Cmd.Short = %q, want %q", s3Cmd.Short, "S3 storage operations")
 	}
 
-	if s3PushCmd.Use != "push <bucket>/<image-path>:<tag>" {
-		t.Errorf("s3PushCmd.Use = %q, want %q", s3PushCmd.Use, "push <bucket>/<image-path>:<tag>")
+	if s3PushCmd.Use != "push <bucket>/<image-path>:<tag> [<bucket>/<image-path>:<tag>...]" {
+		t.Errorf("s3PushCmd.Use = %q, want %q", s3PushCmd.Use, "push <bucket>/<image-path>:<tag> [<bucket>/<image-path>:<tag>...]")
 	}
 
 	if s3PullCmd.Use != "pull <bucket>/<image-path>:<tag>" {
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/distribution/distribution/v3/configuration"
+	"github.com/distribution/distribution/v3/registry"
+	"github.com/nbctools/oci-store/pkg/ocistore"
+	"github.com/spf13/cobra"
+)
+
+// ServeOptions holds the flags of the serve commands.
+type ServeOptions struct {
+	Listen string
+	// ReadWrite accepts pushes and deletes. The registry has no
+	// authentication, so anyone who can reach Listen can then write.
+	ReadWrite bool
+	// TLSCert and TLSKey serve HTTPS, which Docker requires of mirrors other
+	// than localhost.
+	TLSCert string
+	TLSKey  string
+	// ProxyRemote makes the registry a pull-through cache of that registry,
+	// keeping what clients pull in the bucket for ProxyTTL after fetching
+	// it, or forever when it is 0.
+	ProxyRemote   string
+	ProxyUsername string
+	ProxyPassword string
+	ProxyTTL      time.Duration
+}
+
+// proxyPassword is the upstream password given by flag or environment, kept
+// for redacting it from the logs.
+var proxyPassword string
+
+func newServeCmd(storageType string, validate func() error) *cobra.Command {
+	var opts ServeOptions
+	cmd := &cobra.Command{
+		Use:   "serve <bucket>",
+		Short: "Serve a bucket as a registry, optionally as a pull-through cache of another registry",
+		Long: `Serve a bucket as a registry until interrupted.
+
+The registry has no authentication and bypasses the bucket's write policy, so
+it listens on localhost and is read-only by default. --read-write accepts
+pushes and deletes from anyone who can reach --listen.
+
+With --proxy-remote the registry is a read-only mirror of the remote registry:
+images pulled through it are fetched from the remote once, stored in the bucket
+and served from there afterwards.`,
+		Args: cobra.ExactArgs(1),
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			if err := validate(); err != nil {
+				return err
+			}
+			if opts.ProxyPassword == "" {
+				opts.ProxyPassword = getEnv("OCI_STORE_PROXY_PASSWORD")
+			}
+			proxyPassword = opts.ProxyPassword
+			return opts.validate()
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return serveBucket(cmd.Context(), storageType, args[0], opts)
+		},
+	}
+	cmd.Flags().StringVar(&opts.Listen, "listen", "127.0.0.1:5000", "Address to listen on, e.g. :5000 for all interfaces")
+	cmd.Flags().BoolVar(&opts.ReadWrite, "read-write", false, "Accept pushes and deletes from any client, without authentication")
+	cmd.Flags().StringVar(&opts.TLSCert, "tls-cert", "", "TLS certificate file, serves HTTPS together with --tls-key")
+	cmd.Flags().StringVar(&opts.TLSKey, "tls-key", "", "TLS private key file")
+	cmd.Flags().StringVar(&opts.ProxyRemote, "proxy-remote", "", "Upstream registry to mirror, e.g. https://registry-1.docker.io")
+	cmd.Flags().StringVar(&opts.ProxyUsername, "proxy-username", "", "Username for the upstream registry")
+	cmd.Flags().StringVar(&opts.ProxyPassword, "proxy-password", "", "Password for the upstream registry (env: OCI_STORE_PROXY_PASSWORD)")
+	cmd.Flags().DurationVar(&opts.ProxyTTL, "proxy-ttl", 7*24*time.Hour, "How long mirrored content is kept after it was fetched, 0 keeps it forever")
+	return cmd
+}
+
+func (o ServeOptions) validate() error {
+	if (o.TLSCert == "") != (o.TLSKey == "") {
+		return invalidf("--tls-cert and --tls-key must be given together")
+	}
+	if o.ProxyRemote != "" && o.ReadWrite {
+		return invalidf("--read-write cannot be used with --proxy-remote, a mirror is read-only")
+	}
+	if o.ProxyRemote == "" {
+		if o.ProxyUsername != "" || o.ProxyPassword != "" {
+			return invalidf("proxy credentials require --proxy-remote")
+		}
+		return nil
+	}
+	u, err := url.Parse(o.ProxyRemote)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return invalidf("invalid --proxy-remote %q, expected an http or https URL", o.ProxyRemote)
+	}
+	if (o.ProxyUsername == "") != (o.ProxyPassword == "") {
+		return invalidf("--proxy-username and --proxy-password must be given together")
+	}
+	if o.ProxyTTL < 0 {
+		return invalidf("--proxy-ttl must not be negative")
+	}
+	return nil
+}
+
+// serveConfig returns the configuration of the registry served by serve.
+func serveConfig(backend StorageBackend, bucket string, opts ServeOptions) (*configuration.Configuration, error) {
+	config, err := registryConfig(backend, bucket, opts.Listen)
+	if err != nil {
+		return nil, err
+	}
+	// Unlike the embedded registries, this one is long-lived and shared, so
+	// its errors are worth logging.
+	if !verbose {
+		config.Log.Level = configuration.Loglevel("error")
+	}
+	config.HTTP.TLS.Certificate = opts.TLSCert
+	config.HTTP.TLS.Key = opts.TLSKey
+	if !opts.ReadWrite {
+		config.Storage["maintenance"]["readonly"] = map[interface{}]interface{}{"enabled": true}
+	}
+	if opts.ProxyRemote != "" {
+		ttl := opts.ProxyTTL
+		config.Proxy = configuration.Proxy{
+			RemoteURL: opts.ProxyRemote,
+			Username:  opts.ProxyUsername,
+			Password:  opts.ProxyPassword,
+			TTL:       &ttl,
+		}
+	}
+	return config, nil
+}
+
+// serveBucket serves bucket until ctx is cancelled, then waits for the
+// requests in flight.
+func serveBucket(ctx context.Context, storageType string, bucket string, opts ServeOptions) error {
+	backend, err := NewBackend(storageType)
+	if err != nil {
+		return err
+	}
+	if err := backend.ValidateConfig(); err != nil {
+		return err
+	}
+	// The registry's context outlives the interrupt, so requests in flight
+	// can finish during the shutdown.
+	config, err := serveConfig(backend, bucket, opts)
+	if err != nil {
+		return err
+	}
+	var reg *registry.Registry
+	err = newRegistry(ctx, func() (err error) {
+		reg, err = ocistore.NewRegistry(context.WithoutCancel(ctx), config)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	served := make(chan error, 1)
+	go func() { served <- reg.ListenAndServe() }()
+	slog.Info("Serving bucket", "bucket", bucket, "addr", opts.Listen, "read_write", opts.ReadWrite, "proxy_remote", opts.ProxyRemote)
+
+	select {
+	case err := <-served:
+		return err
+	case <-ctx.Done():
+	}
+	shutdownCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 10*time.Second)
+	defer cancel()
+	if err := reg.Shutdown(shutdownCtx); err != nil {
+		return err
+	}
+	if err := <-served; err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	slog.Info("Stopped serving bucket", "bucket", bucket)
+	return nil
+}
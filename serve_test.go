@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+func TestServeProxy(t *testing.T) {
+	upstream := newTestRegistry(t)
+	img, _ := random.Image(1024, 2)
+	ref, _ := name.ParseReference(upstream + "/library/app:v1")
+	if err := remote.Write(ref, img); err != nil {
+		t.Fatal(err)
+	}
+	digest, _ := img.Digest()
+
+	old := fsRootDirectory
+	fsRootDirectory = t.TempDir()
+	t.Cleanup(func() { fsRootDirectory = old })
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	_ = l.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() {
+		served <- serveBucket(ctx, "filesystem", "bucket", ServeOptions{Listen: addr, ProxyRemote: "http://" + upstream, ProxyTTL: time.Hour})
+	}()
+	waitForRegistry(t, addr)
+
+	ref, _ = name.ParseReference(addr+"/library/app:v1", name.Insecure)
+	pulled, err := remote.Image(ref)
+	if err != nil {
+		t.Fatalf("pulling through the proxy: %v", err)
+	}
+	if got, _ := pulled.Digest(); got != digest {
+		t.Errorf("proxy served %s, want %s", got, digest)
+	}
+	if _, err := pulled.ConfigFile(); err != nil {
+		t.Fatal(err)
+	}
+	layers, _ := pulled.Layers()
+	for _, l := range layers {
+		readLayer(t, l)
+	}
+
+	cancel()
+	if err := <-served; err != nil {
+		t.Fatalf("serveBucket() error = %v", err)
+	}
+
+	// The bucket now holds the image without the upstream.
+	reg, err := openStorageRegistry(context.Background(), "filesystem", "bucket")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { stopRegistries(context.Background()) })
+	waitForRegistry(t, reg.RegistryStr())
+	cached, err := remote.Image(reg.Repo("library", "app").Digest(digest.String()))
+	if err != nil {
+		t.Fatalf("image not stored in the bucket: %v", err)
+	}
+	layers, _ = cached.Layers()
+	for _, l := range layers {
+		readLayer(t, l)
+	}
+}
+
+func TestServeReadOnly(t *testing.T) {
+	old := fsRootDirectory
+	fsRootDirectory = t.TempDir()
+	t.Cleanup(func() { fsRootDirectory = old })
+	img, _ := random.Image(512, 1)
+
+	serve := func(opts ServeOptions) (string, func()) {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		opts.Listen = l.Addr().String()
+		_ = l.Close()
+		ctx, cancel := context.WithCancel(context.Background())
+		served := make(chan error, 1)
+		go func() { served <- serveBucket(ctx, "filesystem", "bucket", opts) }()
+		waitForRegistry(t, opts.Listen)
+		return opts.Listen, func() {
+			cancel()
+			if err := <-served; err != nil {
+				t.Errorf("serveBucket() error = %v", err)
+			}
+		}
+	}
+
+	addr, stop := serve(ServeOptions{})
+	ref, _ := name.NewTag(addr+"/app:v1", name.Insecure)
+	if err := remote.Write(ref, img); err == nil {
+		t.Error("pushing to a read-only registry succeeded")
+	}
+	stop()
+
+	addr, stop = serve(ServeOptions{ReadWrite: true})
+	ref, _ = name.NewTag(addr+"/app:v1", name.Insecure)
+	if err := remote.Write(ref, img); err != nil {
+		t.Errorf("pushing with --read-write: %v", err)
+	}
+	stop()
+
+	// The pushed image can still be pulled from the read-only registry.
+	addr, stop = serve(ServeOptions{})
+	ref, _ = name.NewTag(addr+"/app:v1", name.Insecure)
+	if _, err := remote.Head(ref); err != nil {
+		t.Errorf("pulling from a read-only registry: %v", err)
+	}
+	stop()
+}
+
+func TestServeOptionsValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		opts    ServeOptions
+		wantErr bool
+	}{
+		{"plain", ServeOptions{}, false},
+		{"proxy", ServeOptions{ProxyRemote: "https://registry-1.docker.io"}, false},
+		{"credentials", ServeOptions{ProxyRemote: "https://registry-1.docker.io", ProxyUsername: "me", ProxyPassword: "secret"}, false},
+		{"not a url", ServeOptions{ProxyRemote: "registry-1.docker.io"}, true},
+		{"username only", ServeOptions{ProxyRemote: "https://registry-1.docker.io", ProxyUsername: "me"}, true},
+		{"credentials without proxy", ServeOptions{ProxyUsername: "me", ProxyPassword: "secret"}, true},
+		{"negative ttl", ServeOptions{ProxyRemote: "https://registry-1.docker.io", ProxyTTL: -time.Hour}, true},
+		{"cert without key", ServeOptions{TLSCert: "cert.pem"}, true},
+		{"read-write", ServeOptions{ReadWrite: true}, false},
+		{"read-write proxy", ServeOptions{ProxyRemote: "https://registry-1.docker.io", ReadWrite: true}, true},
+	}
+	for _, tt := range tests {
+		err := tt.opts.validate()
+		if (err != nil) != tt.wantErr || (err != nil && exitCode(err) != exitValidation) {
+			t.Errorf("%s: validate() = %v, wantErr %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	"github.com/google/go-containerregistry/pkg/v1/static"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/secure-systems-lab/go-securesystemslib/encrypted"
+	"github.com/spf13/cobra"
+)
+
+// Media type, annotation and payload type used by cosign, so that signatures
+// written here can be checked with `cosign verify --key` and vice versa.
+const (
+	cosignPayloadMediaType    = "application/vnd.dev.cosign.simplesigning.v1+json"
+	cosignSignatureAnnotation = "dev.cosignproject.cosign/signature"
+	cosignSignatureType       = "cosign container image signature"
+)
+
+// simpleSigningPayload is the "simple signing" document that cosign signs.
+type simpleSigningPayload struct {
+	Critical struct {
+		Identity struct {
+			DockerReference string `json:"docker-reference"`
+		} `json:"identity"`
+		Image struct {
+			DockerManifestDigest string `json:"docker-manifest-digest"`
+		} `json:"image"`
+		Type string `json:"type"`
+	} `json:"critical"`
+	Optional map[string]interface{} `json:"optional"`
+}
+
+func newSignCmd(storageType string, validate func() error) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "sign " + refUsage(storageType),
+		Short: "Sign a stored image with a local key",
+		Long: `Sign a stored image with a local cosign-compatible key. The signature is
+stored next to the image under the sha256-<digest>.sig tag. Encrypted keys are
+decrypted with the COSIGN_PASSWORD env var.`,
+		Args: cobra.ExactArgs(1),
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			return validate()
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			keyPath, _ := cmd.Flags().GetString("key")
+			policyFile, _ := cmd.Flags().GetString("policy")
+			return signImage(cmd.Context(), storageType, args[0], keyPath, policyFile)
+		},
+	}
+	cmd.Flags().String("key", "", "Private key used to sign the image (e.g. cosign.key)")
+	cmd.Flags().String("policy", "", "Local policy file enforced in addition to the bucket policy")
+	_ = cmd.MarkFlagRequired("key")
+	return cmd
+}
+
+func signImage(ctx context.Context, storageType string, storageRef string, keyPath string, policyFile string) error {
+	key, err := loadSigningKey(keyPath)
+	if err != nil {
+		return err
+	}
+
+	ref, target, err := openStorageRef(ctx, storageType, storageRef)
+	if err != nil {
+		return err
+	}
+	// The signature tag is written next to the image, in its repository.
+	policies, err := loadPolicies(ctx, storageType, ref.Bucket, policyFile)
+	if err != nil {
+		return err
+	}
+	if err := policies.CheckRepository(target.RepositoryStr()); err != nil {
+		return err
+	}
+	sigTag, err := writeSignature(ctx, target, ref.Bucket+"/"+ref.Path, key)
+	if err != nil {
+		return err
+	}
+	slog.Info("Image signed", "image", storageRef, "signature", sigTag.TagStr())
+	return nil
+}
+
+// writeSignature signs the manifest behind target and stores the signature
+// under its cosign .sig tag. Signing the same image again adds a layer to the
+// existing signature manifest.
+func writeSignature(ctx context.Context, target name.Tag, identity string, key crypto.Signer) (name.Tag, error) {
+	desc, err := remote.Head(target, remote.WithContext(ctx), withRegistryTransport())
+	if err != nil {
+		return name.Tag{}, fmt.Errorf("failed to resolve %s: %w", target, err)
+	}
+
+	var payload simpleSigningPayload
+	payload.Critical.Identity.DockerReference = identity
+	payload.Critical.Image.DockerManifestDigest = desc.Digest.String()
+	payload.Critical.Type = cosignSignatureType
+	rawPayload, err := json.Marshal(payload)
+	if err != nil {
+		return name.Tag{}, err
+	}
+	sig, err := signPayload(key, rawPayload)
+	if err != nil {
+		return name.Tag{}, fmt.Errorf("failed to sign payload: %w", err)
+	}
+
+	sigTag := signatureTag(target.Repository, desc.Digest)
+	sigImg, err := remote.Image(sigTag, remote.WithContext(ctx), withRegistryTransport())
+	if isNotFound(err) {
+		sigImg = mutate.ConfigMediaType(mutate.MediaType(empty.Image, types.OCIManifestSchema1), types.OCIConfigJSON)
+	} else if err != nil {
+		return name.Tag{}, err
+	}
+	sigImg, err = mutate.Append(sigImg, mutate.Addendum{
+		Layer:       static.NewLayer(rawPayload, cosignPayloadMediaType),
+		Annotations: map[string]string{cosignSignatureAnnotation: base64.StdEncoding.EncodeToString(sig)},
+	})
+	if err != nil {
+		return name.Tag{}, err
+	}
+	if err := remote.Write(sigTag, sigImg, remote.WithContext(ctx), withRegistryTransport()); err != nil {
+		return name.Tag{}, fmt.Errorf("failed to write signature: %w", err)
+	}
+	return sigTag, nil
+}
+
+// verifyImageSignature checks that img has at least one signature in repo that
+// verifies against the public key at keyPath and covers img's digest.
+func verifyImageSignature(ctx context.Context, repo name.Repository, img v1.Image, keyPath string) error {
+	pub, err := loadVerificationKey(keyPath)
+	if err != nil {
+		return err
+	}
+	imgDigest, err := img.Digest()
+	if err != nil {
+		return err
+	}
+
+	sigImg, err := remote.Image(signatureTag(repo, imgDigest), remote.WithContext(ctx), withRegistryTransport())
+	if isNotFound(err) {
+		return fmt.Errorf("image %s is not signed", imgDigest)
+	} else if err != nil {
+		return err
+	}
+	manifest, err := sigImg.Manifest()
+	if err != nil {
+		return err
+	}
+	for _, desc := range manifest.Layers {
+		if desc.MediaType != cosignPayloadMediaType {
+			continue
+		}
+		sig, err := base64.StdEncoding.DecodeString(desc.Annotations[cosignSignatureAnnotation])
+		if err != nil {
+			continue
+		}
+		rawPayload, err := readLayerBlob(sigImg, desc.Digest)
+		if err != nil {
+			return err
+		}
+		if err := verifyPayload(pub, rawPayload, sig); err != nil {
+			slog.Debug("Signature does not verify", "layer", desc.Digest.String(), "error", err)
+			continue
+		}
+		var payload simpleSigningPayload
+		if err := json.Unmarshal(rawPayload, &payload); err != nil {
+			continue
+		}
+		if payload.Critical.Image.DockerManifestDigest == imgDigest.String() {
+			slog.Info("Signature verified", "digest", imgDigest.String())
+			return nil
+		}
+	}
+	return fmt.Errorf("no valid signature found for image %s", imgDigest)
+}
+
+// signatureTag returns the cosign tag for the signatures of digest h.
+func signatureTag(repo name.Repository, h v1.Hash) name.Tag {
+	return repo.Tag(fmt.Sprintf("%s-%s.sig", h.Algorithm, h.Hex))
+}
+
+func readLayerBlob(img v1.Image, h v1.Hash) ([]byte, error) {
+	layer, err := img.LayerByDigest(h)
+	if err != nil {
+		return nil, err
+	}
+	rc, err := layer.Compressed()
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = rc.Close() }()
+	return io.ReadAll(rc)
+}
+
+func isNotFound(err error) bool {
+	var terr *transport.Error
+	return errors.As(err, &terr) && terr.StatusCode == http.StatusNotFound
+}
+
+func signPayload(key crypto.Signer, payload []byte) ([]byte, error) {
+	if _, ok := key.Public().(ed25519.PublicKey); ok {
+		return key.Sign(rand.Reader, payload, crypto.Hash(0))
+	}
+	h := sha256.Sum256(payload)
+	return key.Sign(rand.Reader, h[:], crypto.SHA256)
+}
+
+func verifyPayload(pub crypto.PublicKey, payload []byte, sig []byte) error {
+	h := sha256.Sum256(payload)
+	switch k := pub.(type) {
+	case *ecdsa.PublicKey:
+		if !ecdsa.VerifyASN1(k, h[:], sig) {
+			return errors.New("invalid ECDSA signature")
+		}
+		return nil
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(k, crypto.SHA256, h[:], sig)
+	case ed25519.PublicKey:
+		if !ed25519.Verify(k, payload, sig) {
+			return errors.New("invalid ed25519 signature")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported public key type %T", pub)
+	}
+}
+
+// loadSigningKey reads a PEM private key. Cosign's encrypted key format is
+// decrypted with the COSIGN_PASSWORD env var.
+func loadSigningKey(path string) (crypto.Signer, error) {
+	block, err := readPEMFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var key interface{}
+	switch block.Type {
+	case "ENCRYPTED SIGSTORE PRIVATE KEY", "ENCRYPTED COSIGN PRIVATE KEY":
+		der, derr := encrypted.Decrypt(block.Bytes, []byte(getEnv("COSIGN_PASSWORD")))
+		if derr != nil {
+			return nil, fmt.Errorf("failed to decrypt %s (check COSIGN_PASSWORD): %w", path, derr)
+		}
+		key, err = x509.ParsePKCS8PrivateKey(der)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unsupported private key type %q in %s", block.Type, path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse private key %s: %w", path, err)
+	}
+
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("key in %s cannot be used for signing", path)
+	}
+	return signer, nil
+}
+
+func loadVerificationKey(path string) (crypto.PublicKey, error) {
+	block, err := readPEMFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if block.Type != "PUBLIC KEY" {
+		return nil, fmt.Errorf("expected a PUBLIC KEY in %s, got %q", path, block.Type)
+	}
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse public key %s: %w", path, err)
+	}
+	return pub, nil
+}
+
+func readPEMFile(path string) (*pem.Block, error) {
+	data, err := os.ReadFile(filepath.Clean(path))
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found in %s", path)
+	}
+	return block, nil
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/secure-systems-lab/go-securesystemslib/encrypted"
+)
+
+func writePEM(t *testing.T, path string, typ string, der []byte) {
+	t.Helper()
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func writePublicKey(t *testing.T, path string, pub crypto.PublicKey) {
+	t.Helper()
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writePEM(t, path, "PUBLIC KEY", der)
+}
+
+func TestSignVerifyPayload(t *testing.T) {
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+
+	tests := []struct {
+		name string
+		key  crypto.Signer
+	}{
+		{name: "ecdsa", key: ecKey},
+		{name: "rsa", key: rsaKey},
+		{name: "ed25519", key: edKey},
+	}
+
+	payload := []byte(`{"critical":{}}`)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sig, err := signPayload(tt.key, payload)
+			if err != nil {
+				t.Fatalf("signPayload() error = %v", err)
+			}
+			if err := verifyPayload(tt.key.Public(), payload, sig); err != nil {
+				t.Errorf("verifyPayload() error = %v", err)
+			}
+			if err := verifyPayload(tt.key.Public(), []byte(`{"critical":{"x":1}}`), sig); err == nil {
+				t.Error("verifyPayload() should fail for a tampered payload")
+			}
+		})
+	}
+}
+
+func TestLoadSigningKey(t *testing.T) {
+	dir := t.TempDir()
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	der, _ := x509.MarshalPKCS8PrivateKey(key)
+
+	plainPath := filepath.Join(dir, "plain.key")
+	writePEM(t, plainPath, "PRIVATE KEY", der)
+	if _, err := loadSigningKey(plainPath); err != nil {
+		t.Errorf("loadSigningKey() plain key error = %v", err)
+	}
+
+	enc, err := encrypted.Encrypt(der, []byte("s3cret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cosignPath := filepath.Join(dir, "cosign.key")
+	writePEM(t, cosignPath, "ENCRYPTED SIGSTORE PRIVATE KEY", enc)
+
+	t.Setenv("COSIGN_PASSWORD", "wrong")
+	if _, err := loadSigningKey(cosignPath); err == nil {
+		t.Error("loadSigningKey() should fail with the wrong COSIGN_PASSWORD")
+	}
+	t.Setenv("COSIGN_PASSWORD", "s3cret")
+	if _, err := loadSigningKey(cosignPath); err != nil {
+		t.Errorf("loadSigningKey() cosign key error = %v", err)
+	}
+}
+
+func TestWriteAndVerifySignature(t *testing.T) {
+	ctx := context.Background()
+	host := newTestRegistry(t)
+
+	img, _ := random.Image(512, 1)
+	target, _ := name.NewTag(host+"/app:v1", name.Insecure)
+	if err := remote.Write(target, img); err != nil {
+		t.Fatalf("remote.Write() error = %v", err)
+	}
+
+	dir := t.TempDir()
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	pubPath := filepath.Join(dir, "cosign.pub")
+	writePublicKey(t, pubPath, key.Public())
+
+	if err := verifyImageSignature(ctx, target.Repository, img, pubPath); err == nil {
+		t.Error("verifyImageSignature() should fail for an unsigned image")
+	}
+
+	if _, err := writeSignature(ctx, target, "bucket/app", key); err != nil {
+		t.Fatalf("writeSignature() error = %v", err)
+	}
+	if err := verifyImageSignature(ctx, target.Repository, img, pubPath); err != nil {
+		t.Errorf("verifyImageSignature() error = %v", err)
+	}
+
+	otherKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	otherPath := filepath.Join(dir, "other.pub")
+	writePublicKey(t, otherPath, otherKey.Public())
+	if err := verifyImageSignature(ctx, target.Repository, img, otherPath); err == nil {
+		t.Error("verifyImageSignature() should fail with a different public key")
+	}
+
+	// A different image pushed under the same tag is not covered by the signature.
+	tampered, _ := random.Image(512, 1)
+	if err := remote.Write(target, tampered); err != nil {
+		t.Fatal(err)
+	}
+	if err := verifyImageSignature(ctx, target.Repository, tampered, pubPath); err == nil {
+		t.Error("verifyImageSignature() should fail for a tampered image")
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// errInterrupted is the cause of a context cancelled by SIGINT or SIGTERM.
+var errInterrupted = errors.New("interrupted")
+
+// withInterrupt returns a context cancelled by the first SIGINT or SIGTERM,
+// so the running command stops its transfers and cleans up after itself. A
+// second signal exits at once. stop releases the signal handler and cancels
+// the context.
+func withInterrupt(parent context.Context) (ctx context.Context, stop func()) {
+	ctx, cancel := context.WithCancelCause(parent)
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	done := make(chan struct{})
+
+	go func() {
+		select {
+		case sig := <-signals:
+			slog.Warn("Interrupted, cancelling the command", "signal", signalName(sig))
+			cancel(fmt.Errorf("%w by %s", errInterrupted, signalName(sig)))
+		case <-done:
+			return
+		}
+		select {
+		case sig := <-signals:
+			slog.Error("Interrupted again, exiting without cleaning up", "signal", signalName(sig))
+			os.Exit(exitInterrupted)
+		case <-done:
+		}
+	}()
+
+	return ctx, func() {
+		signal.Stop(signals)
+		close(done)
+		cancel(nil)
+	}
+}
+
+func signalName(sig os.Signal) string {
+	if sig == os.Interrupt {
+		return "SIGINT"
+	}
+	if sig == syscall.SIGTERM {
+		return "SIGTERM"
+	}
+	return sig.String()
+}
+
+// interruptedError marks err as caused by the interruption of ctx, if any.
+// Cancelled requests fail with all kinds of errors, which would otherwise be
+// reported as network or storage failures.
+func interruptedError(ctx context.Context, err error) error {
+	cause := context.Cause(ctx)
+	if err == nil || !errors.Is(cause, errInterrupted) || errors.Is(err, errInterrupted) {
+		return err
+	}
+	return fmt.Errorf("%w: %w", cause, err)
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestWithInterrupt(t *testing.T) {
+	ctx, stop := withInterrupt(context.Background())
+	defer stop()
+
+	if err := syscall.Kill(syscall.Getpid(), syscall.SIGTERM); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-ctx.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("SIGTERM did not cancel the context")
+	}
+	if !errors.Is(context.Cause(ctx), errInterrupted) {
+		t.Errorf("cause = %v, want errInterrupted", context.Cause(ctx))
+	}
+
+	err := interruptedError(ctx, errors.New("failed to upload layers: context canceled"))
+	if exitCode(err) != exitInterrupted || err.Error() != "interrupted by SIGTERM: failed to upload layers: context canceled" {
+		t.Errorf("interruptedError() = %v with exit code %d", err, exitCode(err))
+	}
+	if err := interruptedError(ctx, nil); err != nil {
+		t.Errorf("interruptedError(nil) = %v", err)
+	}
+}
+
+func TestInterruptedErrorWithoutSignal(t *testing.T) {
+	ctx, stop := withInterrupt(context.Background())
+	stop()
+	if err := interruptedError(ctx, errors.New("boom")); exitCode(err) != exitFailure {
+		t.Errorf("interruptedError() after stop = %v, want the error unchanged", err)
+	}
+}
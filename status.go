@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/daemon"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/spf13/cobra"
+)
+
+const (
+	statusNotStored = "not-stored"
+	statusUpToDate  = "up-to-date"
+	statusDiffers   = "differs"
+)
+
+// StatusResult is the result of status printed with --output json.
+type StatusResult struct {
+	Ref          string `json:"ref"`
+	Image        string `json:"image"`
+	ImageID      string `json:"imageId"`
+	State        string `json:"state"`
+	StoredDigest string `json:"storedDigest,omitempty"`
+}
+
+func newStatusCmd(storageType string, validate func() error) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "status " + refUsage(storageType),
+		Short: "Check whether a stored tag holds the local image",
+		Args:  cobra.ExactArgs(1),
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			return validate()
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			localImage, _ := cmd.Flags().GetString("image")
+			return imageStatus(cmd.Context(), storageType, args[0], localImage)
+		},
+	}
+	cmd.Flags().StringP("image", "i", "", "Local Docker image to compare (defaults to image-path:tag)")
+	return cmd
+}
+
+func imageStatus(ctx context.Context, storageType string, storageRef string, localImage string) error {
+	if localImage == "" {
+		localImage = storageRef
+	}
+	localRef, err := name.ParseReference(localImage)
+	if err != nil {
+		return err
+	}
+	img, err := daemon.Image(localRef)
+	if err != nil {
+		return fmt.Errorf("failed to load image '%s' from local Docker daemon: %w", localImage, err)
+	}
+	id, err := img.ConfigName()
+	if err != nil {
+		return err
+	}
+
+	_, target, err := openStorageRef(ctx, storageType, storageRef)
+	if err != nil {
+		return err
+	}
+	result := StatusResult{Ref: storageRef, Image: localImage, ImageID: id.String()}
+	desc, err := remote.Get(target, remote.WithContext(ctx), withRegistryTransport())
+	switch {
+	case isNotFound(err):
+		result.State = statusNotStored
+	case err != nil:
+		return fmt.Errorf("failed to fetch %s: %w", storageRef, err)
+	case storedImageMatches(desc, id):
+		result.State, result.StoredDigest = statusUpToDate, desc.Digest.String()
+	default:
+		result.State, result.StoredDigest = statusDiffers, desc.Digest.String()
+	}
+	return printResult(result, func(w io.Writer) error {
+		var err error
+		switch result.State {
+		case statusNotStored:
+			_, err = fmt.Fprintf(w, "%s: not stored\n", storageRef)
+		case statusUpToDate:
+			_, err = fmt.Fprintf(w, "%s: up to date with %s (%s)\n", storageRef, localImage, desc.Digest)
+		default:
+			_, err = fmt.Fprintf(w, "%s: differs from %s (stored %s, local image %s)\n", storageRef, localImage, desc.Digest, id)
+		}
+		return err
+	})
+}
+
+// storedImageMatches reports whether a stored manifest holds the image with
+// the given ID. Docker reports the config digest as image ID, or the manifest
+// digest when it uses the containerd image store. The config digest does not
+// depend on how layers were compressed or encrypted on push.
+func storedImageMatches(desc *remote.Descriptor, id v1.Hash) bool {
+	if desc.Digest == id {
+		return true
+	}
+	if !desc.MediaType.IsImage() {
+		return false
+	}
+	manifest, err := v1.ParseManifest(bytes.NewReader(desc.Manifest))
+	if err != nil {
+		return false
+	}
+	return manifest.Config.Digest == id
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+func TestCheckDestinations(t *testing.T) {
+	host := newTestRegistry(t)
+	stored, _ := random.Image(256, 1)
+	other, _ := random.Image(256, 1)
+	tag := func(s string) name.Tag {
+		tag, _ := name.NewTag(host+"/app:"+s, name.Insecure)
+		return tag
+	}
+	if err := remote.Write(tag("v1"), stored); err != nil {
+		t.Fatal(err)
+	}
+	never := func(name.Tag) bool { return false }
+	always := func(name.Tag) bool { return true }
+
+	desc, err := checkDestinations(context.Background(), []name.Tag{tag("v1")}, stored, never)
+	if err != nil || desc == nil {
+		t.Fatalf("checkDestinations() = %v, %v, want the stored descriptor", desc, err)
+	}
+	id, _ := stored.ConfigName()
+	if !storedImageMatches(desc, id) {
+		t.Error("storedImageMatches() = false for the stored image")
+	}
+	if digest, _ := stored.Digest(); !storedImageMatches(desc, digest) {
+		t.Error("storedImageMatches() = false for the manifest digest")
+	}
+
+	if desc, err := checkDestinations(context.Background(), []name.Tag{tag("v1")}, other, never); err != nil || desc != nil {
+		t.Errorf("checkDestinations() for a changed image = %v, %v, want nil, nil", desc, err)
+	}
+	if _, err := checkDestinations(context.Background(), []name.Tag{tag("v1")}, other, always); err == nil {
+		t.Error("checkDestinations() for protected tags should refuse to overwrite a different image")
+	}
+	if desc, err := checkDestinations(context.Background(), []name.Tag{tag("v2"), tag("v1")}, stored, always); err != nil || desc != nil {
+		t.Errorf("checkDestinations() for a new tag = %v, %v, want nil, nil", desc, err)
+	}
+	if _, err := checkDestinations(context.Background(), []name.Tag{tag("v2"), tag("v1")}, other, always); err == nil {
+		t.Error("checkDestinations() for protected tags should check additional tags")
+	}
+}
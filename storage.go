@@ -1,38 +1,19 @@
 package main
 
-import (
-	"fmt"
-	"strings"
-)
-
-type StorageRef struct {
-	Bucket string
-	Path   string
-	Tag    string
-	Type   string
-}
+import "github.com/nbctools/oci-store/pkg/ocistore"
 
-type StorageBackend interface {
-	Type() string
-	ParseRef(ref string) (*StorageRef, error)
-	GetStorageConfig(bucket string) map[string]interface{}
-	ValidateConfig() error
-}
+type (
+	StorageRef     = ocistore.StorageRef
+	StorageBackend = ocistore.StorageBackend
+)
 
-func ParseStorageRef(ref string, storageType string) (*StorageRef, error) {
-	bucket, pathTag, ok := strings.Cut(ref, "/")
-	if !ok {
-		return nil, fmt.Errorf("invalid %s reference format, expected: bucket/path:tag", storageType)
-	}
-	path, tag, ok := strings.Cut(pathTag, ":")
-	if !ok {
-		return nil, fmt.Errorf("missing tag in reference")
+// refUsage returns the reference placeholder shown in command usage lines.
+func refUsage(storageType string) string {
+	switch storageType {
+	case "azure":
+		return "<container>/<image-path>:<tag>"
+	case "filesystem":
+		return "<dir>/<image-path>:<tag>"
 	}
-
-	return &StorageRef{
-		Bucket: bucket,
-		Path:   path,
-		Tag:    tag,
-		Type:   storageType,
-	}, nil
+	return "<bucket>/<image-path>:<tag>"
 }
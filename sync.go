@@ -0,0 +1,528 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/nbctools/oci-store/pkg/ocistore"
+	"github.com/spf13/cobra"
+	"golang.org/x/sync/errgroup"
+)
+
+// SyncResult is the result of sync. The repositories are those of the
+// destination.
+type SyncResult struct {
+	Source      string      `json:"source"`
+	Destination string      `json:"destination"`
+	DryRun      bool        `json:"dryRun"`
+	Copied      []SyncedTag `json:"copied"`
+	Deleted     []SyncedTag `json:"deleted"`
+	Unchanged   int         `json:"unchanged"`
+	// Skipped counts the changed tags left out by --since.
+	Skipped         int          `json:"skipped"`
+	Refused         []RefusedTag `json:"refused"`
+	DurationSeconds float64      `json:"durationSeconds"`
+}
+
+// SyncedTag is a tag copied or deleted by sync.
+type SyncedTag struct {
+	Repository string `json:"repository"`
+	Tag        string `json:"tag"`
+	Digest     string `json:"digest"`
+}
+
+// RefusedTag is a tag sync left alone because the policy of the destination
+// forbids copying or deleting it.
+type RefusedTag struct {
+	Repository string `json:"repository"`
+	Tag        string `json:"tag"`
+	Digest     string `json:"digest"`
+	Reason     string `json:"reason"`
+}
+
+// SyncOptions holds the flags of sync.
+type SyncOptions struct {
+	Include     []string
+	Since       time.Duration
+	Delete      bool
+	DryRun      bool
+	Jobs        int
+	PolicyFile  string
+	Source      SyncSide
+	Destination SyncSide
+	Transfer    ocistore.TransferOptions
+}
+
+// SyncSide holds the storage flags of one side of a sync. Credentials come
+// from the environment variables of each backend.
+type SyncSide struct {
+	Region   string
+	Endpoint string
+	RootDir  string
+}
+
+// syncLocation is one side of a sync, given as <type>://<bucket>/<prefix>.
+type syncLocation struct {
+	backend StorageBackend
+	bucket  string
+	prefix  string
+}
+
+// syncTag is a tag found by sync, in a repository relative to the prefix.
+type syncTag struct {
+	repo     string
+	tag      string
+	digest   v1.Hash
+	modified time.Time
+}
+
+func (t syncTag) key() string {
+	return t.repo + ":" + t.tag
+}
+
+// syncPlan is what sync changes in the destination.
+type syncPlan struct {
+	copy      []syncTag
+	delete    []syncTag
+	refused   []RefusedTag
+	unchanged int
+	skipped   int
+}
+
+func newSyncCmd() *cobra.Command {
+	var opts SyncOptions
+	var since string
+	cmd := &cobra.Command{
+		Use:   "sync <source> <destination>",
+		Short: "Copy new and changed tags from one bucket to another",
+		Long: `Copy the tags of the source that the destination lacks or holds a different
+image for, with only the blobs the destination is missing. Locations are given
+as <type>://<bucket>/<prefix>, where type is s3, gcs, azure or filesystem and the
+prefix selects the repositories below it, e.g. s3://src-bucket/team/.
+
+Tags are compared in the storage itself, so a sync with nothing to copy does not
+transfer any image data.
+
+The write policy of the destination bucket applies: tags it forbids to copy or
+delete are left alone and reported, and sync fails once the rest is done. The
+size limit is checked when an image is copied, so --dry-run does not report it.`,
+		Args: cobra.ExactArgs(2),
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			var err error
+			if since != "" {
+				if opts.Since, err = parseAge(since); err != nil {
+					return err
+				}
+			}
+			opts.Transfer = transferOptionsFromFlags(cmd)
+			return opts.validate()
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return syncBuckets(cmd.Context(), args[0], args[1], opts)
+		},
+	}
+	cmd.Flags().StringArrayVar(&opts.Include, "include", nil, "Only sync repositories matching this glob pattern, relative to the prefix (repeatable)")
+	cmd.Flags().StringVar(&since, "since", "", "Only copy tags changed in the source within this time, e.g. 7d or 12h")
+	cmd.Flags().BoolVar(&opts.Delete, "delete", false, "Delete destination tags that are not in the source")
+	cmd.Flags().BoolVar(&opts.DryRun, "dry-run", false, "Only print the plan")
+	cmd.Flags().IntVar(&opts.Jobs, "jobs", 4, "Number of tags copied concurrently")
+	cmd.Flags().StringVar(&opts.PolicyFile, "policy", "", "Local policy file enforced in addition to the destination bucket policy")
+	cmd.Flags().StringVar(&opts.Source.Region, "src-region", "", "AWS region of an S3 source (defaults to AWS_REGION env var)")
+	cmd.Flags().StringVar(&opts.Source.Endpoint, "src-endpoint", "", "S3-compatible endpoint of the source (optional)")
+	cmd.Flags().StringVar(&opts.Source.RootDir, "src-root-dir", "", "Root directory of the source storage")
+	cmd.Flags().StringVar(&opts.Destination.Region, "dst-region", "", "AWS region of an S3 destination (defaults to AWS_REGION env var)")
+	cmd.Flags().StringVar(&opts.Destination.Endpoint, "dst-endpoint", "", "S3-compatible endpoint of the destination (optional)")
+	cmd.Flags().StringVar(&opts.Destination.RootDir, "dst-root-dir", "", "Root directory of the destination storage")
+	addTransferFlags(cmd)
+	return cmd
+}
+
+func (o SyncOptions) validate() error {
+	for _, pattern := range o.Include {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return invalidf("invalid --include pattern %q: %v", pattern, err)
+		}
+	}
+	if o.Jobs < 1 {
+		return invalidf("--jobs must be at least 1")
+	}
+	return o.Transfer.Validate()
+}
+
+// parseAge parses a duration that may also be given in days, e.g. 7d.
+func parseAge(s string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n < 0 {
+			return 0, invalidf("invalid duration %q", s)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		return 0, invalidf("invalid duration %q", s)
+	}
+	return d, nil
+}
+
+// parseSyncLocation parses a <type>://<bucket>/<prefix> location and sets
+// up its backend with the flags of side.
+func parseSyncLocation(location string, side SyncSide) (*syncLocation, error) {
+	storageType, rest, ok := strings.Cut(location, "://")
+	bucket, prefix, _ := strings.Cut(rest, "/")
+	if !ok || bucket == "" {
+		return nil, invalidf("invalid location %q, expected <type>://<bucket>/<prefix>", location)
+	}
+	if storageType != "s3" && (side.Region != "" || side.Endpoint != "") {
+		return nil, invalidf("region and endpoint only apply to S3 locations, not %s", location)
+	}
+	switch storageType {
+	case "s3":
+		loadS3Credentials()
+	case "gcs":
+		if err := validateGCSConfig(); err != nil {
+			return nil, invalid(err)
+		}
+	case "azure":
+		if err := validateAzureConfig(); err != nil {
+			return nil, invalid(err)
+		}
+	}
+	backend, err := NewBackend(storageType)
+	if err != nil {
+		return nil, invalid(err)
+	}
+	switch b := backend.(type) {
+	case *S3Backend:
+		b.Region = cmp.Or(side.Region, getEnv("AWS_REGION"))
+		b.Endpoint, b.RootDir = side.Endpoint, side.RootDir
+	case *GCSBackend:
+		b.RootDir = side.RootDir
+	case *AzureBackend:
+		b.RootDir = side.RootDir
+	case *FilesystemBackend:
+		if side.RootDir != "" {
+			if b.RootDir, err = filepath.Abs(side.RootDir); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := backend.ValidateConfig(); err != nil {
+		return nil, invalid(fmt.Errorf("%s: %w", location, err))
+	}
+	return &syncLocation{backend: backend, bucket: bucket, prefix: strings.Trim(prefix, "/")}, nil
+}
+
+// repository returns the full name of repo, relative to the prefix.
+func (l *syncLocation) repository(repo string) string {
+	return path.Join(l.prefix, repo)
+}
+
+func syncBuckets(ctx context.Context, src string, dst string, opts SyncOptions) error {
+	start := time.Now()
+	source, err := parseSyncLocation(src, opts.Source)
+	if err != nil {
+		return err
+	}
+	dest, err := parseSyncLocation(dst, opts.Destination)
+	if err != nil {
+		return err
+	}
+	srcDriver, err := openBackendDriver(ctx, source.backend, source.bucket)
+	if err != nil {
+		return err
+	}
+	dstDriver, err := openBackendDriver(ctx, dest.backend, dest.bucket)
+	if err != nil {
+		return err
+	}
+	srcTags, err := listSyncTags(ctx, srcDriver, source.prefix, opts.Include, opts.Since > 0)
+	if err != nil {
+		return fmt.Errorf("failed to list the tags of %s: %w", src, err)
+	}
+	dstTags, err := listSyncTags(ctx, dstDriver, dest.prefix, opts.Include, false)
+	if err != nil {
+		return fmt.Errorf("failed to list the tags of %s: %w", dst, err)
+	}
+	policies, err := readPolicies(ctx, dstDriver, dest.bucket, opts.PolicyFile)
+	if err != nil {
+		return err
+	}
+	var cutoff time.Time
+	if opts.Since > 0 {
+		cutoff = start.Add(-opts.Since)
+	}
+	plan := planSync(srcTags, dstTags, cutoff, opts.Delete)
+	plan.enforce(policies, dest, dstTags)
+	slog.Info("Sync plan", "copy", len(plan.copy), "delete", len(plan.delete), "unchanged", plan.unchanged, "skipped", plan.skipped, "refused", len(plan.refused))
+
+	if !opts.DryRun {
+		if err := applySync(ctx, source, dest, &plan, policies, opts); err != nil {
+			return err
+		}
+	}
+	result := SyncResult{
+		Source:      src,
+		Destination: dst,
+		DryRun:      opts.DryRun,
+		Copied:      syncedTags(dest, plan.copy),
+		Deleted:     syncedTags(dest, plan.delete),
+		Unchanged:   plan.unchanged,
+		Skipped:     plan.skipped,
+		Refused:     plan.refused,
+	}
+	if result.Refused == nil {
+		result.Refused = []RefusedTag{}
+	}
+	result.DurationSeconds = durationSince(start)
+	err = printResult(result, func(w io.Writer) error {
+		verbs := [2]string{"copied", "deleted"}
+		if opts.DryRun {
+			verbs = [2]string{"would copy", "would delete"}
+		}
+		for _, t := range result.Copied {
+			if _, err := fmt.Fprintf(w, "copy    %s:%s (%s)\n", t.Repository, t.Tag, t.Digest); err != nil {
+				return err
+			}
+		}
+		for _, t := range result.Deleted {
+			if _, err := fmt.Fprintf(w, "delete  %s:%s\n", t.Repository, t.Tag); err != nil {
+				return err
+			}
+		}
+		for _, t := range result.Refused {
+			if _, err := fmt.Fprintf(w, "refuse  %s:%s: %s\n", t.Repository, t.Tag, t.Reason); err != nil {
+				return err
+			}
+		}
+		_, err := fmt.Fprintf(w, "%s %d, %s %d, %d unchanged, %d older than --since, %d refused by policy\n",
+			verbs[0], len(result.Copied), verbs[1], len(result.Deleted), result.Unchanged, result.Skipped, len(result.Refused))
+		return err
+	})
+	if err != nil || len(result.Refused) == 0 {
+		return err
+	}
+	return reportedError{err: fmt.Errorf("the policy of %s refused %d tags", dst, len(result.Refused))}
+}
+
+func syncedTags(dest *syncLocation, tags []syncTag) []SyncedTag {
+	synced := make([]SyncedTag, 0, len(tags))
+	for _, t := range tags {
+		synced = append(synced, SyncedTag{Repository: dest.repository(t.repo), Tag: t.tag, Digest: t.digest.String()})
+	}
+	return synced
+}
+
+// listSyncTags reads the tags of the repositories below prefix that match
+// include from the storage, keyed by syncTag.key. withModTime also looks up
+// when each tag was last written.
+func listSyncTags(ctx context.Context, d storagedriver.StorageDriver, prefix string, include []string, withModTime bool) (map[string]syncTag, error) {
+	repos, err := listRepositories(ctx, d, path.Join(repositoriesRoot, prefix))
+	if err != nil {
+		return nil, err
+	}
+	tags := map[string]syncTag{}
+	for _, full := range repos {
+		repo := strings.TrimPrefix(strings.TrimPrefix(full, prefix), "/")
+		if !matchesAny(include, repo) {
+			continue
+		}
+		tagDirs, err := d.List(ctx, path.Join(repositoriesRoot, full, "_manifests", "tags"))
+		if isPathNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, tagDir := range tagDirs {
+			link := path.Join(tagDir, "current", "link")
+			t := syncTag{repo: repo, tag: path.Base(tagDir)}
+			if t.digest, err = readLink(ctx, d, link); err != nil {
+				slog.Warn("Skipping tag with unreadable link", "repository", full, "tag", t.tag, "error", err)
+				continue
+			}
+			if withModTime {
+				fi, err := d.Stat(ctx, link)
+				if err != nil {
+					return nil, err
+				}
+				t.modified = fi.ModTime()
+			}
+			tags[t.key()] = t
+		}
+	}
+	return tags, nil
+}
+
+func matchesAny(patterns []string, repo string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, repo); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// planSync compares the tags of source and destination. Source tags written
+// before cutoff are not copied; with del, destination tags missing from the
+// source are deleted.
+func planSync(src, dst map[string]syncTag, cutoff time.Time, del bool) syncPlan {
+	var plan syncPlan
+	for key, s := range src {
+		switch d, ok := dst[key]; {
+		case ok && d.digest == s.digest:
+			plan.unchanged++
+		case !cutoff.IsZero() && s.modified.Before(cutoff):
+			plan.skipped++
+		default:
+			plan.copy = append(plan.copy, s)
+		}
+	}
+	if del {
+		for key, d := range dst {
+			if _, ok := src[key]; !ok {
+				plan.delete = append(plan.delete, d)
+			}
+		}
+	}
+	byKey := func(tags []syncTag) {
+		sort.Slice(tags, func(i, j int) bool { return tags[i].key() < tags[j].key() })
+	}
+	byKey(plan.copy)
+	byKey(plan.delete)
+	return plan
+}
+
+// enforce moves the tags policies forbid to copy or delete from the plan to
+// refused. dst holds the tags of the destination.
+func (p *syncPlan) enforce(policies ocistore.PolicySet, dest *syncLocation, dst map[string]syncTag) {
+	allowed := func(t syncTag, action string, changesTag bool) bool {
+		repo := dest.repository(t.repo)
+		err := policies.CheckRepository(repo)
+		if err == nil && changesTag && policies.Immutable(repo, t.tag) {
+			err = fmt.Errorf("%s:%s is immutable, refusing to %s it", repo, t.tag, action)
+		}
+		if err == nil {
+			return true
+		}
+		p.refused = append(p.refused, RefusedTag{Repository: repo, Tag: t.tag, Digest: t.digest.String(), Reason: err.Error()})
+		slog.Warn("Tag refused by policy", "repository", repo, "tag", t.tag, "reason", err)
+		return false
+	}
+	var copies, deletes []syncTag
+	for _, t := range p.copy {
+		// planSync only copies over a destination tag holding another image.
+		_, exists := dst[t.key()]
+		if allowed(t, "move", exists) {
+			copies = append(copies, t)
+		}
+	}
+	for _, t := range p.delete {
+		if allowed(t, "delete", true) {
+			deletes = append(deletes, t)
+		}
+	}
+	p.copy, p.delete = copies, deletes
+}
+
+// applySync copies and deletes the tags of plan through registries on both
+// buckets, which only start when there is something to do. Deletions wait
+// for every copy to succeed. Images larger than policies allow are not
+// copied but moved to the refused tags of plan.
+func applySync(ctx context.Context, source, dest *syncLocation, plan *syncPlan, policies ocistore.PolicySet, opts SyncOptions) error {
+	if len(plan.copy) == 0 && len(plan.delete) == 0 {
+		return nil
+	}
+	dstAddr, err := startRegistry(ctx, dest.backend, dest.bucket)
+	if err != nil {
+		return err
+	}
+	if len(plan.copy) > 0 {
+		srcAddr, err := startRegistry(ctx, source.backend, source.bucket)
+		if err != nil {
+			return err
+		}
+		g, ctx := errgroup.WithContext(ctx)
+		g.SetLimit(opts.Jobs)
+		tooLarge := make([]error, len(plan.copy))
+		for i, t := range plan.copy {
+			g.Go(func() error {
+				err := copySyncTag(ctx, srcAddr, source, dstAddr, dest, t, policies, opts.Transfer)
+				if errors.As(err, &ocistore.SizeError{}) {
+					tooLarge[i] = err
+					return nil
+				}
+				return err
+			})
+		}
+		if err := g.Wait(); err != nil {
+			return err
+		}
+		var copied []syncTag
+		for i, t := range plan.copy {
+			if tooLarge[i] == nil {
+				copied = append(copied, t)
+				continue
+			}
+			plan.refused = append(plan.refused, RefusedTag{Repository: dest.repository(t.repo), Tag: t.tag, Digest: t.digest.String(), Reason: tooLarge[i].Error()})
+			slog.Warn("Tag refused by policy", "repository", dest.repository(t.repo), "tag", t.tag, "reason", tooLarge[i])
+		}
+		plan.copy = copied
+	}
+	for _, t := range plan.delete {
+		tag, err := name.NewTag(fmt.Sprintf("%s/%s:%s", dstAddr, dest.repository(t.repo), t.tag), name.Insecure)
+		if err != nil {
+			return err
+		}
+		if err := remote.Delete(tag, transferOptions(ctx, opts.Transfer)...); err != nil {
+			return fmt.Errorf("failed to delete %s:%s: %w", dest.repository(t.repo), t.tag, err)
+		}
+		slog.Info("Deleted tag", "repository", dest.repository(t.repo), "tag", t.tag)
+	}
+	return nil
+}
+
+func copySyncTag(ctx context.Context, srcAddr string, source *syncLocation, dstAddr string, dest *syncLocation, t syncTag, policies ocistore.PolicySet, transfer ocistore.TransferOptions) error {
+	src, err := name.NewTag(fmt.Sprintf("%s/%s:%s", srcAddr, source.repository(t.repo), t.tag), name.Insecure)
+	if err != nil {
+		return err
+	}
+	dst, err := name.NewTag(fmt.Sprintf("%s/%s:%s", dstAddr, dest.repository(t.repo), t.tag), name.Insecure)
+	if err != nil {
+		return err
+	}
+	options := transferOptions(ctx, transfer)
+	desc, err := remote.Get(src, options...)
+	if err != nil {
+		return fmt.Errorf("failed to read %s:%s: %w", source.repository(t.repo), t.tag, err)
+	}
+	err = policies.CheckManifestSize(desc)
+	if errors.As(err, &ocistore.SizeError{}) {
+		return err
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read %s:%s: %w", source.repository(t.repo), t.tag, err)
+	}
+	if err := ocistore.CopyManifest(desc, dst, options...); err != nil {
+		return fmt.Errorf("failed to copy %s:%s: %w", source.repository(t.repo), t.tag, err)
+	}
+	slog.Info("Copied tag", "repository", dest.repository(t.repo), "tag", t.tag, "digest", desc.Digest.String())
+	return nil
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+func writeTestImage(t *testing.T, reg name.Registry, ref string, img v1.Image) {
+	t.Helper()
+	tag, err := name.NewTag(reg.RegistryStr()+"/"+ref, name.Insecure)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := remote.Write(tag, img); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSyncBuckets(t *testing.T) {
+	src, _ := startFSRegistry(t)
+	dst, err := openStorageRegistry(context.Background(), "filesystem", "dr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForRegistry(t, dst.RegistryStr())
+	oldFormat := outputFormat
+	t.Cleanup(func() { outputFormat = oldFormat })
+	outputFormat = outputJSON
+
+	app1, _ := random.Image(512, 2)
+	app2, _ := random.Image(512, 2)
+	web, _ := random.Image(512, 1)
+	stale, _ := random.Image(512, 1)
+	writeTestImage(t, src, "team/app:v1", app1)
+	writeTestImage(t, src, "team/app:v2", app2)
+	writeTestImage(t, src, "team/web:v1", web)
+	writeTestImage(t, src, "other/app:v1", app1)
+	writeTestImage(t, dst, "team/app:v1", app1)
+	writeTestImage(t, dst, "team/app:old", app1)
+	writeTestImage(t, dst, "team/web:v1", stale)
+
+	side := SyncSide{RootDir: fsRootDirectory}
+	opts := SyncOptions{Delete: true, Jobs: 2, Source: side, Destination: side}
+	if err := syncBuckets(context.Background(), "filesystem://bucket/team/", "filesystem://dr/team", opts); err != nil {
+		t.Fatalf("syncBuckets() error = %v", err)
+	}
+
+	d, err := openStorageDriver(context.Background(), "filesystem", "dr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tags, err := listSyncTags(context.Background(), d, "", nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]v1.Image{"team/app:v1": app1, "team/app:v2": app2, "team/web:v1": web}
+	if len(tags) != len(want) {
+		t.Errorf("destination tags = %v, want %d tags", tags, len(want))
+	}
+	for key, img := range want {
+		digest, _ := img.Digest()
+		if tags[key].digest != digest {
+			t.Errorf("destination %s = %s, want %s", key, tags[key].digest, digest)
+		}
+	}
+	// The copied image is complete.
+	copied, err := remote.Image(dst.Repo("team", "app").Tag("v2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	layers, _ := copied.Layers()
+	for _, l := range layers {
+		readLayer(t, l)
+	}
+
+	// A second run finds nothing to do.
+	srcDriver, _ := openStorageDriver(context.Background(), "filesystem", "bucket")
+	srcTags, _ := listSyncTags(context.Background(), srcDriver, "team", nil, false)
+	dstTags, _ := listSyncTags(context.Background(), d, "team", nil, false)
+	if plan := planSync(srcTags, dstTags, time.Time{}, true); len(plan.copy) != 0 || len(plan.delete) != 0 || plan.unchanged != 3 {
+		t.Errorf("plan after sync = %+v", plan)
+	}
+}
+
+func TestSyncBucketsPolicy(t *testing.T) {
+	src, _ := startFSRegistry(t)
+	ctx := context.Background()
+	dst, err := openStorageRegistry(ctx, "filesystem", "dr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForRegistry(t, dst.RegistryStr())
+	oldFormat := outputFormat
+	t.Cleanup(func() { outputFormat = oldFormat })
+	outputFormat = outputJSON
+
+	policyFile := filepath.Join(t.TempDir(), "policy.json")
+	if err := os.WriteFile(policyFile, []byte(`{"immutableTags": ["v*"], "allowedRepositories": ["team/app", "team/big"], "maxImageBytes": 10000}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := setPolicy(ctx, "filesystem", "dr", policyFile); err != nil {
+		t.Fatal(err)
+	}
+
+	app1, _ := random.Image(512, 2)
+	app2, _ := random.Image(512, 2)
+	big, _ := random.Image(8192, 3)
+	writeTestImage(t, src, "team/app:v1", app2)
+	writeTestImage(t, src, "team/app:latest", app2)
+	writeTestImage(t, src, "team/big:latest", big)
+	writeTestImage(t, src, "team/web:latest", app1)
+	writeTestImage(t, dst, "team/app:v1", app1)
+	writeTestImage(t, dst, "team/app:v0", app1)
+	writeTestImage(t, dst, "team/app:tmp", app1)
+
+	side := SyncSide{RootDir: fsRootDirectory}
+	opts := SyncOptions{Delete: true, Jobs: 2, Source: side, Destination: side}
+	err = syncBuckets(ctx, "filesystem://bucket/team", "filesystem://dr/team", opts)
+	if !errors.As(err, &reportedError{}) || !strings.Contains(err.Error(), "refused 4 tags") {
+		t.Fatalf("syncBuckets() error = %v, want 4 refused tags", err)
+	}
+
+	d, err := openStorageDriver(ctx, "filesystem", "dr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tags, err := listSyncTags(ctx, d, "", nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest1, _ := app1.Digest()
+	digest2, _ := app2.Digest()
+	// The immutable tags keep their image, the new tag is copied, the
+	// mutable one deleted, and the large image and the repository outside
+	// the allowed ones are left out.
+	want := map[string]v1.Hash{"team/app:v1": digest1, "team/app:v0": digest1, "team/app:latest": digest2}
+	if len(tags) != len(want) {
+		t.Errorf("destination tags = %v, want %d tags", tags, len(want))
+	}
+	for key, digest := range want {
+		if tags[key].digest != digest {
+			t.Errorf("destination %s = %s, want %s", key, tags[key].digest, digest)
+		}
+	}
+}
+
+func TestPlanSync(t *testing.T) {
+	now := time.Now()
+	h := func(s string) v1.Hash { return v1.Hash{Algorithm: "sha256", Hex: s} }
+	src := map[string]syncTag{
+		"app:v1":  {repo: "app", tag: "v1", digest: h("1"), modified: now.Add(-time.Hour)},
+		"app:v2":  {repo: "app", tag: "v2", digest: h("2"), modified: now.Add(-48 * time.Hour)},
+		"web:new": {repo: "web", tag: "new", digest: h("3"), modified: now},
+		"web:old": {repo: "web", tag: "old", digest: h("4"), modified: now.Add(-48 * time.Hour)},
+	}
+	dst := map[string]syncTag{
+		"app:v1":   {repo: "app", tag: "v1", digest: h("1")},
+		"app:v2":   {repo: "app", tag: "v2", digest: h("0")},
+		"web:gone": {repo: "web", tag: "gone", digest: h("5")},
+	}
+	plan := planSync(src, dst, now.Add(-24*time.Hour), true)
+	if len(plan.copy) != 1 || plan.copy[0].key() != "web:new" {
+		t.Errorf("copy = %+v, want web:new only", plan.copy)
+	}
+	if len(plan.delete) != 1 || plan.delete[0].key() != "web:gone" {
+		t.Errorf("delete = %+v, want web:gone", plan.delete)
+	}
+	if plan.unchanged != 1 || plan.skipped != 2 {
+		t.Errorf("unchanged = %d, skipped = %d, want 1 and 2", plan.unchanged, plan.skipped)
+	}
+	if plan := planSync(src, dst, time.Time{}, false); len(plan.copy) != 3 || len(plan.delete) != 0 {
+		t.Errorf("plan without --since and --delete = %+v", plan)
+	}
+}
+
+func TestParseSyncOptions(t *testing.T) {
+	if d, err := parseAge("7d"); err != nil || d != 7*24*time.Hour {
+		t.Errorf("parseAge(7d) = %v, %v", d, err)
+	}
+	if d, err := parseAge("90m"); err != nil || d != 90*time.Minute {
+		t.Errorf("parseAge(90m) = %v, %v", d, err)
+	}
+	for _, s := range []string{"xd", "-1d", "soon"} {
+		if _, err := parseAge(s); exitCode(err) != exitValidation {
+			t.Errorf("parseAge(%q) = %v, want a validation error", s, err)
+		}
+	}
+
+	root := SyncSide{RootDir: t.TempDir()}
+	loc, err := parseSyncLocation("filesystem://dr/team/", root)
+	if err != nil || loc.bucket != "dr" || loc.prefix != "team" || loc.repository("app") != "team/app" {
+		t.Errorf("parseSyncLocation() = %+v, %v", loc, err)
+	}
+	invalid := []struct {
+		location string
+		side     SyncSide
+	}{
+		{"dr/team", root},
+		{"filesystem://", root},
+		{"ftp://dr/team", root},
+		{"filesystem://dr", SyncSide{RootDir: root.RootDir, Region: "us-east-1"}},
+	}
+	for _, tt := range invalid {
+		if _, err := parseSyncLocation(tt.location, tt.side); exitCode(err) != exitValidation {
+			t.Errorf("parseSyncLocation(%q) = %v, want a validation error", tt.location, err)
+		}
+	}
+	if err := (SyncOptions{Include: []string{"[app"}, Jobs: 1}).validate(); exitCode(err) != exitValidation {
+		t.Errorf("validate() with a bad pattern = %v", err)
+	}
+}
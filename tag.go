@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/nbctools/oci-store/pkg/ocistore"
+	"github.com/spf13/cobra"
+)
+
+func newTagCmd(storageType string, validate func() error) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "tag " + refUsage(storageType) + " <dest>...",
+		Short: "Add tags to a stored image without re-uploading it",
+		Long: `Point one or more tags at an existing stored image. Destinations must be in
+the same bucket as the source. Tags in the same repository only get a new tag
+link; other repositories get the manifest with blobs mounted from the source.`,
+		Args: cobra.MinimumNArgs(2),
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			return validate()
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			policyFile, _ := cmd.Flags().GetString("policy")
+			return tagImage(cmd.Context(), storageType, args[0], args[1:], policyFile)
+		},
+	}
+	cmd.Flags().String("policy", "", "Local policy file enforced in addition to the bucket policy")
+	return cmd
+}
+
+func tagImage(ctx context.Context, storageType string, storageRef string, destRefs []string, policyFile string) error {
+	ref, target, err := openStorageRef(ctx, storageType, storageRef)
+	if err != nil {
+		return err
+	}
+	dests, err := destinationTags(storageType, ref, target.RegistryStr(), destRefs)
+	if err != nil {
+		return err
+	}
+	desc, err := remote.Get(target, remote.WithContext(ctx), withRegistryTransport())
+	if err != nil {
+		return fmt.Errorf("failed to resolve %s: %w", storageRef, err)
+	}
+	policies, err := loadPolicies(ctx, storageType, ref.Bucket, policyFile)
+	if err != nil {
+		return err
+	}
+	for _, tag := range dests {
+		if err := policies.CheckTag(tag, desc.Digest, remote.WithContext(ctx), withRegistryTransport()); err != nil {
+			return err
+		}
+	}
+	return applyTags(ctx, target.Repository, desc, dests)
+}
+
+// destinationTags parses additional references, which must be in the same
+// bucket as ref, into tags on the registry serving that bucket.
+func destinationTags(storageType string, ref *StorageRef, registry string, refs []string) ([]name.Tag, error) {
+	backend, err := NewBackend(storageType)
+	if err != nil {
+		return nil, err
+	}
+	tags := make([]name.Tag, 0, len(refs))
+	for _, r := range refs {
+		dest, err := backend.ParseRef(r)
+		if err != nil {
+			return nil, err
+		}
+		if dest.Bucket != ref.Bucket {
+			return nil, fmt.Errorf("destination %s must be in bucket %s", r, ref.Bucket)
+		}
+		tag, err := name.NewTag(fmt.Sprintf("%s/%s:%s", registry, dest.Path, dest.Tag), name.Insecure)
+		if err != nil {
+			return nil, err
+		}
+		tags = append(tags, tag)
+	}
+	return tags, nil
+}
+
+// applyTags points every tag at the manifest in desc, which lives in src.
+func applyTags(ctx context.Context, src name.Repository, desc *remote.Descriptor, tags []name.Tag) error {
+	for _, tag := range tags {
+		var err error
+		if tag.Repository == src {
+			err = remote.Tag(tag, desc, remote.WithContext(ctx), withRegistryTransport())
+		} else {
+			err = ocistore.CopyManifest(desc, tag, remote.WithContext(ctx), withRegistryTransport())
+		}
+		if err != nil {
+			return fmt.Errorf("failed to tag %s: %w", tag.String(), err)
+		}
+		slog.Info("Tagged image", "repository", tag.RepositoryStr(), "tag", tag.TagStr(), "digest", desc.Digest.String())
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+func TestDestinationTags(t *testing.T) {
+	ref := &StorageRef{Bucket: "bucket", Path: "app", Tag: "v1"}
+
+	tags, err := destinationTags("s3", ref, "localhost:5000", []string{"bucket/app:latest", "bucket/other:v1"})
+	if err != nil {
+		t.Fatalf("destinationTags() error = %v", err)
+	}
+	want := []string{"localhost:5000/app:latest", "localhost:5000/other:v1"}
+	for i, tag := range tags {
+		if tag.String() != want[i] {
+			t.Errorf("tags[%d] = %q, want %q", i, tag.String(), want[i])
+		}
+	}
+
+	if _, err := destinationTags("s3", ref, "localhost:5000", []string{"elsewhere/app:latest"}); err == nil {
+		t.Error("destinationTags() with a different bucket should fail")
+	}
+}
+
+func TestApplyTags(t *testing.T) {
+	host := newTestRegistry(t)
+	src, _ := name.NewTag(host+"/app:v1", name.Insecure)
+	img, _ := random.Image(256, 2)
+	if err := remote.Write(src, img); err != nil {
+		t.Fatalf("remote.Write() error = %v", err)
+	}
+	desc, err := remote.Get(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sameRepo, _ := name.NewTag(host+"/app:latest", name.Insecure)
+	otherRepo, _ := name.NewTag(host+"/mirror/app:v1", name.Insecure)
+	if err := applyTags(context.Background(), src.Repository, desc, []name.Tag{sameRepo, otherRepo}); err != nil {
+		t.Fatalf("applyTags() error = %v", err)
+	}
+
+	for _, tag := range []name.Tag{sameRepo, otherRepo} {
+		got, err := remote.Head(tag)
+		if err != nil {
+			t.Fatalf("remote.Head(%s) error = %v", tag, err)
+		}
+		if got.Digest != desc.Digest {
+			t.Errorf("%s digest = %s, want %s", tag, got.Digest, desc.Digest)
+		}
+	}
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/cobra"
+	"go.opentelemetry.io/contrib/exporters/autoexport"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric"
+	metricnoop "go.opentelemetry.io/otel/metric/noop"
+	"go.opentelemetry.io/otel/propagation"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	tracenoop "go.opentelemetry.io/otel/trace/noop"
+)
+
+const instrumentationName = "github.com/nbctools/oci-store"
+
+// Telemetry is off unless the standard OTEL_* environment variables ask for
+// an exporter. The embedded registry sets the global tracer provider itself,
+// so ours is kept here rather than registered globally.
+var (
+	tracer      trace.Tracer = tracenoop.NewTracerProvider().Tracer(instrumentationName)
+	instruments              = newInstruments(metricnoop.NewMeterProvider())
+	commandSpan trace.Span   = trace.SpanFromContext(context.Background())
+)
+
+type telemetryInstruments struct {
+	// transferred counts blob and manifest bytes sent to and received from
+	// the embedded registry.
+	transferred metric.Int64Counter
+	// retries counts requests repeated after a failed attempt.
+	retries metric.Int64Counter
+	// duration records how long push and pull operations take.
+	duration metric.Float64Histogram
+}
+
+func newInstruments(mp metric.MeterProvider) *telemetryInstruments {
+	meter := mp.Meter(instrumentationName)
+	// The noop and SDK meters only fail on invalid instrument names.
+	transferred, _ := meter.Int64Counter("oci_store.transfer.bytes",
+		metric.WithUnit("By"), metric.WithDescription("Bytes transferred to and from storage"))
+	retries, _ := meter.Int64Counter("oci_store.retries",
+		metric.WithUnit("{retry}"), metric.WithDescription("Requests retried after a failed attempt"))
+	duration, _ := meter.Float64Histogram("oci_store.operation.duration",
+		metric.WithUnit("s"), metric.WithDescription("Duration of push and pull operations"))
+	return &telemetryInstruments{transferred: transferred, retries: retries, duration: duration}
+}
+
+// telemetryEnabled reports whether the environment configures an exporter
+// for signal, "TRACES" or "METRICS".
+func telemetryEnabled(signal string) bool {
+	if strings.EqualFold(getEnv("OTEL_SDK_DISABLED"), "true") {
+		return false
+	}
+	if exporter := getEnv("OTEL_" + signal + "_EXPORTER"); exporter != "" {
+		return exporter != "none"
+	}
+	return getEnv("OTEL_EXPORTER_OTLP_ENDPOINT") != "" || getEnv("OTEL_EXPORTER_OTLP_"+signal+"_ENDPOINT") != ""
+}
+
+// setupTelemetry creates the tracer and meter providers configured by the
+// environment and instruments requests to the embedded registry. The
+// returned function flushes and stops them.
+func setupTelemetry(ctx context.Context) (func(context.Context) error, error) {
+	tracesEnabled, metricsEnabled := telemetryEnabled("TRACES"), telemetryEnabled("METRICS")
+	registryTracingMu.Lock()
+	registryTraces = tracesEnabled
+	registryTracingMu.Unlock()
+	if !tracesEnabled && !metricsEnabled {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	res, err := resource.New(ctx,
+		resource.WithAttributes(attribute.String("service.name", "oci-store")),
+		resource.WithFromEnv(),
+		resource.WithTelemetrySDK(),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	var shutdowns []func(context.Context) error
+	var tp trace.TracerProvider = tracenoop.NewTracerProvider()
+	if tracesEnabled {
+		exporter, err := autoexport.NewSpanExporter(ctx)
+		if err != nil {
+			return nil, err
+		}
+		provider := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(res))
+		shutdowns = append(shutdowns, provider.Shutdown)
+		tp = provider
+	}
+	var mp metric.MeterProvider = metricnoop.NewMeterProvider()
+	if metricsEnabled {
+		reader, err := autoexport.NewMetricReader(ctx)
+		if err != nil {
+			return nil, err
+		}
+		provider := sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader), sdkmetric.WithResource(res))
+		shutdowns = append(shutdowns, provider.Shutdown)
+		mp = provider
+	}
+
+	tracer = tp.Tracer(instrumentationName)
+	instruments = newInstruments(mp)
+	registryTransport = newTelemetryTransport(registryClient, tp, mp)
+	return func(ctx context.Context) error {
+		var errs []error
+		for _, shutdown := range shutdowns {
+			errs = append(errs, shutdown(ctx))
+		}
+		return errors.Join(errs...)
+	}, nil
+}
+
+// Every embedded registry installs a global tracer provider configured from
+// the OTEL_* environment, which exports to the default OTLP endpoint when
+// nothing is set. Unless registryTraces is set, newRegistry shuts that
+// provider down, so the registry's spans are dropped.
+var (
+	registryTracingMu sync.Mutex
+	registryTraces    bool
+)
+
+// newRegistry runs create, which creates an embedded registry, and stops the
+// tracer provider the registry installed unless traces are exported.
+func newRegistry(ctx context.Context, create func() error) error {
+	registryTracingMu.Lock()
+	defer registryTracingMu.Unlock()
+	if err := create(); err != nil {
+		return err
+	}
+	if tp, ok := otel.GetTracerProvider().(*sdktrace.TracerProvider); ok && !registryTraces {
+		if err := tp.Shutdown(context.WithoutCancel(ctx)); err != nil {
+			slog.Debug("Failed to stop the registry tracer provider", "error", err)
+		}
+	}
+	return nil
+}
+
+// startCommandSpan starts the span covering the whole command and stores it
+// in the command's context, so every other span is part of one trace.
+func startCommandSpan(cmd *cobra.Command) {
+	ctx, span := tracer.Start(cmd.Context(), cmd.CommandPath())
+	cmd.SetContext(ctx)
+	commandSpan = span
+}
+
+func startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return tracer.Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// endSpan records err on span and ends it.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		msg := redactString(err.Error())
+		span.RecordError(errors.New(msg))
+		span.SetStatus(codes.Error, msg)
+	}
+	span.End()
+}
+
+// recordOperation records the duration of a push or pull.
+func recordOperation(ctx context.Context, operation string, storageType string, start time.Time, err error) {
+	outcome := "success"
+	if err != nil {
+		outcome = exitKind(exitCode(err))
+	}
+	instruments.duration.Record(ctx, time.Since(start).Seconds(), metric.WithAttributes(
+		attribute.String("operation", operation),
+		attribute.String("storage.type", storageType),
+		attribute.String("outcome", outcome),
+	))
+}
+
+// newTelemetryTransport traces every request to the embedded registry as a
+// span named after the registry operation, and counts transferred bytes and
+// retried requests.
+func newTelemetryTransport(base http.RoundTripper, tp trace.TracerProvider, mp metric.MeterProvider) http.RoundTripper {
+	return otelhttp.NewTransport(&meteredTransport{base: base, failed: map[string]bool{}},
+		otelhttp.WithTracerProvider(tp),
+		otelhttp.WithMeterProvider(mp),
+		otelhttp.WithPropagators(propagation.TraceContext{}),
+		otelhttp.WithSpanNameFormatter(func(_ string, r *http.Request) string {
+			return registryOperation(r)
+		}),
+	)
+}
+
+// registryOperation names the registry API operation of a request.
+func registryOperation(r *http.Request) string {
+	p := r.URL.Path
+	switch {
+	case strings.Contains(p, "/blobs/uploads/"):
+		return "blob upload"
+	case strings.Contains(p, "/blobs/"):
+		if r.Method == http.MethodHead {
+			return "blob check"
+		}
+		return "blob download"
+	case strings.Contains(p, "/manifests/"):
+		switch r.Method {
+		case http.MethodPut:
+			return "manifest write"
+		case http.MethodDelete:
+			return "manifest delete"
+		}
+		return "manifest read"
+	case strings.HasSuffix(p, "/tags/list"):
+		return "tag list"
+	case strings.Contains(p, "/referrers/"):
+		return "referrers"
+	case strings.HasSuffix(p, "/_catalog"):
+		return "catalog"
+	}
+	return "registry " + r.Method
+}
+
+type meteredTransport struct {
+	base http.RoundTripper
+
+	mu sync.Mutex
+	// failed holds the requests whose last attempt failed, so the next
+	// identical request counts as a retry.
+	failed map[string]bool
+}
+
+func (t *meteredTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	operation := registryOperation(r)
+	attrs := metric.WithAttributes(attribute.String("operation", operation))
+	key := r.Method + " " + r.URL.String()
+
+	t.mu.Lock()
+	if t.failed[key] {
+		instruments.retries.Add(r.Context(), 1, attrs)
+	}
+	t.mu.Unlock()
+
+	if r.Body != nil && r.Body != http.NoBody {
+		r = r.Clone(r.Context())
+		r.Body = &countingReader{ReadCloser: r.Body, ctx: r.Context(), attrs: metric.WithAttributes(
+			attribute.String("operation", operation), attribute.String("direction", "upload"))}
+	}
+	resp, err := t.base.RoundTrip(r)
+
+	failed := err != nil || resp.StatusCode >= http.StatusInternalServerError ||
+		resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusRequestTimeout
+	t.mu.Lock()
+	if failed {
+		t.failed[key] = true
+	} else {
+		delete(t.failed, key)
+	}
+	t.mu.Unlock()
+
+	if err == nil && resp.Body != nil {
+		resp.Body = &countingReader{ReadCloser: resp.Body, ctx: r.Context(), attrs: metric.WithAttributes(
+			attribute.String("operation", operation), attribute.String("direction", "download"))}
+	}
+	return resp, err
+}
+
+// countingReader adds the bytes read through it to the transfer counter.
+type countingReader struct {
+	io.ReadCloser
+	ctx   context.Context
+	attrs metric.MeasurementOption
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	if n > 0 {
+		instruments.transferred.Add(c.ctx, int64(n), c.attrs)
+	}
+	return n, err
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestRegistryOperation(t *testing.T) {
+	tests := []struct {
+		method, path, want string
+	}{
+		{http.MethodPost, "/v2/app/blobs/uploads/", "blob upload"},
+		{http.MethodPatch, "/v2/app/blobs/uploads/0b1c", "blob upload"},
+		{http.MethodHead, "/v2/app/blobs/sha256:abc", "blob check"},
+		{http.MethodGet, "/v2/app/blobs/sha256:abc", "blob download"},
+		{http.MethodPut, "/v2/app/manifests/v1", "manifest write"},
+		{http.MethodGet, "/v2/app/manifests/v1", "manifest read"},
+		{http.MethodGet, "/v2/app/tags/list", "tag list"},
+		{http.MethodGet, "/v2/_catalog", "catalog"},
+		{http.MethodGet, "/v2/", "registry GET"},
+	}
+	for _, tt := range tests {
+		r := &http.Request{Method: tt.method, URL: &url.URL{Path: tt.path}}
+		if got := registryOperation(r); got != tt.want {
+			t.Errorf("registryOperation(%s %s) = %q, want %q", tt.method, tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestTelemetryEnabled(t *testing.T) {
+	for _, key := range []string{"OTEL_SDK_DISABLED", "OTEL_TRACES_EXPORTER", "OTEL_METRICS_EXPORTER", "OTEL_EXPORTER_OTLP_ENDPOINT", "OTEL_EXPORTER_OTLP_TRACES_ENDPOINT", "OTEL_EXPORTER_OTLP_METRICS_ENDPOINT"} {
+		t.Setenv(key, "")
+	}
+	if telemetryEnabled("TRACES") {
+		t.Error("telemetry should be off without OTEL_* variables")
+	}
+	t.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", "http://collector:4318")
+	if !telemetryEnabled("TRACES") || !telemetryEnabled("METRICS") {
+		t.Error("OTEL_EXPORTER_OTLP_ENDPOINT should enable traces and metrics")
+	}
+	t.Setenv("OTEL_METRICS_EXPORTER", "none")
+	if telemetryEnabled("METRICS") {
+		t.Error("OTEL_METRICS_EXPORTER=none should disable metrics")
+	}
+	t.Setenv("OTEL_SDK_DISABLED", "true")
+	if telemetryEnabled("TRACES") {
+		t.Error("OTEL_SDK_DISABLED should disable telemetry")
+	}
+}
+
+func TestTelemetryTransport(t *testing.T) {
+	spans := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(spans))
+	reader := sdkmetric.NewManualReader()
+	mp := sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader))
+	oldTracer, oldInstruments := tracer, instruments
+	tracer, instruments = tp.Tracer(instrumentationName), newInstruments(mp)
+	t.Cleanup(func() { tracer, instruments = oldTracer, oldInstruments })
+
+	transport := newTelemetryTransport(http.DefaultTransport, tp, mp)
+	ctx, span := startSpan(context.Background(), "push")
+
+	tag, _ := name.NewTag(newTestRegistry(t)+"/app:v1", name.Insecure)
+	img, _ := random.Image(1024, 2)
+	if err := remote.Write(tag, img, remote.WithTransport(transport), remote.WithContext(ctx)); err != nil {
+		t.Fatalf("remote.Write() error = %v", err)
+	}
+	span.End()
+
+	// A request failing once and then succeeding counts as a retry.
+	attempts := 0
+	flaky := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		if attempts == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	t.Cleanup(flaky.Close)
+	client := &http.Client{Transport: transport}
+	for range 2 {
+		resp, err := client.Get(flaky.URL + "/v2/app/blobs/sha256:abc")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = resp.Body.Close()
+	}
+
+	names := map[string]int{}
+	for _, s := range spans.Ended() {
+		names[s.Name()]++
+		if s.Name() == "manifest write" && s.Parent().SpanID() != span.SpanContext().SpanID() {
+			t.Error("request spans should be children of the operation span")
+		}
+	}
+	for _, want := range []string{"blob upload", "manifest write", "blob download"} {
+		if names[want] == 0 {
+			t.Errorf("no %q span recorded, got %v", want, names)
+		}
+	}
+
+	var rm metricdata.ResourceMetrics
+	if err := reader.Collect(context.Background(), &rm); err != nil {
+		t.Fatal(err)
+	}
+	sums := map[string]map[string]int64{}
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			data, ok := m.Data.(metricdata.Sum[int64])
+			if !ok {
+				continue
+			}
+			sums[m.Name] = map[string]int64{}
+			for _, dp := range data.DataPoints {
+				direction, _ := dp.Attributes.Value(attribute.Key("direction"))
+				operation, _ := dp.Attributes.Value(attribute.Key("operation"))
+				sums[m.Name][direction.AsString()+"/"+operation.AsString()] += dp.Value
+			}
+		}
+	}
+	if sums["oci_store.transfer.bytes"]["upload/blob upload"] < 2*1024 {
+		t.Errorf("uploaded bytes = %v, want at least the two layers", sums["oci_store.transfer.bytes"])
+	}
+	if got := sums["oci_store.retries"]["/blob download"]; got != 1 {
+		t.Errorf("retries = %d, want 1", got)
+	}
+}
+
+func TestSetupTelemetryKeepsEnvironment(t *testing.T) {
+	for _, key := range []string{"OTEL_SDK_DISABLED", "OTEL_TRACES_EXPORTER", "OTEL_METRICS_EXPORTER", "OTEL_EXPORTER_OTLP_ENDPOINT", "OTEL_EXPORTER_OTLP_TRACES_ENDPOINT", "OTEL_EXPORTER_OTLP_METRICS_ENDPOINT"} {
+		t.Setenv(key, "")
+	}
+	oldTransport := registryTransport
+	t.Cleanup(func() { registryTransport = oldTransport })
+
+	if _, err := setupTelemetry(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if v := os.Getenv("OTEL_TRACES_EXPORTER"); v != "" {
+		t.Errorf("setupTelemetry() set OTEL_TRACES_EXPORTER=%s", v)
+	}
+
+	// The embedded registry's own tracer provider is stopped, so its spans
+	// go nowhere.
+	startFSRegistry(t)
+	if _, span := otel.GetTracerProvider().Tracer("test").Start(context.Background(), "request"); span.IsRecording() {
+		t.Error("the registry's tracer provider still records spans")
+	}
+}
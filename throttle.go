@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+var byteSizePattern = regexp.MustCompile(`(?i)^(\d+(?:\.\d+)?)([kmg]?)$`)
+
+// byteRate is a bandwidth flag in bytes per second, such as 50M. As in curl's
+// --limit-rate, K, M and G are powers of 1024.
+type byteRate int64
+
+// parseByteSize parses a number of bytes with an optional K, M or G suffix.
+func parseByteSize(s string) (int64, error) {
+	m := byteSizePattern.FindStringSubmatch(strings.TrimSpace(s))
+	if m == nil {
+		return 0, fmt.Errorf("invalid size %q, expected a number of bytes such as 500K or 50M", s)
+	}
+	v, err := strconv.ParseFloat(m[1], 64)
+	if err != nil {
+		return 0, err
+	}
+	switch strings.ToUpper(m[2]) {
+	case "K":
+		v *= 1 << 10
+	case "M":
+		v *= 1 << 20
+	case "G":
+		v *= 1 << 30
+	}
+	return int64(v), nil
+}
+
+func (r *byteRate) Set(s string) error {
+	v, err := parseByteSize(s)
+	if err != nil {
+		return err
+	}
+	*r = byteRate(v)
+	return nil
+}
+
+func (r *byteRate) String() string { return strconv.FormatInt(int64(*r), 10) }
+
+func (r *byteRate) Type() string { return "rate" }
+
+func flagRate(cmd *cobra.Command, name string) int64 {
+	if r, ok := cmd.Flags().Lookup(name).Value.(*byteRate); ok {
+		return int64(*r)
+	}
+	return 0
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/spf13/cobra"
+)
+
+func TestParseByteRate(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    int64
+		wantErr bool
+	}{
+		{"0", 0, false},
+		{"1000", 1000, false},
+		{"500K", 500 << 10, false},
+		{"50M", 50 << 20, false},
+		{"1.5g", 3 << 29, false},
+		{"", 0, true},
+		{"-1M", 0, true},
+		{"50MB/s", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := parseByteSize(tt.in)
+		if got != tt.want || (err != nil) != tt.wantErr {
+			t.Errorf("parseByteSize(%q) = %d, %v, want %d", tt.in, got, err, tt.want)
+		}
+	}
+}
+
+func TestTransferOptionsFromFlags(t *testing.T) {
+	cmd := &cobra.Command{Use: "push"}
+	addTransferFlags(cmd)
+	if err := cmd.ParseFlags([]string{"--limit-rate", "1M", "--limit-download-rate", "2M"}); err != nil {
+		t.Fatal(err)
+	}
+	opts := transferOptionsFromFlags(cmd)
+	if opts.UploadLimit == nil || opts.UploadLimit.Limit() != 1<<20 {
+		t.Errorf("upload limit = %v, want 1M", opts.UploadLimit)
+	}
+	if opts.DownloadLimit == nil || opts.DownloadLimit.Limit() != 2<<20 {
+		t.Errorf("download limit = %v, want 2M", opts.DownloadLimit)
+	}
+	if err := cmd.ParseFlags([]string{"--limit-rate", "fast"}); err == nil {
+		t.Error("an invalid rate was accepted")
+	}
+
+	cmd = &cobra.Command{Use: "pull"}
+	addTransferFlags(cmd)
+	if opts := transferOptionsFromFlags(cmd); opts.UploadLimit != nil || opts.DownloadLimit != nil {
+		t.Error("transfers are limited without --limit-rate")
+	}
+}
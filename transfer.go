@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/nbctools/oci-store/pkg/ocistore"
+	"github.com/spf13/cobra"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+func addTransferFlags(cmd *cobra.Command) {
+	cmd.Flags().Int("retries", 3, "Times a failed transfer is retried before giving up")
+	cmd.Flags().Duration("retry-backoff", time.Second, "Wait before the first retry, doubled for each further one")
+	cmd.Flags().Duration("operation-timeout", 0, "Time limit for each blob or manifest request, 0 for none")
+	cmd.Flags().Var(new(byteRate), "limit-rate", "Cap upload and download bandwidth in bytes per second, e.g. 50M")
+	cmd.Flags().Var(new(byteRate), "limit-upload-rate", "Cap upload bandwidth, overriding --limit-rate")
+	cmd.Flags().Var(new(byteRate), "limit-download-rate", "Cap download bandwidth, overriding --limit-rate")
+}
+
+func transferOptionsFromFlags(cmd *cobra.Command) ocistore.TransferOptions {
+	retries, _ := cmd.Flags().GetInt("retries")
+	backoff, _ := cmd.Flags().GetDuration("retry-backoff")
+	timeout, _ := cmd.Flags().GetDuration("operation-timeout")
+	upload, download := flagRate(cmd, "limit-rate"), flagRate(cmd, "limit-rate")
+	if cmd.Flags().Changed("limit-upload-rate") {
+		upload = flagRate(cmd, "limit-upload-rate")
+	}
+	if cmd.Flags().Changed("limit-download-rate") {
+		download = flagRate(cmd, "limit-download-rate")
+	}
+	return ocistore.TransferOptions{
+		Retries:          retries,
+		Backoff:          backoff,
+		OperationTimeout: timeout,
+		UploadLimit:      ocistore.NewRateLimiter(upload),
+		DownloadLimit:    ocistore.NewRateLimiter(download),
+		OnRetry:          countRetry,
+	}
+}
+
+// countRetry records a retried operation in the retries metric.
+func countRetry(ctx context.Context, operation string) {
+	instruments.retries.Add(ctx, 1, metric.WithAttributes(attribute.String("operation", operation)))
+}
+
+// transferOptions returns the remote options of o for requests to the
+// embedded registries.
+func transferOptions(ctx context.Context, o ocistore.TransferOptions) []remote.Option {
+	return o.RemoteOptions(ctx, registryTransport)
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"path"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/spf13/cobra"
+)
+
+// Upload purging settings of the embedded registry, see
+// https://distribution.github.io/distribution/about/configuration/#maintenance
+var (
+	uploadPurging       bool
+	uploadPurgeAge      time.Duration
+	uploadPurgeInterval time.Duration
+	uploadPurgeDryRun   bool
+)
+
+// Upload is an unfinished blob upload in a repository.
+type Upload struct {
+	Repository string    `json:"repository"`
+	ID         string    `json:"id"`
+	StartedAt  time.Time `json:"startedAt"`
+	Size       int64     `json:"size"`
+	path       string
+}
+
+// PurgeResult is the result of uploads purge printed with --output json.
+type PurgeResult struct {
+	Scope          string   `json:"scope"`
+	DryRun         bool     `json:"dryRun"`
+	Uploads        []Upload `json:"uploads"`
+	ReclaimedBytes int64    `json:"reclaimedBytes"`
+}
+
+func newUploadsCmd(storageType string, validate func() error) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "uploads",
+		Short: "Manage unfinished blob uploads",
+	}
+
+	purgeCmd := &cobra.Command{
+		Use:   "purge <bucket>[/<image-path>]",
+		Short: "Delete uploads abandoned by interrupted pushes",
+		Args:  cobra.ExactArgs(1),
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			return validate()
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			olderThan, _ := cmd.Flags().GetDuration("older-than")
+			dryRun, _ := cmd.Flags().GetBool("dry-run")
+			return purgeUploads(cmd.Context(), storageType, args[0], olderThan, dryRun)
+		},
+	}
+	purgeCmd.Flags().Duration("older-than", 24*time.Hour, "Only purge uploads started longer ago than this")
+	purgeCmd.Flags().Bool("dry-run", false, "List the uploads that would be purged without deleting them")
+
+	cmd.AddCommand(purgeCmd)
+	return cmd
+}
+
+// uploadPurgingConfig returns the maintenance settings passed to the
+// embedded registry.
+func uploadPurgingConfig() map[interface{}]interface{} {
+	return map[interface{}]interface{}{
+		"enabled":  uploadPurging,
+		"age":      uploadPurgeAge.String(),
+		"interval": uploadPurgeInterval.String(),
+		"dryrun":   uploadPurgeDryRun,
+	}
+}
+
+func purgeUploads(ctx context.Context, storageType string, scope string, olderThan time.Duration, dryRun bool) error {
+	bucket, repoPath, _ := strings.Cut(scope, "/")
+	if bucket == "" {
+		return invalidf("invalid scope %q, expected <bucket>[/<image-path>]", scope)
+	}
+	d, err := openStorageDriver(ctx, storageType, bucket)
+	if err != nil {
+		return err
+	}
+
+	repos := []string{repoPath}
+	if repoPath == "" {
+		if repos, err = listRepositories(ctx, d, repositoriesRoot); err != nil {
+			return fmt.Errorf("failed to list repositories: %w", err)
+		}
+		sort.Strings(repos)
+	}
+
+	cutoff := time.Now().Add(-olderThan)
+	purged := []Upload{}
+	var reclaimed int64
+	for _, repo := range repos {
+		uploads, err := listUploads(ctx, d, repo)
+		if err != nil {
+			return err
+		}
+		for _, u := range uploads {
+			// Cancelled uploads leave their hash state behind, without a
+			// start time or data.
+			cancelled := u.StartedAt.IsZero() && u.Size == 0
+			if u.StartedAt.IsZero() && !cancelled {
+				slog.Warn("Skipping upload without a start time", "repository", u.Repository, "id", u.ID)
+				continue
+			}
+			if !cancelled && !u.StartedAt.Before(cutoff) {
+				continue
+			}
+			if !dryRun {
+				if u.Size, err = deleteUpload(ctx, d, u); err != nil {
+					return fmt.Errorf("failed to purge upload %s in %s: %w", u.ID, u.Repository, err)
+				}
+			}
+			purged = append(purged, u)
+			reclaimed += u.Size
+		}
+	}
+
+	result := PurgeResult{Scope: scope, DryRun: dryRun, Uploads: purged, ReclaimedBytes: reclaimed}
+	err = printResult(result, func(out io.Writer) error {
+		w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+		_, _ = fmt.Fprintln(w, "REPOSITORY\tUPLOAD\tSTARTED\tSIZE")
+		for _, u := range purged {
+			_, _ = fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", u.Repository, u.ID, u.StartedAt.UTC().Format(time.RFC3339), humanSize(u.Size))
+		}
+		return w.Flush()
+	})
+	if err != nil {
+		return err
+	}
+	if dryRun {
+		slog.Info("Dry run, nothing deleted", "uploads", len(purged), "size", humanSize(reclaimed))
+		return nil
+	}
+	slog.Info("Purged abandoned uploads", "uploads", len(purged), "reclaimed", humanSize(reclaimed))
+	return nil
+}
+
+// listUploads returns the unfinished uploads of repo. StartedAt is zero when
+// the upload has no readable start time.
+func listUploads(ctx context.Context, d storagedriver.StorageDriver, repo string) ([]Upload, error) {
+	dirs, err := d.List(ctx, path.Join(repositoriesRoot, repo, "_uploads"))
+	if isPathNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(dirs)
+
+	uploads := make([]Upload, 0, len(dirs))
+	for _, dir := range dirs {
+		u := Upload{Repository: repo, ID: path.Base(dir), path: dir}
+		if content, err := d.GetContent(ctx, path.Join(dir, "startedat")); err == nil {
+			u.StartedAt, _ = time.Parse(time.RFC3339, strings.TrimSpace(string(content)))
+		}
+		if info, err := d.Stat(ctx, path.Join(dir, "data")); err == nil {
+			u.Size = info.Size()
+		}
+		uploads = append(uploads, u)
+	}
+	return uploads, nil
+}
+
+// deleteUpload removes an upload and returns the number of bytes it held.
+// On S3 the data of an unfinished upload lives in a multipart upload that
+// deleting the directory leaves behind, so it is resumed and cancelled first.
+func deleteUpload(ctx context.Context, d storagedriver.StorageDriver, u Upload) (int64, error) {
+	size := u.Size
+	if w, err := d.Writer(ctx, path.Join(u.path, "data"), true); err == nil {
+		size = max(size, w.Size())
+		if err := w.Cancel(ctx); err != nil {
+			slog.Debug("Failed to cancel upload data", "id", u.ID, "error", err)
+		}
+	}
+	if err := d.Delete(ctx, u.path); err != nil && !isPathNotFound(err) {
+		return 0, err
+	}
+	return size, nil
+}
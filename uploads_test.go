@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPurgeUploads(t *testing.T) {
+	reg, dir := startFSRegistry(t)
+
+	// Start an upload and send some data without ever completing it.
+	resp, err := http.Post("http://"+reg.RegistryStr()+"/v2/app/blobs/uploads/", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("starting upload: status %d", resp.StatusCode)
+	}
+	req, _ := http.NewRequest(http.MethodPatch, resp.Header.Get("Location"), bytes.NewReader(make([]byte, 4096)))
+	req.Header.Set("Content-Type", "application/octet-stream")
+	if resp, err = http.DefaultClient.Do(req); err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+
+	d, err := openStorageDriver(context.Background(), "filesystem", "bucket")
+	if err != nil {
+		t.Fatal(err)
+	}
+	uploads, err := listUploads(context.Background(), d, "app")
+	if err != nil {
+		t.Fatalf("listUploads() error = %v", err)
+	}
+	if len(uploads) != 1 || uploads[0].Size != 4096 || uploads[0].StartedAt.IsZero() {
+		t.Fatalf("listUploads() = %+v, want one 4096 byte upload", uploads)
+	}
+	uploadDir := filepath.Join(dir, "docker", "registry", "v2", "repositories", "app", "_uploads", uploads[0].ID)
+
+	// Too recent to be purged.
+	if err := purgeUploads(context.Background(), "filesystem", "bucket", time.Hour, false); err != nil {
+		t.Fatalf("purgeUploads() error = %v", err)
+	}
+	if _, err := os.Stat(uploadDir); err != nil {
+		t.Fatalf("recent upload was purged: %v", err)
+	}
+
+	started := time.Now().Add(-48 * time.Hour).UTC().Format(time.RFC3339)
+	if err := os.WriteFile(filepath.Join(uploadDir, "startedat"), []byte(started), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := purgeUploads(context.Background(), "filesystem", "bucket/app", 24*time.Hour, true); err != nil {
+		t.Fatalf("purgeUploads() dry run error = %v", err)
+	}
+	if _, err := os.Stat(uploadDir); err != nil {
+		t.Fatalf("dry run deleted the upload: %v", err)
+	}
+	if err := purgeUploads(context.Background(), "filesystem", "bucket", 24*time.Hour, false); err != nil {
+		t.Fatalf("purgeUploads() error = %v", err)
+	}
+	if _, err := os.Stat(uploadDir); !os.IsNotExist(err) {
+		t.Errorf("abandoned upload still exists: %v", err)
+	}
+}
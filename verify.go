@@ -0,0 +1,317 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"path"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/spf13/cobra"
+)
+
+const (
+	severityError   = "error"
+	severityWarning = "warning"
+)
+
+// VerifyResult is the result of verify printed with --output json.
+type VerifyResult struct {
+	Scope    string    `json:"scope"`
+	Findings []Finding `json:"findings"`
+	Errors   int       `json:"errors"`
+	Warnings int       `json:"warnings"`
+}
+
+// Finding is a problem reported by verify.
+type Finding struct {
+	Severity   string `json:"severity"`
+	Repository string `json:"repository"`
+	Message    string `json:"message"`
+}
+
+func newVerifyCmd(storageType string, validate func() error) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "verify <bucket>[/<image-path>[:<tag>]]",
+		Short: "Check stored images for missing or corrupted blobs",
+		Long: `Walk the manifests of a bucket, a repository or a single tag and check that
+every referenced blob exists and matches its digest. Dangling tag links are
+reported as errors; revisions no tag refers to and leftover uploads as
+warnings. The command fails when any error is found.`,
+		Args: cobra.ExactArgs(1),
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			return validate()
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			skipHash, _ := cmd.Flags().GetBool("skip-hash")
+			return verifyStorage(cmd.Context(), storageType, args[0], skipHash)
+		},
+	}
+	cmd.Flags().Bool("skip-hash", false, "Only check that blobs exist and have the expected size")
+	return cmd
+}
+
+func verifyStorage(ctx context.Context, storageType string, scope string, skipHash bool) error {
+	bucket, repoPath, _ := strings.Cut(scope, "/")
+	repoPath, tag, _ := strings.Cut(repoPath, ":")
+	if bucket == "" {
+		return invalidf("invalid scope %q, expected <bucket>[/<image-path>[:<tag>]]", scope)
+	}
+	d, err := openStorageDriver(ctx, storageType, bucket)
+	if err != nil {
+		return err
+	}
+
+	findings, err := newVerifier(d, !skipHash).run(ctx, repoPath, tag)
+	if err != nil {
+		return err
+	}
+
+	result := VerifyResult{Scope: scope, Findings: findings}
+	if result.Findings == nil {
+		result.Findings = []Finding{}
+	}
+	for _, f := range findings {
+		if f.Severity == severityError {
+			result.Errors++
+		} else {
+			result.Warnings++
+		}
+	}
+	err = printResult(result, func(out io.Writer) error {
+		w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+		for _, f := range findings {
+			_, _ = fmt.Fprintf(w, "%s\t%s\t%s\n", strings.ToUpper(f.Severity), f.Repository, f.Message)
+		}
+		return w.Flush()
+	})
+	if err != nil {
+		return err
+	}
+	if result.Errors > 0 {
+		return reportedError{err: fmt.Errorf("found %d errors in %s", result.Errors, scope)}
+	}
+	slog.Info("Verification passed", "scope", scope, "warnings", result.Warnings)
+	return nil
+}
+
+type verifier struct {
+	driver storagedriver.StorageDriver
+	hash   bool
+	// blobs caches the result of checking a blob, which can be shared by
+	// several repositories. An empty string means the blob is intact.
+	blobs    map[v1.Hash]string
+	findings []Finding
+}
+
+func newVerifier(d storagedriver.StorageDriver, hash bool) *verifier {
+	return &verifier{driver: d, hash: hash, blobs: map[v1.Hash]string{}}
+}
+
+// run verifies repoPath, or every repository when it is empty, and returns
+// the findings. When tag is set only that tag is checked and unreferenced
+// revisions are not reported.
+func (v *verifier) run(ctx context.Context, repoPath string, tag string) ([]Finding, error) {
+	repos := []string{repoPath}
+	if repoPath == "" {
+		var err error
+		if repos, err = listRepositories(ctx, v.driver, repositoriesRoot); err != nil {
+			return nil, fmt.Errorf("failed to list repositories: %w", err)
+		}
+		sort.Strings(repos)
+	}
+	for _, repo := range repos {
+		if err := v.verifyRepository(ctx, repo, tag); err != nil {
+			return nil, err
+		}
+	}
+	return v.findings, nil
+}
+
+func (v *verifier) report(severity string, repo string, format string, args ...any) {
+	v.findings = append(v.findings, Finding{Severity: severity, Repository: repo, Message: fmt.Sprintf(format, args...)})
+}
+
+func (v *verifier) verifyRepository(ctx context.Context, repo string, onlyTag string) error {
+	base := path.Join(repositoriesRoot, repo)
+	revisions, err := listLinkDigests(ctx, v.driver, path.Join(base, "_manifests", "revisions"))
+	if err != nil {
+		return err
+	}
+	tags, err := v.driver.List(ctx, path.Join(base, "_manifests", "tags"))
+	if err != nil && !isPathNotFound(err) {
+		return err
+	}
+	if len(revisions) == 0 && len(tags) == 0 {
+		if _, err := v.driver.Stat(ctx, base); isPathNotFound(err) {
+			return fmt.Errorf("repository %s does not exist", repo)
+		}
+	}
+
+	r := &repoCheck{verifier: v, repo: repo, base: base, revisions: revisions, visited: map[v1.Hash]bool{}}
+	found := false
+	for _, tagDir := range tags {
+		tag := path.Base(tagDir)
+		if onlyTag != "" && tag != onlyTag {
+			continue
+		}
+		found = true
+		d, err := readLink(ctx, v.driver, path.Join(tagDir, "current", "link"))
+		if err != nil {
+			v.report(severityError, repo, "tag %s has an unreadable link: %v", tag, err)
+			continue
+		}
+		if !revisions[d] {
+			v.report(severityError, repo, "tag %s points to missing revision %s", tag, d)
+			continue
+		}
+		r.verifyManifest(ctx, d)
+	}
+	if onlyTag != "" {
+		if !found {
+			return fmt.Errorf("tag %s:%s does not exist", repo, onlyTag)
+		}
+		return nil
+	}
+
+	var orphans []string
+	for d := range revisions {
+		if !r.visited[d] {
+			orphans = append(orphans, d.String())
+		}
+	}
+	sort.Strings(orphans)
+	for _, o := range orphans {
+		v.report(severityWarning, repo, "revision %s is not referenced by any tag", o)
+		d, _ := v1.NewHash(o)
+		r.verifyManifest(ctx, d)
+	}
+
+	uploads, err := listUploads(ctx, v.driver, repo)
+	if err != nil {
+		return err
+	}
+	for _, u := range uploads {
+		if u.StartedAt.IsZero() {
+			v.report(severityWarning, repo, "leftover upload %s", u.ID)
+		} else {
+			v.report(severityWarning, repo, "leftover upload %s started at %s", u.ID, u.StartedAt.UTC().Format(time.RFC3339))
+		}
+	}
+	return nil
+}
+
+// checkBlob returns a description of what is wrong with the blob, or an empty
+// string when it exists, has the expected size and, when hashing, matches its
+// digest. size is ignored when negative.
+func (v *verifier) checkBlob(ctx context.Context, h v1.Hash, size int64) string {
+	if problem, ok := v.blobs[h]; ok {
+		return problem
+	}
+	problem := v.inspectBlob(ctx, h, size)
+	v.blobs[h] = problem
+	return problem
+}
+
+func (v *verifier) inspectBlob(ctx context.Context, h v1.Hash, size int64) string {
+	p := blobDataPath(h)
+	info, err := v.driver.Stat(ctx, p)
+	if isPathNotFound(err) {
+		return fmt.Sprintf("blob %s is missing", h)
+	}
+	if err != nil {
+		return fmt.Sprintf("blob %s cannot be read: %v", h, err)
+	}
+	if size >= 0 && info.Size() != size {
+		return fmt.Sprintf("blob %s has size %d, expected %d", h, info.Size(), size)
+	}
+	if !v.hash || h.Algorithm != "sha256" {
+		return ""
+	}
+	r, err := v.driver.Reader(ctx, p, 0)
+	if err != nil {
+		return fmt.Sprintf("blob %s cannot be read: %v", h, err)
+	}
+	defer func() { _ = r.Close() }()
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, r); err != nil {
+		return fmt.Sprintf("blob %s cannot be read: %v", h, err)
+	}
+	if got := hex.EncodeToString(hasher.Sum(nil)); got != h.Hex {
+		return fmt.Sprintf("blob %s is corrupted, content hashes to sha256:%s", h, got)
+	}
+	return ""
+}
+
+// repoCheck holds the state of verifying one repository.
+type repoCheck struct {
+	*verifier
+	repo      string
+	base      string
+	revisions map[v1.Hash]bool
+	visited   map[v1.Hash]bool
+}
+
+// storedManifest covers the fields of image manifests, artifact manifests and
+// indexes that reference other content.
+type storedManifest struct {
+	Config    *v1.Descriptor  `json:"config"`
+	Layers    []v1.Descriptor `json:"layers"`
+	Manifests []v1.Descriptor `json:"manifests"`
+}
+
+func (r *repoCheck) verifyManifest(ctx context.Context, d v1.Hash) {
+	if r.visited[d] {
+		return
+	}
+	r.visited[d] = true
+
+	if problem := r.checkBlob(ctx, d, -1); problem != "" {
+		r.report(severityError, r.repo, "manifest %s", problem)
+		return
+	}
+	content, err := r.driver.GetContent(ctx, blobDataPath(d))
+	if err != nil {
+		r.report(severityError, r.repo, "manifest %s cannot be read: %v", d, err)
+		return
+	}
+	var m storedManifest
+	if err := json.Unmarshal(content, &m); err != nil {
+		r.report(severityError, r.repo, "manifest %s is not valid JSON: %v", d, err)
+		return
+	}
+
+	for _, child := range m.Manifests {
+		if !r.revisions[child.Digest] {
+			r.report(severityError, r.repo, "index %s references missing manifest %s", d, child.Digest)
+			continue
+		}
+		r.verifyManifest(ctx, child.Digest)
+	}
+	blobs := m.Layers
+	if m.Config != nil {
+		blobs = append([]v1.Descriptor{*m.Config}, blobs...)
+	}
+	for _, desc := range blobs {
+		// Foreign layers are served from their URLs, not from the bucket.
+		if len(desc.URLs) > 0 {
+			continue
+		}
+		if _, err := r.driver.Stat(ctx, path.Join(r.base, "_layers", desc.Digest.Algorithm, desc.Digest.Hex, "link")); isPathNotFound(err) {
+			r.report(severityError, r.repo, "manifest %s references blob %s that is not linked into the repository", d, desc.Digest)
+			continue
+		}
+		if problem := r.checkBlob(ctx, desc.Digest, desc.Size); problem != "" {
+			r.report(severityError, r.repo, "manifest %s references %s", d, problem)
+		}
+	}
+}
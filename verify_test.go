@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+// startFSRegistry serves a bucket of a temporary filesystem backend and
+// returns the registry and the bucket's directory.
+func startFSRegistry(t *testing.T) (name.Registry, string) {
+	t.Helper()
+	old := fsRootDirectory
+	fsRootDirectory = t.TempDir()
+	t.Cleanup(func() { fsRootDirectory = old })
+
+	reg, err := openStorageRegistry(context.Background(), "filesystem", "bucket")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { stopRegistries(context.Background()) })
+	waitForRegistry(t, reg.RegistryStr())
+	return reg, filepath.Join(fsRootDirectory, "bucket")
+}
+
+// waitForRegistry waits until the registry at addr answers.
+func waitForRegistry(t *testing.T, addr string) {
+	t.Helper()
+	for i := 0; ; i++ {
+		resp, err := http.Get("http://" + addr + "/v2/")
+		if err == nil {
+			_ = resp.Body.Close()
+			return
+		}
+		if i == 100 {
+			t.Fatalf("registry did not start: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func runVerifier(t *testing.T, repo, tag string) []Finding {
+	t.Helper()
+	d, err := openStorageDriver(context.Background(), "filesystem", "bucket")
+	if err != nil {
+		t.Fatal(err)
+	}
+	findings, err := newVerifier(d, true).run(context.Background(), repo, tag)
+	if err != nil {
+		t.Fatalf("verifier.run() error = %v", err)
+	}
+	return findings
+}
+
+func hasFinding(findings []Finding, severity, substr string) bool {
+	for _, f := range findings {
+		if f.Severity == severity && strings.Contains(f.Message, substr) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestVerifier(t *testing.T) {
+	reg, dir := startFSRegistry(t)
+	v2 := filepath.Join(dir, "docker", "registry", "v2")
+	write := func(ref string, img v1.Image) {
+		tag, _ := name.NewTag(reg.RegistryStr()+"/"+ref, name.Insecure)
+		if err := remote.Write(tag, img); err != nil {
+			t.Fatalf("remote.Write(%s) error = %v", ref, err)
+		}
+	}
+	app, _ := random.Image(512, 2)
+	old, _ := random.Image(256, 1)
+	db, _ := random.Image(256, 1)
+	write("team/app:v1", app)
+	write("db:v1", old)
+	write("db:v1", db)
+
+	if findings := runVerifier(t, "", ""); hasFinding(findings, severityError, "") {
+		t.Fatalf("intact bucket has errors: %+v", findings)
+	} else if oldDigest, _ := old.Digest(); !hasFinding(findings, severityWarning, "revision "+oldDigest.String()) {
+		t.Errorf("overwritten revision of db:v1 not reported: %+v", findings)
+	}
+
+	// Corrupt one layer of the app image and delete the db config.
+	layers, _ := app.Layers()
+	corrupt, _ := layers[0].Digest()
+	corruptSize, _ := layers[0].Size()
+	if err := os.WriteFile(filepath.Join(v2, "blobs", "sha256", corrupt.Hex[:2], corrupt.Hex, "data"), make([]byte, corruptSize), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	config, _ := db.ConfigName()
+	if err := os.RemoveAll(filepath.Join(v2, "blobs", "sha256", config.Hex[:2], config.Hex)); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(v2, "repositories", "db", "_uploads", "0123-abcd"), 0o750); err != nil {
+		t.Fatal(err)
+	}
+
+	findings := runVerifier(t, "", "")
+	if !hasFinding(findings, severityError, corrupt.String()+" is corrupted") {
+		t.Errorf("corrupted layer not reported: %+v", findings)
+	}
+	if !hasFinding(findings, severityError, config.String()+" is missing") {
+		t.Errorf("missing config not reported: %+v", findings)
+	}
+	if !hasFinding(findings, severityWarning, "leftover upload 0123-abcd") {
+		t.Errorf("leftover upload not reported: %+v", findings)
+	}
+
+	// A tag whose revision link is gone is dangling.
+	appDigest, _ := app.Digest()
+	if err := os.RemoveAll(filepath.Join(v2, "repositories", "team", "app", "_manifests", "revisions", "sha256", appDigest.Hex)); err != nil {
+		t.Fatal(err)
+	}
+	findings = runVerifier(t, "team/app", "v1")
+	if !hasFinding(findings, severityError, "tag v1 points to missing revision") {
+		t.Errorf("dangling tag not reported: %+v", findings)
+	}
+
+	// The result already lists the errors, so main must not print another
+	// JSON document for the failure.
+	oldFormat := outputFormat
+	t.Cleanup(func() { outputFormat = oldFormat })
+	outputFormat = outputJSON
+	err := verifyStorage(context.Background(), "filesystem", "bucket", false)
+	var reported reportedError
+	if !errors.As(err, &reported) || exitCode(err) != exitFailure {
+		t.Errorf("verifyStorage() error = %#v, want a reported failure", err)
+	}
+}